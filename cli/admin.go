@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/mahadevans87/go-send/cli/network"
+)
+
+// adminUsage - How go-send admin is called
+const adminUsage = "Usage: go-send admin [-signal-url url] [-admin-key key] [-json] status | rooms | room <token> | kick <token> <peer> | close <token> | drain | undrain"
+
+// runAdmin - go-send admin: inspects and manages the rooms of the signalling server through its admin API
+func runAdmin(args []string) {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	adminKey := flags.String("admin-key", os.Getenv("GO_SEND_ADMIN_KEY"), "Admin key of the signalling server (or GO_SEND_ADMIN_KEY)")
+	signalURL := flags.String("signal-url", signalURLFromEnv(), "Base URL of the signalling server (or GO_SEND_SIGNAL_URL)")
+	asJSON := flags.Bool("json", false, "Print what the server answers as JSON instead of tables")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), adminUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	domain.SignalBaseURL = strings.TrimSuffix(*signalURL, "/")
+
+	command := flags.Args()
+	arguments := map[string]int{"status": 0, "rooms": 0, "room": 1, "kick": 2, "close": 1, "drain": 0, "undrain": 0}
+	if len(command) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if count, ok := arguments[command[0]]; !ok || len(command)-1 != count {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var result interface{}
+	var err error
+	switch command[0] {
+	case "status":
+		result, err = network.FetchServerStatus(*adminKey)
+	case "rooms":
+		result, err = network.FetchRooms(*adminKey)
+	case "room":
+		var room *domain.RoomStatus
+		if room, err = network.FetchRoom(*adminKey, command[1]); err == nil {
+			result = []domain.RoomStatus{*room}
+		}
+	case "kick":
+		err = network.KickPeer(*adminKey, command[1], command[2])
+	case "close":
+		err = network.CloseRoom(*adminKey, command[1])
+	case "drain", "undrain":
+		if err = network.Drain(*adminKey, command[0] == "drain"); err == nil {
+			result, err = network.FetchServerStatus(*adminKey)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		if result == nil {
+			result = map[string]string{"message": "OK"}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	switch result := result.(type) {
+	case *domain.ServerStatus:
+		printServerStatus(result)
+	case []domain.RoomStatus:
+		printRooms(result)
+	default:
+		fmt.Println("OK")
+	}
+}
+
+// printServerStatus - Prints the status as a table
+func printServerStatus(status *domain.ServerStatus) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "DRAINING\tROOMS\tPEERS\tQUEUED")
+	fmt.Fprintf(table, "%t\t%d\t%d\t%d\n", status.Draining, status.Rooms, status.Peers, status.QueuedMessages)
+	table.Flush()
+}
+
+// printRooms - Prints a line per peer, the room's columns only on its first
+func printRooms(rooms []domain.RoomStatus) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TOKEN\tSIZE\tOWNER\tAGE\tPEER\tMODE\tLAST SEEN\tQUEUED")
+	for _, room := range rooms {
+		owner := room.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		roomColumns := fmt.Sprintf("%s\t%d\t%s\t%s", room.Token, room.Size, owner, since(room.Created))
+		for _, peer := range room.Peers {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s ago\t%d\n", roomColumns, peer.ID, peer.Mode, since(peer.LastSeen), peer.Queued)
+			roomColumns = "\t\t\t"
+		}
+	}
+	table.Flush()
+}
+
+// since - How long ago moment was, to the second
+func since(moment time.Time) time.Duration {
+	return time.Since(moment).Round(time.Second)
+}
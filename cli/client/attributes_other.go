@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package client
+
+import (
+	"os"
+)
+
+// fileOwner - Ownership is not preserved on this platform
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// readXattrs - Extended attributes are not preserved on this platform
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs - Extended attributes are not preserved on this platform
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package client
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner - The owner and group of a file
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// readXattrs - The extended attributes of a file in the user namespace, without following symlinks
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreUnsupported(err)
+	}
+	buffer := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buffer); err != nil {
+		return nil, ignoreUnsupported(err)
+	}
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buffer[:size]), "\x00") {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:valueSize]
+	}
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return attrs, nil
+}
+
+// writeXattrs - Sets extended attributes in the user namespace, without following symlinks
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// ignoreUnsupported - File systems without extended attributes simply have none
+func ignoreUnsupported(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression settings. A sender offers codecs in the manifest, the receiver picks one in its ACCEPT.
+const (
+	// CompressionAuto - zstd, unless the file looks already compressed
+	CompressionAuto = "auto"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// Codec ids carried in every frame header so that any peer can decode a chunk
+const (
+	codecNone byte = iota
+	codecGzip
+	codecZstd
+)
+
+// minCompressionGain - The first chunk must shrink to at most this fraction for compression to be offered
+const minCompressionGain = 0.9
+
+// compressedExtensions - Formats that do not compress any further
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true, ".lz4": true, ".zip": true,
+	".7z": true, ".rar": true, ".jar": true, ".apk": true, ".jpg": true, ".jpeg": true, ".png": true,
+	".gif": true, ".webp": true, ".mp3": true, ".mp4": true, ".mkv": true, ".webm": true, ".mov": true,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd - EncodeAll and DecodeAll are safe for concurrent use, so one of each is shared
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		// Also caps the window, a hostile frame cannot make us allocate more than a chunk
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxChunkSize))
+	})
+	return zstdErr
+}
+
+// codecID - Frame header id of a codec name
+func codecID(compression string) byte {
+	switch compression {
+	case CompressionZstd:
+		return codecZstd
+	case CompressionGzip:
+		return codecGzip
+	default:
+		return codecNone
+	}
+}
+
+// compressChunk - Encodes a chunk with the given codec
+func compressChunk(codec byte, chunk []byte) ([]byte, error) {
+	switch codec {
+	case codecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(chunk, make([]byte, 0, len(chunk))), nil
+	case codecGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(chunk); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	default:
+		return chunk, nil
+	}
+}
+
+// decompressChunk - Reverse of compressChunk. Decodes at most one byte more than the length
+// expected, the caller rejects a chunk of any other length.
+func decompressChunk(codec byte, data []byte, length int64) ([]byte, error) {
+	switch codec {
+	case codecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	case codecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(io.LimitReader(reader, length+1))
+	case codecNone:
+		return data, nil
+	default:
+		return nil, &AppError{fmt.Sprintf("Unknown compression codec %d", codec)}
+	}
+}
+
+// offeredCompression - What the sender offers for a file, in order of preference.
+// With auto nothing is offered for files that are already compressed, judged by their
+// extension or by trial compressing the first chunk.
+func offeredCompression(setting string, path string, firstChunk []byte) []string {
+	switch setting {
+	case CompressionZstd:
+		return []string{CompressionZstd, CompressionGzip}
+	case CompressionGzip:
+		return []string{CompressionGzip}
+	case CompressionAuto:
+	default:
+		return nil
+	}
+
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		fmt.Printf("Not compressing %s, it is already compressed\n", filepath.Base(path))
+		return nil
+	}
+	if len(firstChunk) > 0 {
+		trial, err := compressChunk(codecZstd, firstChunk)
+		if err != nil || float64(len(trial)) > float64(len(firstChunk))*minCompressionGain {
+			fmt.Printf("Not compressing %s, its first chunk does not compress well\n", filepath.Base(path))
+			return nil
+		}
+	}
+	return []string{CompressionZstd, CompressionGzip}
+}
+
+// acceptedCompression - The codec a receiver picks out of the sender's offer
+func acceptedCompression(setting string, offered []string) string {
+	if setting == CompressionNone {
+		return CompressionNone
+	}
+	for _, codec := range offered {
+		if codec == setting {
+			return codec
+		}
+	}
+	for _, codec := range offered {
+		if codec == CompressionZstd || codec == CompressionGzip {
+			return codec
+		}
+	}
+	return CompressionNone
+}
+
+// compressionSummary - Describes how much compression saved
+func compressionSummary(compression string, rawBytes int64, encodedBytes int64) string {
+	if compression == CompressionNone || compression == "" || rawBytes == 0 {
+		return "uncompressed"
+	}
+	return fmt.Sprintf("%s compressed %v bytes to %v (ratio %.2f)", compression, rawBytes, encodedBytes, float64(rawBytes)/float64(encodedBytes))
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressChunk(t *testing.T) {
+	chunk := bytes.Repeat([]byte("go-send compresses chunks "), 4096)
+	tests := []struct {
+		name  string
+		codec byte
+	}{
+		{name: "none", codec: codecNone},
+		{name: "gzip", codec: codecGzip},
+		{name: "zstd", codec: codecZstd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := compressChunk(test.codec, chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.codec != codecNone && len(encoded) >= len(chunk) {
+				t.Errorf("Compressed %d bytes to %d", len(chunk), len(encoded))
+			}
+			decoded, err := decompressChunk(test.codec, encoded, int64(len(chunk)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, chunk) {
+				t.Errorf("Decompressed %d bytes that differ from the chunk", len(decoded))
+			}
+		})
+	}
+}
+
+func TestDecompressChunkLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec byte
+		size  int
+	}{
+		{name: "gzip stops after the expected length", codec: codecGzip, size: 1 << 20},
+		{name: "zstd refuses more than a chunk", codec: codecZstd, size: maxChunkSize + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := compressChunk(test.codec, make([]byte, test.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, err := decompressChunk(test.codec, encoded, 1024); err == nil && len(decoded) > 1025 {
+				t.Errorf("Decompressed %d bytes where 1024 were expected", len(decoded))
+			}
+		})
+	}
+}
+
+func TestDecompressUnknownCodec(t *testing.T) {
+	if _, err := decompressChunk(9, []byte("data"), 4); err == nil {
+		t.Error("Decompressing with an unknown codec succeeded")
+	}
+}
+
+func TestAcceptedCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		offered []string
+		want    string
+	}{
+		{name: "nothing offered", setting: CompressionAuto, offered: nil, want: CompressionNone},
+		{name: "auto takes the sender's first", setting: CompressionAuto, offered: []string{CompressionZstd, CompressionGzip}, want: CompressionZstd},
+		{name: "the codec asked for", setting: CompressionGzip, offered: []string{CompressionZstd, CompressionGzip}, want: CompressionGzip},
+		{name: "another codec if ours is not offered", setting: CompressionGzip, offered: []string{CompressionZstd}, want: CompressionZstd},
+		{name: "none refuses every codec", setting: CompressionNone, offered: []string{CompressionZstd}, want: CompressionNone},
+		{name: "unknown codecs are not taken", setting: CompressionAuto, offered: []string{"brotli"}, want: CompressionNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := acceptedCompression(test.setting, test.offered); got != test.want {
+				t.Errorf("acceptedCompression(%q, %v) = %q, want %q", test.setting, test.offered, got, test.want)
+			}
+		})
+	}
+}
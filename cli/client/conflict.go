@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What a receiver does when the destination file already exists. A copy identical to the sender's
+// file is always kept as it is, whatever the policy, and the sender sends nothing.
+const (
+	// ConflictOverwrite - Replace the existing file once the new one has been verified
+	ConflictOverwrite = "overwrite"
+	// ConflictRename - Keep the existing file, write to "name (1).ext" instead
+	ConflictRename = "rename"
+	// ConflictSkip - Keep the existing file and receive nothing
+	ConflictSkip = "skip"
+	// ConflictResume - Keep the chunks of an interrupted transfer, or of the existing file, that match
+	// the sender's and only fetch the rest
+	ConflictResume = "resume"
+	// ConflictAsk - Ask on the terminal which of the above to do
+	ConflictAsk = "ask"
+)
+
+// partSuffix - Files are received into a hidden "<name>.gosend-part" next to the destination and only
+// renamed to it once verified, so the destination never holds a partial or corrupt file
+const partSuffix = ".gosend-part"
+
+// ValidConflictPolicy - Whether policy is one of the Conflict constants, empty leaves the choice to the sender
+func ValidConflictPolicy(policy string) bool {
+	switch policy {
+	case "", ConflictOverwrite, ConflictRename, ConflictSkip, ConflictResume, ConflictAsk:
+		return true
+	}
+	return false
+}
+
+// partPath - The temporary file a destination is received into
+func partPath(destPath string) string {
+	return filepath.Join(filepath.Dir(destPath), "."+filepath.Base(destPath)+partSuffix)
+}
+
+// renamedPath - The first of "name (1).ext", "name (2).ext", ... that does not exist yet
+func renamedPath(destPath string) string {
+	ext := filepath.Ext(destPath)
+	base := strings.TrimSuffix(destPath, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// askConflict - Asks the user what to do about an existing file. Falls back to renaming
+// when there is nobody to ask.
+func askConflict(destPath string, input io.Reader) string {
+	reader := bufio.NewReader(input)
+	for {
+		fmt.Printf("\n%s already exists. [o]verwrite, [r]ename, [s]kip or r[e]sume? ", destPath)
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Printf("\nNo answer, keeping the existing file and renaming the new one\n")
+			return ConflictRename
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "o", "overwrite":
+			return ConflictOverwrite
+		case "r", "rename":
+			return ConflictRename
+		case "s", "skip":
+			return ConflictSkip
+		case "e", "resume":
+			return ConflictResume
+		}
+	}
+}
+
+// copyFile - Copies src over dst, used to resume from an existing destination without touching it
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
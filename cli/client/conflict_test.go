@@ -0,0 +1,39 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenamedPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		dest     string
+		want     string
+	}{
+		{name: "the first free number", existing: []string{"report.pdf"}, dest: "report.pdf", want: "report (1).pdf"},
+		{name: "skips taken numbers", existing: []string{"report.pdf", "report (1).pdf", "report (2).pdf"}, dest: "report.pdf", want: "report (3).pdf"},
+		{name: "without an extension", existing: []string{"notes"}, dest: "notes", want: "notes (1)"},
+		{name: "only the last extension", existing: []string{"backup.tar.gz"}, dest: "backup.tar.gz", want: "backup.tar (1).gz"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "go-send-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range test.existing {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := renamedPath(filepath.Join(dir, test.dest)); got != filepath.Join(dir, test.want) {
+				t.Errorf("renamedPath(%q) = %q, want %q", test.dest, got, filepath.Join(dir, test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Delta transfers, for files of which the receiver already has an older version. The receiver
+// splits its copy into blocks and sends a signature of each, the sender slides a window over its
+// file and sends references to blocks the receiver already has in place of the bytes they hold.
+
+const (
+	// minDeltaBlockSize and maxDeltaBlockSize - Bounds of the block size, which grows with the
+	// square root of the file size like rsync's
+	minDeltaBlockSize = 2 << 10
+	maxDeltaBlockSize = 64 << 10
+	// maxDeltaLiteral - Literal bytes carried by a single op, base64 keeps it well below a data channel message
+	maxDeltaLiteral = 32 << 10
+	// maxDeltaCopy - Bytes a receiver copies out of its old file at once
+	maxDeltaCopy = 1 << 20
+	// signaturesPerMessage - Block signatures that comfortably fit in one data channel message
+	signaturesPerMessage = 512
+	// opsPerMessage - Ops of a delta message, together with maxDeltaLiteral this keeps messages small
+	opsPerMessage = 256
+)
+
+// BlockSignature - Identifies a block of the receiver's copy: a rolling checksum that is cheap to
+// slide over the sender's file, and a strong hash to confirm what the rolling one matches
+type BlockSignature struct {
+	Weak   uint32 `json:"w"`
+	Strong string `json:"s"`
+}
+
+// DeltaOp - Either Data to write as is, or Count blocks of the receiver's copy starting at Block
+type DeltaOp struct {
+	Block int    `json:"b,omitempty"`
+	Count int    `json:"n,omitempty"`
+	Data  []byte `json:"d,omitempty"`
+}
+
+// deltaBlockSize - Block size for a receiver's copy of size bytes
+func deltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size))+1023) &^ 1023
+	if blockSize < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+	if blockSize > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return blockSize
+}
+
+// rollingChecksum - rsync's weak checksum of a window, updated in constant time as the window slides
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(window []byte) rollingChecksum {
+	checksum := rollingChecksum{n: uint32(len(window))}
+	for i, c := range window {
+		checksum.a += uint32(c)
+		checksum.b += (checksum.n - uint32(i)) * uint32(c)
+	}
+	return checksum
+}
+
+// roll - The window lost out at its start and gained in at its end
+func (checksum *rollingChecksum) roll(out byte, in byte) {
+	checksum.a += uint32(in) - uint32(out)
+	checksum.b += checksum.a - checksum.n*uint32(out)
+}
+
+// shrink - The window lost out at its start, at the end of the file
+func (checksum *rollingChecksum) shrink(out byte) {
+	checksum.a -= uint32(out)
+	checksum.b -= checksum.n * uint32(out)
+	checksum.n--
+}
+
+func (checksum *rollingChecksum) sum() uint32 {
+	return checksum.a&0xffff | checksum.b<<16
+}
+
+// strongHash - Hex of the first half of the block's sha256
+func strongHash(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// computeSignatures - Signs every block of the receiver's copy
+func computeSignatures(base io.Reader, blockSize int) ([]BlockSignature, error) {
+	reader := bufio.NewReaderSize(base, maxDeltaCopy)
+	block := make([]byte, blockSize)
+	signatures := make([]BlockSignature, 0)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			checksum := newRollingChecksum(block[:n])
+			signatures = append(signatures, BlockSignature{Weak: checksum.sum(), Strong: strongHash(block[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signatures, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deltaEncoder - Turns the sender's file into ops against the receiver's signatures
+type deltaEncoder struct {
+	signatures []BlockSignature
+	blockSize  int
+	// lastBlockSize - The receiver's last block may be shorter than the others
+	lastBlockSize int
+	weak          map[uint32][]int
+	emit          func(op DeltaOp) error
+
+	literal []byte
+	copying DeltaOp
+	// Literal and Matched - Bytes sent as is and bytes found in the receiver's copy
+	Literal int64
+	Matched int64
+}
+
+func newDeltaEncoder(signatures []BlockSignature, blockSize int, baseSize int64, emit func(op DeltaOp) error) *deltaEncoder {
+	encoder := &deltaEncoder{
+		signatures:    signatures,
+		blockSize:     blockSize,
+		lastBlockSize: int(baseSize - int64(len(signatures)-1)*int64(blockSize)),
+		weak:          make(map[uint32][]int),
+		emit:          emit,
+	}
+	for index, signature := range signatures {
+		encoder.weak[signature.Weak] = append(encoder.weak[signature.Weak], index)
+	}
+	return encoder
+}
+
+// blockLength - Length of block index of the receiver's copy
+func (encoder *deltaEncoder) blockLength(index int) int {
+	if index == len(encoder.signatures)-1 {
+		return encoder.lastBlockSize
+	}
+	return encoder.blockSize
+}
+
+// match - The receiver's block holding exactly window, if any
+func (encoder *deltaEncoder) match(window []byte, checksum rollingChecksum) (int, bool) {
+	candidates := encoder.weak[checksum.sum()]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := ""
+	found, ok := 0, false
+	for _, index := range candidates {
+		if encoder.blockLength(index) != len(window) {
+			continue
+		}
+		if strong == "" {
+			strong = strongHash(window)
+		}
+		if encoder.signatures[index].Strong != strong {
+			continue
+		}
+		// Prefer continuing the current run of copied blocks, it costs nothing to send
+		if encoder.copying.Count > 0 && index == encoder.copying.Block+encoder.copying.Count {
+			return index, true
+		}
+		if !ok {
+			found, ok = index, true
+		}
+	}
+	return found, ok
+}
+
+// encode - Reads source to the end, emitting ops as it goes
+func (encoder *deltaEncoder) encode(source io.Reader) error {
+	reader := bufio.NewReaderSize(source, maxDeltaCopy)
+	buffer := make([]byte, 0, 4*encoder.blockSize)
+	start := 0
+
+	fill := func() error {
+		buffer, start = buffer[:encoder.blockSize], 0
+		n, err := io.ReadFull(reader, buffer)
+		buffer = buffer[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	if err := fill(); err != nil {
+		return err
+	}
+	checksum := newRollingChecksum(buffer)
+	for start < len(buffer) {
+		window := buffer[start:]
+		if index, ok := encoder.match(window, checksum); ok {
+			if err := encoder.addCopy(index, len(window)); err != nil {
+				return err
+			}
+			if err := fill(); err != nil {
+				return err
+			}
+			checksum = newRollingChecksum(buffer)
+			continue
+		}
+
+		// No block starts here, the first byte of the window is literal
+		out := window[0]
+		if err := encoder.addLiteral(out); err != nil {
+			return err
+		}
+		start++
+		in, err := reader.ReadByte()
+		if err == io.EOF {
+			checksum.shrink(out)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if start >= 2*encoder.blockSize {
+			buffer = append(buffer[:0], buffer[start:]...)
+			start = 0
+		}
+		buffer = append(buffer, in)
+		checksum.roll(out, in)
+	}
+	if err := encoder.flushLiteral(); err != nil {
+		return err
+	}
+	return encoder.flushCopy()
+}
+
+func (encoder *deltaEncoder) addCopy(index int, length int) error {
+	encoder.Matched += int64(length)
+	if err := encoder.flushLiteral(); err != nil {
+		return err
+	}
+	if encoder.copying.Count > 0 && encoder.copying.Block+encoder.copying.Count == index {
+		encoder.copying.Count++
+		return nil
+	}
+	if err := encoder.flushCopy(); err != nil {
+		return err
+	}
+	encoder.copying = DeltaOp{Block: index, Count: 1}
+	return nil
+}
+
+func (encoder *deltaEncoder) addLiteral(c byte) error {
+	if err := encoder.flushCopy(); err != nil {
+		return err
+	}
+	encoder.Literal++
+	encoder.literal = append(encoder.literal, c)
+	if len(encoder.literal) >= maxDeltaLiteral {
+		return encoder.flushLiteral()
+	}
+	return nil
+}
+
+func (encoder *deltaEncoder) flushLiteral() error {
+	if len(encoder.literal) == 0 {
+		return nil
+	}
+	op := DeltaOp{Data: encoder.literal}
+	encoder.literal = nil
+	return encoder.emit(op)
+}
+
+func (encoder *deltaEncoder) flushCopy() error {
+	if encoder.copying.Count == 0 {
+		return nil
+	}
+	op := encoder.copying
+	encoder.copying = DeltaOp{}
+	return encoder.emit(op)
+}
+
+// Writer indices of delta writes, which do not complete a chunk on their own
+const (
+	deltaWriteIndex = -1
+	deltaDoneIndex  = -2
+)
+
+// sendSignatures - Signs our older copy for the sender and describes it in accept
+func (transfer *incomingTransfer) sendSignatures(pionClient *PionClient, accept *ControlMessage) error {
+	transfer.blockSize = deltaBlockSize(transfer.baseSize)
+	if _, err := transfer.base.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	signatures, err := computeSignatures(transfer.base, transfer.blockSize)
+	if err != nil {
+		return err
+	}
+	if sender := pionClient.senderSession(); sender != nil {
+		for start := 0; start < len(signatures); start += signaturesPerMessage {
+			end := start + signaturesPerMessage
+			if end > len(signatures) {
+				end = len(signatures)
+			}
+			if err := sender.sendControl(ControlMessage{Type: MsgSignatures, Index: start, Signatures: signatures[start:end]}); err != nil {
+				fmt.Printf("Could not send block signatures: %v\n", err)
+			}
+		}
+	}
+	accept.BlockSize = transfer.blockSize
+	accept.Blocks = len(signatures)
+	accept.BaseSize = transfer.baseSize
+	transfer.deltaPending = true
+	fmt.Printf("Asking for a delta against the existing %s (%d blocks of %d bytes)\n", transfer.path, len(signatures), transfer.blockSize)
+	return nil
+}
+
+// applyDelta - Writes the bytes of a delta message to the part file, through the writer like chunks.
+// Once the writer gets to MsgDeltaDone, afterDelta checks what the delta got right.
+func (transfer *incomingTransfer) applyDelta(pionClient *PionClient, message ControlMessage) {
+	transfer.mux.Lock()
+	pending, writer, manifest := transfer.deltaPending, transfer.writer, transfer.manifest
+	transfer.mux.Unlock()
+	if !pending || writer == nil {
+		return
+	}
+	if message.Type == MsgDeltaDone {
+		writer.enqueue(chunkWrite{index: deltaDoneIndex})
+		return
+	}
+
+	offset := message.Offset
+	reused := int64(0)
+	for _, op := range message.Ops {
+		length := int64(len(op.Data))
+		start := int64(op.Block) * int64(transfer.blockSize)
+		if op.Count > 0 {
+			length = int64(op.Count) * int64(transfer.blockSize)
+			if start+length > transfer.baseSize {
+				length = transfer.baseSize - start
+			}
+		}
+		if op.Block < 0 || op.Count < 0 || length <= 0 || offset < 0 || offset+length > manifest.Size {
+			// Whatever this was supposed to hold is requested as chunks later
+			fmt.Printf("Ignoring an invalid delta at offset %d\n", offset)
+			return
+		}
+		if op.Count == 0 {
+			writer.enqueue(chunkWrite{index: deltaWriteIndex, offset: offset, data: op.Data})
+			offset += length
+			continue
+		}
+		for copied := int64(0); copied < length; copied += maxDeltaCopy {
+			size := length - copied
+			if size > maxDeltaCopy {
+				size = maxDeltaCopy
+			}
+			data := make([]byte, size)
+			if _, err := transfer.base.ReadAt(data, start+copied); err != nil && err != io.EOF {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+			writer.enqueue(chunkWrite{index: deltaWriteIndex, offset: offset + copied, data: data})
+		}
+		offset += length
+		reused += length
+	}
+
+	transfer.mux.Lock()
+	transfer.reused += reused
+	transfer.mux.Unlock()
+}
+
+// afterDelta - Every delta write is in the file. Chunks that match their hash are done, the sender
+// is asked for the others.
+func (transfer *incomingTransfer) afterDelta(pionClient *PionClient) {
+	if !transfer.deltaPending {
+		return
+	}
+	transfer.deltaPending = false
+	for index := 0; index < transfer.manifest.Chunks; index++ {
+		if transfer.have[index] {
+			continue
+		}
+		chunk, err := readChunk(transfer.file, transfer.manifest, index)
+		if err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+		if hashChunk(chunk) == transfer.hashes[index] {
+			transfer.have[index] = true
+			transfer.remaining--
+		}
+	}
+	fmt.Printf("Delta applied, %d bytes reused from the existing copy, %d of %d chunks still missing\n", transfer.reused, transfer.remaining, transfer.manifest.Chunks)
+
+	// The sender answers requests for whatever the delta did not get across
+	transfer.seeded = true
+	if transfer.remaining == 0 {
+		transfer.finish(pionClient)
+	} else {
+		transfer.schedule(pionClient)
+	}
+}
+
+// sendDelta - Sends a receiver with an older copy the ops that turn it into our file. Whatever
+// gets lost with a replaced connection the receiver requests as chunks afterwards.
+func (pionClient *PionClient) sendDelta(session *PeerSession, path string) {
+	source, err := os.Open(path)
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+	defer source.Close()
+
+	// offset - Where the next op starts in our file
+	offset := int64(0)
+	batch := ControlMessage{Type: MsgDelta}
+	literal := 0
+	flush := func() error {
+		if len(batch.Ops) == 0 {
+			return nil
+		}
+		err := session.sendControlWhenReady(batch, literal, pionClient.Lifecycle.Done())
+		batch, literal = ControlMessage{Type: MsgDelta, Offset: offset}, 0
+		return err
+	}
+
+	var encoder *deltaEncoder
+	encoder = newDeltaEncoder(session.signatures, session.blockSize, session.baseSize, func(op DeltaOp) error {
+		if len(op.Data) > 0 && literal+len(op.Data) > maxDeltaLiteral {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Ops = append(batch.Ops, op)
+		literal += len(op.Data)
+		if op.Count > 0 {
+			for block := op.Block; block < op.Block+op.Count; block++ {
+				offset += int64(encoder.blockLength(block))
+			}
+		} else {
+			offset += int64(len(op.Data))
+		}
+		if len(batch.Ops) >= opsPerMessage {
+			return flush()
+		}
+		return nil
+	})
+
+	encodeErr := encoder.encode(source)
+	if encodeErr == nil {
+		encodeErr = flush()
+	}
+	if encodeErr == nil {
+		encodeErr = session.sendControlWhenReady(ControlMessage{Type: MsgDeltaDone}, 0, pionClient.Lifecycle.Done())
+	}
+	var pathErr *os.PathError
+	switch {
+	case errors.As(encodeErr, &pathErr):
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", encodeErr))
+	case encodeErr != nil:
+		// The session failed or the transfer ended, either is dealt with elsewhere
+		return
+	default:
+		session.markDeltaSent()
+		session.addBytesSent(encoder.Literal)
+		fmt.Printf("Peer %s: delta sent, %d bytes literal, %d bytes found in its copy\n", session.Peer.ID, encoder.Literal, encoder.Matched)
+	}
+}
+
+// markDeltaSent and isDeltaSent - Whether the whole delta has been sent
+func (session *PeerSession) markDeltaSent() {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	session.deltaSent = true
+}
+
+func (session *PeerSession) isDeltaSent() bool {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	return session.deltaSent
+}
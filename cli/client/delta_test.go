@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+)
+
+func TestRollingChecksum(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, size := range []int{1, 16, 1000} {
+		checksum := newRollingChecksum(data[:size])
+		for start := 1; start+size <= len(data); start++ {
+			checksum.roll(data[start-1], data[start+size-1])
+			if want := newRollingChecksum(data[start : start+size]); checksum.sum() != want.sum() {
+				t.Fatalf("Window of %d at %d: rolled to %x, want %x", size, start, checksum.sum(), want.sum())
+			}
+		}
+		for start := len(data) - size + 1; start < len(data); start++ {
+			checksum.shrink(data[start-1])
+			if want := newRollingChecksum(data[start:]); checksum.sum() != want.sum() {
+				t.Fatalf("Window of %d shrunk at %d: %x, want %x", size, start, checksum.sum(), want.sum())
+			}
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	base := make([]byte, 200<<10)
+	random.Read(base)
+	inserted := make([]byte, 5000)
+	random.Read(inserted)
+	edited := append([]byte{}, base...)
+	copy(edited[100<<10:], "changed in place")
+
+	tests := []struct {
+		name        string
+		base        []byte
+		target      []byte
+		wantMatched bool
+	}{
+		{name: "unchanged", base: base, target: base, wantMatched: true},
+		{name: "edited in place", base: base, target: edited, wantMatched: true},
+		{name: "bytes inserted", base: base, target: append(append(append([]byte{}, base[:50<<10]...), inserted...), base[50<<10:]...), wantMatched: true},
+		{name: "truncated mid block", base: base, target: base[:150<<10+77], wantMatched: true},
+		{name: "appended to", base: base[:10000], target: base, wantMatched: true},
+		{name: "nothing in common", base: base[:10000], target: inserted},
+		{name: "no older copy", base: nil, target: inserted},
+		{name: "emptied", base: base, target: []byte{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockSize := deltaBlockSize(int64(len(test.base)))
+			signatures, err := computeSignatures(bytes.NewReader(test.base), blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := make([]DeltaOp, 0)
+			encoder := newDeltaEncoder(signatures, blockSize, int64(len(test.base)), func(op DeltaOp) error {
+				ops = append(ops, op)
+				return nil
+			})
+			if err := encoder.encode(bytes.NewReader(test.target)); err != nil {
+				t.Fatal(err)
+			}
+			if encoder.Literal+encoder.Matched != int64(len(test.target)) {
+				t.Errorf("Encoded %d literal and %d matched bytes of %d", encoder.Literal, encoder.Matched, len(test.target))
+			}
+			if (encoder.Matched > 0) != test.wantMatched {
+				t.Errorf("Matched %d bytes of the older copy", encoder.Matched)
+			}
+			if got := applyOps(t, test.base, blockSize, ops, len(test.target)); !bytes.Equal(got, test.target) {
+				t.Errorf("Applying %d ops gave %d bytes that differ from the %d of the file", len(ops), len(got), len(test.target))
+			}
+		})
+	}
+}
+
+// applyOps - Has a receiver holding base apply ops and returns what it wrote
+func applyOps(t *testing.T, base []byte, blockSize int, ops []DeltaOp, size int) []byte {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "go-send-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	baseFile, err := ioutil.TempFile(dir, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer baseFile.Close()
+	if _, err := baseFile.Write(base); err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile(dir, "part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	done := make(chan error, 1)
+	transfer := &incomingTransfer{
+		deltaPending: true,
+		base:         baseFile,
+		baseSize:     int64(len(base)),
+		blockSize:    blockSize,
+		manifest:     &domain.Manifest{Size: int64(size)},
+	}
+	transfer.writer = newFileWriter(file, FsyncNone, 0, stop, func(index int, err error) {
+		if err != nil || index == deltaDoneIndex {
+			done <- err
+		}
+	})
+	offset := int64(0)
+	for start := 0; start < len(ops); start += opsPerMessage {
+		end := start + opsPerMessage
+		if end > len(ops) {
+			end = len(ops)
+		}
+		transfer.applyDelta(nil, ControlMessage{Type: MsgDelta, Offset: offset, Ops: ops[start:end]})
+		for _, op := range ops[start:end] {
+			offset += opLength(op, blockSize, int64(len(base)))
+		}
+	}
+	transfer.applyDelta(nil, ControlMessage{Type: MsgDeltaDone})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return written
+}
+
+// opLength - Bytes of the file op stands for
+func opLength(op DeltaOp, blockSize int, baseSize int64) int64 {
+	if op.Count == 0 {
+		return int64(len(op.Data))
+	}
+	length := int64(op.Count) * int64(blockSize)
+	if start := int64(op.Block) * int64(blockSize); start+length > baseSize {
+		length = baseSize - start
+	}
+	return length
+}
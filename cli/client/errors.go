@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind - Class of an error that ends a transfer or a peer session. The kind decides the final
+// state, and with it the exit code, and is passed on to peers when we leave because of it.
+type ErrorKind string
+
+func (kind ErrorKind) Error() string {
+	return string(kind)
+}
+
+const (
+	// ErrPeerRejected - A peer, or the room on the signalling server, turned us away
+	ErrPeerRejected ErrorKind = "rejected"
+	// ErrIntegrity - The received file does not match the sender's
+	ErrIntegrity ErrorKind = "integrity failure"
+	// ErrSignal - The signalling server could not be reached or answered nonsense
+	ErrSignal ErrorKind = "signalling failure"
+	// ErrNetwork - A connection with a peer could not be established or was lost for good
+	ErrNetwork ErrorKind = "network failure"
+	// ErrPeerLeft - A peer went away before the transfer was over
+	ErrPeerLeft ErrorKind = "peer left"
+	// ErrPeerTimeout - The peers did not show up in time or went silent
+	ErrPeerTimeout ErrorKind = "peer timeout"
+	// ErrFile - Reading the source or writing the destination failed, e.g. the disk is full
+	ErrFile ErrorKind = "file error"
+	// ErrInterrupted - We were asked to stop
+	ErrInterrupted ErrorKind = "interrupted"
+)
+
+// TransferError - An error of a given kind, optionally caused by a specific peer
+type TransferError struct {
+	Kind ErrorKind
+	Peer string
+	Err  error
+}
+
+// newError - Classifies err, keeping the kind of errors that already have one
+func newError(kind ErrorKind, peer string, err error) error {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return err
+	}
+	return &TransferError{Kind: kind, Peer: peer, Err: err}
+}
+
+func (transferErr *TransferError) Error() string {
+	if transferErr.Peer != "" {
+		return fmt.Sprintf("%s with peer %s: %v", transferErr.Kind, transferErr.Peer, transferErr.Err)
+	}
+	return fmt.Sprintf("%s: %v", transferErr.Kind, transferErr.Err)
+}
+
+// Is - Lets errors.Is(err, ErrIntegrity) and friends match on the kind
+func (transferErr *TransferError) Is(target error) bool {
+	return target == transferErr.Kind
+}
+
+// Unwrap - The underlying cause
+func (transferErr *TransferError) Unwrap() error {
+	return transferErr.Err
+}
+
+// KindOf - The kind of an error, ErrNetwork when it was never classified
+func KindOf(err error) ErrorKind {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return transferErr.Kind
+	}
+	var kind ErrorKind
+	if errors.As(err, &kind) {
+		return kind
+	}
+	return ErrNetwork
+}
+
+// StateOf - The final state a transfer ending with err is in
+func StateOf(err error) TransferState {
+	switch KindOf(err) {
+	case ErrPeerRejected:
+		return StateRejected
+	case ErrIntegrity:
+		return StateIntegrityFailed
+	case ErrPeerTimeout:
+		return StatePeerTimeout
+	case ErrFile:
+		return StateFileFailed
+	case ErrInterrupted:
+		return StateInterrupted
+	default:
+		return StateNetworkFailed
+	}
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFiles - Files whose patterns apply to the directory they are in and everything below it
+var ignoreFiles = []string{".gitignore", ".gosendignore"}
+
+// ignoreRule - One pattern in .gitignore syntax
+type ignoreRule struct {
+	// base - Slash separated directory the pattern is relative to, empty for the root
+	base string
+	// segments - The pattern split at slashes. ** matches any number of path elements, a pattern
+	// without a slash matches at any depth.
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// ignoreRules - Decides which paths below a root are left out. Like git, the last matching rule
+// wins and nothing below an ignored directory is looked at. With includes only files matching one
+// of them, or in a directory matching one, are left in.
+type ignoreRules struct {
+	rules    []ignoreRule
+	includes []ignoreRule
+}
+
+// loadIgnoreRules - The exclude patterns given plus those of every ignore file below root, and the
+// include patterns given
+func loadIgnoreRules(root string, exclude []string, include []string) (*ignoreRules, error) {
+	rules := &ignoreRules{}
+	for _, pattern := range exclude {
+		rules.add("", pattern)
+	}
+	for _, pattern := range include {
+		if rule, ok := parseRule("", pattern); ok && !rule.negate {
+			rules.includes = append(rules.includes, rule)
+		}
+	}
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		relative, err := relativeSlashPath(root, name)
+		if err != nil {
+			return err
+		}
+		if relative != "" && rules.excluded(relative, true) {
+			return filepath.SkipDir
+		}
+		for _, ignoreFile := range ignoreFiles {
+			if err := rules.load(filepath.Join(name, ignoreFile), relative); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return rules, err
+}
+
+// load - Adds the patterns of an ignore file in the directory base, if there is one
+func (rules *ignoreRules) load(file string, base string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		rules.add(base, line)
+	}
+	return nil
+}
+
+// add - Adds a line of .gitignore syntax
+func (rules *ignoreRules) add(base string, line string) {
+	if rule, ok := parseRule(base, line); ok {
+		rules.rules = append(rules.rules, rule)
+	}
+}
+
+// parseRule - Parses a line of .gitignore syntax, false for blank lines and comments
+func parseRule(base string, line string) (ignoreRule, bool) {
+	pattern := strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	pattern = strings.TrimPrefix(pattern, "\\")
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return ignoreRule{}, false
+	}
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return ignoreRule{}, false
+	}
+	rule.segments = strings.Split(pattern, "/")
+	return rule, true
+}
+
+// excluded - Whether the slash separated path relative to the root is left out, either ignored or,
+// for a file, not included. Directories are only left out when ignored, they may hold included files.
+func (rules *ignoreRules) excluded(relative string, isDir bool) bool {
+	if rules == nil {
+		return false
+	}
+	if rules.ignored(relative, isDir) {
+		return true
+	}
+	return !isDir && len(rules.includes) > 0 && !rules.included(relative)
+}
+
+// included - Whether an include pattern matches the file or a directory it is in
+func (rules *ignoreRules) included(relative string) bool {
+	elements := strings.Split(relative, "/")
+	for length := 1; length <= len(elements); length++ {
+		isDir := length < len(elements)
+		for _, rule := range rules.includes {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if matchSegments(rule.segments, elements[:length]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ignored - Whether the slash separated path relative to the root, or a directory it is in, is left out
+func (rules *ignoreRules) ignored(relative string, isDir bool) bool {
+	if rules == nil {
+		return false
+	}
+	elements := strings.Split(relative, "/")
+	for parents := 1; parents < len(elements); parents++ {
+		if rules.match(strings.Join(elements[:parents], "/"), true) {
+			return true
+		}
+	}
+	return rules.match(relative, isDir)
+}
+
+// match - Whether the last rule matching the path itself ignores it
+func (rules *ignoreRules) match(relative string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		name := relative
+		if rule.base != "" {
+			if !strings.HasPrefix(relative, rule.base+"/") {
+				continue
+			}
+			name = relative[len(rule.base)+1:]
+		}
+		if matchSegments(rule.segments, strings.Split(name, "/")) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments - Matches pattern elements against path elements, ** standing for any number of them
+func matchSegments(pattern []string, elements []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(elements); skip++ {
+				if matchSegments(pattern[1:], elements[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elements) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], elements[0]); !matched {
+			return false
+		}
+		pattern, elements = pattern[1:], elements[1:]
+	}
+	return len(elements) == 0
+}
+
+// relativeSlashPath - name relative to root with forward slashes, empty for root itself
+func relativeSlashPath(root string, name string) (string, error) {
+	relative, err := filepath.Rel(root, name)
+	if err != nil {
+		return "", err
+	}
+	if relative == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(relative), nil
+}
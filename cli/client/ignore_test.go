@@ -0,0 +1,135 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   ignoreRule
+		wantOK bool
+	}{
+		{line: "", wantOK: false},
+		{line: "   ", wantOK: false},
+		{line: "# a comment", wantOK: false},
+		{line: "*.log", want: ignoreRule{segments: []string{"**", "*.log"}}, wantOK: true},
+		{line: "*.log  \r", want: ignoreRule{segments: []string{"**", "*.log"}}, wantOK: true},
+		{line: "/build", want: ignoreRule{segments: []string{"build"}}, wantOK: true},
+		{line: "build/", want: ignoreRule{segments: []string{"**", "build"}, dirOnly: true}, wantOK: true},
+		{line: "docs/*.md", want: ignoreRule{segments: []string{"docs", "*.md"}}, wantOK: true},
+		{line: "!keep.log", want: ignoreRule{segments: []string{"**", "keep.log"}, negate: true}, wantOK: true},
+		{line: "\\#not-a-comment", want: ignoreRule{segments: []string{"**", "#not-a-comment"}}, wantOK: true},
+		{line: "/", wantOK: false},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			rule, ok := parseRule("", test.line)
+			if ok != test.wantOK || (ok && !reflect.DeepEqual(rule, test.want)) {
+				t.Errorf("parseRule(%q) = %+v, %t, want %+v, %t", test.line, rule, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern []string
+		path    []string
+		want    bool
+	}{
+		{pattern: []string{"a"}, path: []string{"a"}, want: true},
+		{pattern: []string{"a"}, path: []string{"b"}, want: false},
+		{pattern: []string{"*.go"}, path: []string{"main.go"}, want: true},
+		{pattern: []string{"*.go"}, path: []string{"cmd", "main.go"}, want: false},
+		{pattern: []string{"**", "*.go"}, path: []string{"main.go"}, want: true},
+		{pattern: []string{"**", "*.go"}, path: []string{"cmd", "tool", "main.go"}, want: true},
+		{pattern: []string{"a", "**", "b"}, path: []string{"a", "b"}, want: true},
+		{pattern: []string{"a", "**", "b"}, path: []string{"a", "x", "y", "b"}, want: true},
+		{pattern: []string{"a", "**", "b"}, path: []string{"a", "x", "c"}, want: false},
+		{pattern: []string{"a", "**"}, path: []string{"a", "x", "y"}, want: true},
+		{pattern: []string{"a"}, path: []string{"a", "b"}, want: false},
+	}
+	for _, test := range tests {
+		if got := matchSegments(test.pattern, test.path); got != test.want {
+			t.Errorf("matchSegments(%q, %q) = %t, want %t", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreRulesExcluded(t *testing.T) {
+	type check struct {
+		path  string
+		isDir bool
+		want  bool
+	}
+	tests := []struct {
+		name     string
+		patterns map[string][]string
+		include  []string
+		checks   []check
+	}{
+		{
+			name:     "a pattern without a slash matches at any depth",
+			patterns: map[string][]string{"": {"*.log"}},
+			checks:   []check{{"debug.log", false, true}, {"logs/debug.log", false, true}, {"debug.txt", false, false}},
+		},
+		{
+			name:     "a leading slash anchors to the root",
+			patterns: map[string][]string{"": {"/build"}},
+			checks:   []check{{"build", true, true}, {"build/out.bin", false, true}, {"src/build", true, false}},
+		},
+		{
+			name:     "a trailing slash matches directories only",
+			patterns: map[string][]string{"": {"cache/"}},
+			checks:   []check{{"cache", true, true}, {"cache", false, false}, {"cache/entry", false, true}},
+		},
+		{
+			name:     "the last matching rule wins",
+			patterns: map[string][]string{"": {"*.log", "!keep.log"}},
+			checks:   []check{{"debug.log", false, true}, {"keep.log", false, false}},
+		},
+		{
+			name:     "nothing below an ignored directory comes back",
+			patterns: map[string][]string{"": {"vendor/", "!vendor/keep.go"}},
+			checks:   []check{{"vendor/keep.go", false, true}},
+		},
+		{
+			name:     "an ignore file applies below its directory",
+			patterns: map[string][]string{"docs": {"*.tmp"}},
+			checks:   []check{{"docs/draft.tmp", false, true}, {"docs/old/draft.tmp", false, true}, {"draft.tmp", false, false}},
+		},
+		{
+			name:    "includes leave other files out",
+			include: []string{"*.go", "docs/"},
+			checks:  []check{{"main.go", false, false}, {"cmd/main.go", false, false}, {"README.md", false, true}, {"docs/guide.md", false, false}, {"assets", true, false}},
+		},
+		{
+			name:     "ignoring wins over including",
+			patterns: map[string][]string{"": {"generated/"}},
+			include:  []string{"*.go"},
+			checks:   []check{{"generated/api.go", false, true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := &ignoreRules{}
+			for base, patterns := range test.patterns {
+				for _, pattern := range patterns {
+					rules.add(base, pattern)
+				}
+			}
+			for _, pattern := range test.include {
+				if rule, ok := parseRule("", pattern); ok {
+					rules.includes = append(rules.includes, rule)
+				}
+			}
+			for _, check := range test.checks {
+				if got := rules.excluded(check.path, check.isDir); got != check.want {
+					t.Errorf("excluded(%q, %t) = %t, want %t", check.path, check.isDir, got, check.want)
+				}
+			}
+		})
+	}
+}
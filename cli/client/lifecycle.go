@@ -0,0 +1,208 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TransferState - Where a transfer is in its lifecycle. StateVerified and everything after it is final.
+type TransferState int
+
+const (
+	// StateWaiting - Registered, waiting for the other peers to join the room
+	StateWaiting TransferState = iota
+	// StateConnecting - Negotiating connections with the peers
+	StateConnecting
+	// StateTransferring - File data is flowing
+	StateTransferring
+	// StateSeeding - A receiver has verified the file and keeps serving other receivers of the swarm
+	StateSeeding
+	// StateWatching - A watched directory has been synced, changes are pushed as they happen.
+	// Quiet peers do not time out.
+	StateWatching
+	// StateVerified - The file was received and verified, by us or by every receiver
+	StateVerified
+	// StateSkipped - The destination already existed and the conflict policy kept it, nothing was received
+	StateSkipped
+	// StatePeerTimeout - The peers did not show up in time or went silent
+	StatePeerTimeout
+	// StateRejected - The signalling server or a peer turned us away
+	StateRejected
+	// StateIntegrityFailed - The received file does not match the sender's
+	StateIntegrityFailed
+	// StateNetworkFailed - The signalling server or the peers could not be reached any more
+	StateNetworkFailed
+	// StateFileFailed - The source could not be read or the destination could not be written
+	StateFileFailed
+	// StateInterrupted - We were asked to stop
+	StateInterrupted
+)
+
+var stateNames = map[TransferState]string{
+	StateWaiting:         "waiting for peers",
+	StateConnecting:      "connecting",
+	StateTransferring:    "transferring",
+	StateSeeding:         "seeding",
+	StateWatching:        "watching",
+	StateVerified:        "verified",
+	StateSkipped:         "skipped",
+	StatePeerTimeout:     "peer timeout",
+	StateRejected:        "rejected",
+	StateIntegrityFailed: "integrity failure",
+	StateNetworkFailed:   "network failure",
+	StateFileFailed:      "file error",
+	StateInterrupted:     "interrupted",
+}
+
+func (state TransferState) String() string {
+	return stateNames[state]
+}
+
+// Final - Whether the transfer is over
+func (state TransferState) Final() bool {
+	return state >= StateVerified
+}
+
+// ExitCode - Process exit code for a final state. 1 is left for usage errors.
+func (state TransferState) ExitCode() int {
+	switch state {
+	case StateVerified, StateSkipped:
+		return 0
+	case StatePeerTimeout:
+		return 2
+	case StateRejected:
+		return 3
+	case StateIntegrityFailed:
+		return 4
+	case StateNetworkFailed:
+		return 5
+	case StateFileFailed:
+		return 6
+	case StateInterrupted:
+		return 130
+	default:
+		return 1
+	}
+}
+
+// Lifecycle - Tracks the state of a transfer. Every error that ends it goes through the single
+// errors channel, the first one decides the final state. The transfer ends when Done is closed.
+type Lifecycle struct {
+	mux          sync.Mutex
+	state        TransferState
+	err          error
+	started      time.Time
+	lastActivity time.Time
+	errors       chan error
+	done         chan struct{}
+}
+
+// NewLifecycle - A transfer waiting for its peers
+func NewLifecycle() *Lifecycle {
+	now := time.Now()
+	lifecycle := &Lifecycle{
+		state:        StateWaiting,
+		started:      now,
+		lastActivity: now,
+		errors:       make(chan error, 1),
+		done:         make(chan struct{}),
+	}
+	go lifecycle.control()
+	return lifecycle
+}
+
+// control - Ends the transfer with the first error reported
+func (lifecycle *Lifecycle) control() {
+	select {
+	case err := <-lifecycle.errors:
+		lifecycle.finish(StateOf(err), err)
+	case <-lifecycle.done:
+	}
+}
+
+// Fail - Reports an error that ends the transfer. Only the first one counts.
+func (lifecycle *Lifecycle) Fail(err error) {
+	select {
+	case lifecycle.errors <- err:
+	default:
+	}
+}
+
+// Complete - Ends the transfer successfully, unless it has ended already
+func (lifecycle *Lifecycle) Complete() {
+	lifecycle.finish(StateVerified, nil)
+}
+
+// Skip - Ends the transfer successfully without having received anything, unless it has ended already
+func (lifecycle *Lifecycle) Skip() {
+	lifecycle.finish(StateSkipped, nil)
+}
+
+// Advance - Moves on to a later, non final state
+func (lifecycle *Lifecycle) Advance(state TransferState) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if state.Final() || state <= lifecycle.state {
+		return
+	}
+	lifecycle.state = state
+	lifecycle.lastActivity = time.Now()
+}
+
+// finish - Ends the transfer in a final state, unless it has already ended
+func (lifecycle *Lifecycle) finish(state TransferState, err error) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if lifecycle.state.Final() {
+		return
+	}
+	lifecycle.state = state
+	lifecycle.err = err
+	close(lifecycle.done)
+}
+
+// Touch - Something arrived from a peer, the idle timeout starts over
+func (lifecycle *Lifecycle) Touch() {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	lifecycle.lastActivity = time.Now()
+}
+
+// State - The current state and, once failed, why
+func (lifecycle *Lifecycle) State() (TransferState, error) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	return lifecycle.state, lifecycle.err
+}
+
+// Done - Closed once a final state is reached
+func (lifecycle *Lifecycle) Done() <-chan struct{} {
+	return lifecycle.done
+}
+
+// Watch - Ends the transfer with StatePeerTimeout if it has not started within waitTimeout,
+// or if nothing arrives from any peer for idleTimeout once it has. Zero disables either.
+func (lifecycle *Lifecycle) Watch(waitTimeout time.Duration, idleTimeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lifecycle.done:
+				return
+			case now := <-ticker.C:
+				lifecycle.mux.Lock()
+				state, started, lastActivity := lifecycle.state, lifecycle.started, lifecycle.lastActivity
+				lifecycle.mux.Unlock()
+
+				switch {
+				case state < StateTransferring && waitTimeout > 0 && now.Sub(started) > waitTimeout:
+					lifecycle.Fail(&TransferError{Kind: ErrPeerTimeout, Err: fmt.Errorf("peers did not connect within %v (%s)", waitTimeout, state)})
+				case state == StateTransferring && idleTimeout > 0 && now.Sub(lastActivity) > idleTimeout:
+					lifecycle.Fail(&TransferError{Kind: ErrPeerTimeout, Err: fmt.Errorf("nothing heard from any peer for %v", idleTimeout)})
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst - The bucket always holds enough tokens for one full frame
+const minBurst = maxFramePayload + frameHeaderSize
+
+// RateLimiter - Token bucket limiting the bytes per second passed through Wait.
+// A rate of 0 means unlimited. The rate can be changed while transfers are running.
+type RateLimiter struct {
+	mux    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter - Creates a limiter allowing rate bytes per second, 0 for unlimited
+func NewRateLimiter(rate int64) *RateLimiter {
+	limiter := &RateLimiter{last: time.Now()}
+	limiter.SetRate(rate)
+	return limiter
+}
+
+// burst - Up to a tenth of a second worth of data may go out at once
+func (limiter *RateLimiter) burst() float64 {
+	if burst := limiter.rate / 10; burst > minBurst {
+		return burst
+	}
+	return minBurst
+}
+
+// SetRate - Changes the limit, 0 for unlimited
+func (limiter *RateLimiter) SetRate(rate int64) {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+	limiter.rate = float64(rate)
+	if limiter.tokens > limiter.burst() {
+		limiter.tokens = limiter.burst()
+	}
+}
+
+// Rate - The current limit in bytes per second, 0 for unlimited
+func (limiter *RateLimiter) Rate() int64 {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+	return int64(limiter.rate)
+}
+
+// Wait - Blocks until n bytes may pass. Larger requests than the bucket holds
+// are let through once it is full and paid back afterwards.
+func (limiter *RateLimiter) Wait(n int) {
+	if limiter == nil {
+		return
+	}
+	for {
+		limiter.mux.Lock()
+		if limiter.rate <= 0 {
+			limiter.mux.Unlock()
+			return
+		}
+		now := time.Now()
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		limiter.last = now
+		if burst := limiter.burst(); limiter.tokens > burst {
+			limiter.tokens = burst
+		}
+
+		needed := float64(n)
+		if burst := limiter.burst(); needed > burst {
+			needed = burst
+		}
+		if limiter.tokens >= needed {
+			limiter.tokens -= float64(n)
+			limiter.mux.Unlock()
+			return
+		}
+		wait := time.Duration((needed - limiter.tokens) / limiter.rate * float64(time.Second))
+		limiter.mux.Unlock()
+
+		// Sleep in small steps so that a raised limit takes effect quickly
+		if wait > 100*time.Millisecond {
+			wait = 100 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+}
+
+// rateUnits - Suffixes accepted by ParseRate, longer ones first so that "mb" is not read as "b".
+// Plain units are decimal, matching the MB/s used in transfer summaries.
+var rateUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+	{"b", 1},
+}
+
+// ParseRate - Parses limits such as "5MB/s", "500k" or "1.5MiB/s" into bytes per second.
+// An empty string or "0" means unlimited.
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "/s")
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSuffix(value, unit.suffix)
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, &AppError{fmt.Sprintf("Invalid rate %q, expected something like 5MB/s", value)}
+	}
+	return int64(number * multiplier), nil
+}
+
+// FormatRate - Human readable form of a rate in bytes per second
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(rate)/1e6)
+}
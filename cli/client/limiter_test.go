@@ -0,0 +1,91 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "500", want: 500},
+		{value: "500b", want: 500},
+		{value: "500k", want: 500e3},
+		{value: "5MB/s", want: 5e6},
+		{value: " 5 mb/s ", want: 5e6},
+		{value: "1.5MiB/s", want: 1.5 * (1 << 20)},
+		{value: "2GiB", want: 2 << 30},
+		{value: "1g", want: 1e9},
+		{value: "fast", wantErr: true},
+		{value: "-5MB/s", wantErr: true},
+		{value: "MB/s", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			rate, err := ParseRate(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseRate(%q): got error %v, want error %t", test.value, err, test.wantErr)
+			}
+			if err == nil && rate != test.want {
+				t.Errorf("ParseRate(%q) = %d, want %d", test.value, rate, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		bytes   int
+		minimum time.Duration
+		maximum time.Duration
+	}{
+		{name: "unlimited", rate: 0, bytes: 1 << 30, maximum: 50 * time.Millisecond},
+		{name: "within the burst", rate: 10e6, bytes: minBurst, maximum: 50 * time.Millisecond},
+		{name: "past the burst", rate: 1e6, bytes: minBurst + 250e3, minimum: 200 * time.Millisecond, maximum: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter(test.rate)
+			// The bucket starts empty, fill it
+			time.Sleep(150 * time.Millisecond)
+			start := time.Now()
+			for sent := 0; sent < test.bytes; sent += minBurst {
+				n := minBurst
+				if test.bytes-sent < n {
+					n = test.bytes - sent
+				}
+				limiter.Wait(n)
+			}
+			if elapsed := time.Since(start); elapsed < test.minimum || elapsed > test.maximum {
+				t.Errorf("Passing %d bytes at %s took %v, want between %v and %v", test.bytes, FormatRate(test.rate), elapsed, test.minimum, test.maximum)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := NewRateLimiter(1e3)
+	done := make(chan struct{})
+	go func() {
+		limiter.Wait(minBurst)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// At 1kB/s the wait takes over a minute, lifting the limit ends it
+	limiter.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Lifting the limit did not end the wait")
+	}
+	if rate := limiter.Rate(); rate != 0 {
+		t.Errorf("Rate = %d, want 0", rate)
+	}
+}
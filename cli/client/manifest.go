@@ -0,0 +1,78 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+)
+
+// buildManifest - Reads the file once, hashing the whole file and every chunk of it
+func buildManifest(path string, chunkSize int64) (*domain.Manifest, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &domain.Manifest{
+		Name:      filepath.Base(path),
+		Size:      fileInfo.Size(),
+		ChunkSize: chunkSize,
+		Chunks:    int((fileInfo.Size() + chunkSize - 1) / chunkSize),
+		ModTime:   fileInfo.ModTime().UnixNano(),
+	}
+
+	fileHash := sha256.New()
+	hashes := make([]string, 0, manifest.Chunks)
+	chunk := make([]byte, chunkSize)
+	for index := 0; index < manifest.Chunks; index++ {
+		n, err := io.ReadFull(file, chunk[:manifest.ChunkLength(index)])
+		if err != nil {
+			return nil, nil, err
+		}
+		fileHash.Write(chunk[:n])
+		hashes = append(hashes, hashChunk(chunk[:n]))
+	}
+	manifest.Hash = hex.EncodeToString(fileHash.Sum(nil))
+
+	return manifest, hashes, nil
+}
+
+// hashChunk - Hex encoded sha256 of a chunk
+func hashChunk(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile - Hex encoded sha256 of a whole file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+// readChunk - Reads chunk index of the file described by manifest
+func readChunk(file io.ReaderAt, manifest *domain.Manifest, index int) ([]byte, error) {
+	chunk := make([]byte, manifest.ChunkLength(index))
+	if _, err := file.ReadAt(chunk, manifest.ChunkOffset(index)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return chunk, nil
+}
@@ -0,0 +1,389 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/pion/webrtc/v3"
+)
+
+// Control messages are sent as JSON text messages on the data channel.
+// File content travels as binary frames, see encodeFrame.
+const (
+	// MsgManifest - sender -> receiver: describes the file about to be sent
+	MsgManifest = "MANIFEST"
+	// MsgHashes - sender -> receiver: a batch of chunk hashes starting at Index
+	MsgHashes = "HASHES"
+	// MsgAccept - receiver -> sender: every hash has arrived, chunks may be sent on any channel.
+	// Carries the Bitfield of chunks a resumed transfer already holds, the file's Hash when the
+	// receiver already has an identical copy, Skip when it keeps a different one, or the BlockSize
+	// of the signatures it sent when it wants a delta.
+	MsgAccept = "ACCEPT"
+	// MsgBitfield - receiver -> receiver: every chunk held so far
+	MsgBitfield = "BITFIELD"
+	// MsgHave - receiver -> receiver: a chunk has just been verified
+	MsgHave = "HAVE"
+	// MsgRequest - receiver -> any peer: please send chunk Index
+	MsgRequest = "REQUEST"
+	// MsgSeeded - sender -> receiver: every chunk has been pushed to some receiver once
+	MsgSeeded = "SEEDED"
+	// MsgComplete - receiver -> sender: the whole file has been received and verified
+	MsgComplete = "COMPLETE"
+	// MsgSignatures - receiver -> sender: a batch of block signatures of the receiver's older copy
+	// starting at Index, sent before an ACCEPT asking for a delta
+	MsgSignatures = "SIGNATURES"
+	// MsgDelta - sender -> receiver: Ops rebuilding the file from Offset on
+	MsgDelta = "DELTA"
+	// MsgDeltaDone - sender -> receiver: every op has been sent, the receiver requests chunks the
+	// delta did not get right
+	MsgDeltaDone = "DELTA_DONE"
+	// MsgTree - sender -> receiver: a batch of the Files of the directory being synced
+	MsgTree = "TREE"
+	// MsgTreeDone - sender -> receiver: every file has been listed, with whether the sender asks
+	// to Delete extraneous files and for a DryRun. With Watch the sender keeps the connection open
+	// and sends a TREE of the files that changed whenever it sees changes, Incremental for those.
+	// Exclude and Include are the sender's patterns, receivers leave what they exclude alone.
+	// With Owner the entries carry their owner, which receivers running as root take on.
+	MsgTreeDone = "TREE_DONE"
+	// MsgPlan - receiver -> sender: Bitfield of the listed files it lacks, Count of files it
+	// deletes and whether it only plans (DryRun)
+	MsgPlan = "PLAN"
+	// MsgSyncDone - sender -> receiver: every wanted file has been sent. A watching sender sends
+	// the next TREE once something changes.
+	MsgSyncDone = "SYNC_DONE"
+	// MsgBye - any peer -> any peer: we are leaving, with Reason. Also sent through the
+	// signalling server to peers we are not connected to yet.
+	MsgBye = "BYE"
+)
+
+// DefaultChunkSize - Size of the chunks a file is split into
+const DefaultChunkSize = 1 << 20
+
+// maxChunkSize - Largest chunk size a receiver accepts in a manifest, it bounds what a chunk
+// may decompress to
+const maxChunkSize = 16 << 20
+
+// hashesPerMessage - Number of chunk hashes that comfortably fit in one data channel message
+const hashesPerMessage = 512
+
+// frameHeaderSize - A binary frame starts with the chunk index, the offset within the encoded chunk,
+// the length of the encoded chunk and the codec it was encoded with
+const frameHeaderSize = 13
+
+// maxFramePayload - SCTP messages are limited to 64KB
+const maxFramePayload = 65535 - frameHeaderSize
+
+// maxBufferedAmount - Sends block while more than this many bytes are queued on a data channel
+const maxBufferedAmount = 4 << 20
+
+// ControlMessage - Envelope for every text message exchanged over a data channel
+type ControlMessage struct {
+	Type     string           `json:"type"`
+	Manifest *domain.Manifest `json:"manifest,omitempty"`
+	Index    int              `json:"index,omitempty"`
+	Hashes   []string         `json:"hashes,omitempty"`
+	Bitfield []byte           `json:"bitfield,omitempty"`
+	// Compression - The codec a receiver picked out of the manifest's offer
+	Compression string `json:"compression,omitempty"`
+	// Hash and Skip - The receiver needs nothing, see MsgAccept
+	Hash string `json:"hash,omitempty"`
+	Skip bool   `json:"skip,omitempty"`
+	// BlockSize, Blocks and BaseSize - Describe the receiver's older copy when it asks for a delta
+	BlockSize  int              `json:"blockSize,omitempty"`
+	Blocks     int              `json:"blocks,omitempty"`
+	BaseSize   int64            `json:"baseSize,omitempty"`
+	Signatures []BlockSignature `json:"signatures,omitempty"`
+	Ops        []DeltaOp        `json:"ops,omitempty"`
+	Offset     int64            `json:"offset,omitempty"`
+	// Files, Delete, DryRun, Count, Watch, Incremental, Exclude, Include and Owner - Directory sync,
+	// see sync.go, tree.go and watch.go
+	Files       []domain.FileEntry `json:"files,omitempty"`
+	Delete      bool               `json:"delete,omitempty"`
+	DryRun      bool               `json:"dryRun,omitempty"`
+	Count       int                `json:"count,omitempty"`
+	Watch       bool               `json:"watch,omitempty"`
+	Incremental bool               `json:"incremental,omitempty"`
+	Exclude     []string           `json:"exclude,omitempty"`
+	Include     []string           `json:"include,omitempty"`
+	Owner       bool               `json:"owner,omitempty"`
+	// Reason and Kind - Why a peer is leaving. Kind is an ErrorKind, empty when it is done.
+	Reason string    `json:"reason,omitempty"`
+	Kind   ErrorKind `json:"kind,omitempty"`
+}
+
+// frameHeader - Locates the payload of a frame within an encoded chunk
+type frameHeader struct {
+	Index  int
+	Offset int
+	Length int
+	Codec  byte
+}
+
+// encodeFrame - Prefixes a piece of an encoded chunk with its header
+func encodeFrame(header frameHeader, payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(header.Index))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(header.Offset))
+	binary.BigEndian.PutUint32(frame[8:12], uint32(header.Length))
+	frame[12] = header.Codec
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+// decodeFrame - Reverse of encodeFrame
+func decodeFrame(frame []byte) (frameHeader, []byte, error) {
+	if len(frame) < frameHeaderSize {
+		return frameHeader{}, nil, &AppError{"Received a truncated data frame"}
+	}
+	header := frameHeader{
+		Index:  int(binary.BigEndian.Uint32(frame[0:4])),
+		Offset: int(binary.BigEndian.Uint32(frame[4:8])),
+		Length: int(binary.BigEndian.Uint32(frame[8:12])),
+		Codec:  frame[12],
+	}
+	return header, frame[frameHeaderSize:], nil
+}
+
+// dataChannelLabel - Data channels are labelled "data/<index>/<count>" so that the answering
+// peer knows how many channels to wait for before the session is usable.
+func dataChannelLabel(index int, count int) string {
+	return fmt.Sprintf("data/%d/%d", index, count)
+}
+
+// parseDataChannelLabel - Reverse of dataChannelLabel
+func parseDataChannelLabel(label string) (index int, count int, err error) {
+	if _, err := fmt.Sscanf(label, "data/%d/%d", &index, &count); err != nil {
+		return 0, 0, err
+	}
+	if count < 1 || index < 0 || index >= count {
+		return 0, 0, &AppError{fmt.Sprintf("Invalid data channel label %q", label)}
+	}
+	return index, count, nil
+}
+
+// sendControl - Sends a control message to the peer of this session.
+// Control messages always use the first channel so that they stay in order.
+func (session *PeerSession) sendControl(message ControlMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if !session.open() {
+		return &AppError{"Data channel is not open"}
+	}
+	return session.channels()[0].SendText(string(payload))
+}
+
+// sendControlWhenReady - Sends a control message carrying bulk data, waiting while the peer falls
+// behind or the connection is being recovered. payloadBytes count against the upload limit.
+func (session *PeerSession) sendControlWhenReady(message ControlMessage, payloadBytes int, done <-chan struct{}) error {
+	session.limiter.Wait(payloadBytes)
+	for {
+		select {
+		case <-done:
+			return &AppError{"The transfer has ended"}
+		default:
+		}
+		if !session.healthy() {
+			return session.Err
+		}
+		if session.usable() && session.channels()[0].BufferedAmount() <= maxBufferedAmount {
+			if err := session.sendControl(message); err == nil {
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendChunk - Compresses a chunk with the codec negotiated for this session and sends it
+func (session *PeerSession) sendChunk(index int, chunk []byte, striped bool) error {
+	codec := codecID(session.Compression)
+	encoded, err := compressChunk(codec, chunk)
+	if err != nil {
+		return err
+	}
+	return session.sendEncodedChunk(index, encoded, codec, len(chunk), striped)
+}
+
+// sendEncodedChunk - Sends an encoded chunk as a sequence of frames, waiting whenever the peer falls behind.
+// When striped the frames are spread round robin over every data channel of the session.
+func (session *PeerSession) sendEncodedChunk(index int, encoded []byte, codec byte, rawLength int, striped bool) error {
+	if session.isRecovering() || !session.open() {
+		return errSessionRecovering
+	}
+	channels := session.channels()
+	if !striped {
+		channels = channels[:1]
+	}
+	session.recordSent(index, striped, int64(rawLength), int64(len(encoded)))
+
+	header := frameHeader{Index: index, Length: len(encoded), Codec: codec}
+	for frame := 0; header.Offset < len(encoded); frame, header.Offset = frame+1, header.Offset+maxFramePayload {
+		end := header.Offset + maxFramePayload
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		dataChannel := channels[frame%len(channels)]
+		// An ICE restart keeps the channels, sends simply wait for it
+		for dataChannel.BufferedAmount() > maxBufferedAmount {
+			if !session.healthy() {
+				return session.Err
+			}
+			if dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+				if session.isRecovering() {
+					return errSessionRecovering
+				}
+				return &AppError{"Data channel closed"}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		frameBytes := encodeFrame(header, encoded[header.Offset:end])
+		session.limiter.Wait(len(frameBytes))
+		if err := dataChannel.Send(frameBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throughput - Bytes the peer acknowledged between the first send and the last acknowledgement
+type throughput struct {
+	bytes int64
+	start time.Time
+	last  time.Time
+}
+
+// bytesPerSecond - Zero if nothing was measured
+func (stats throughput) bytesPerSecond() float64 {
+	if elapsed := stats.last.Sub(stats.start); elapsed > 0 {
+		return float64(stats.bytes) / elapsed.Seconds()
+	}
+	return 0
+}
+
+// merge - Combines two measurements into one spanning both
+func (stats throughput) merge(other throughput) throughput {
+	merged := throughput{bytes: stats.bytes + other.bytes, start: stats.start, last: stats.last}
+	if merged.start.IsZero() || (!other.start.IsZero() && other.start.Before(merged.start)) {
+		merged.start = other.start
+	}
+	if other.last.After(merged.last) {
+		merged.last = other.last
+	}
+	return merged
+}
+
+// recordSent - Remembers how a chunk was sent so that its acknowledgement is accounted to the right phase
+func (session *PeerSession) recordSent(index int, striped bool, rawBytes int64, encodedBytes int64) {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+
+	session.rawBytes += rawBytes
+	session.encodedBytes += encodedBytes
+
+	stats := &session.single
+	if striped {
+		stats = &session.striped
+	}
+	if stats.start.IsZero() {
+		stats.start = time.Now()
+	}
+	session.sentStriped[index] = striped
+}
+
+// recordAcknowledged - Accounts for a chunk we sent that the peer has verified
+func (session *PeerSession) recordAcknowledged(index int, bytes int64) {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+
+	striped, sent := session.sentStriped[index]
+	if !sent {
+		// The peer got this chunk from someone else
+		return
+	}
+	delete(session.sentStriped, index)
+	stats := &session.single
+	if striped {
+		stats = &session.striped
+	}
+	stats.bytes += bytes
+	stats.last = time.Now()
+}
+
+// unacknowledged - Number of chunks sent to the peer that it has not verified yet
+func (session *PeerSession) unacknowledged() int {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	return len(session.sentStriped)
+}
+
+// addBytesSent - Accounts for bytes sent to the peer, chunks and deltas are sent concurrently
+func (session *PeerSession) addBytesSent(bytes int64) {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	session.BytesSent += bytes
+}
+
+// progress - Bytes sent to the peer and chunks it has verified so far
+func (session *PeerSession) progress() (int64, int) {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	return session.BytesSent, session.ChunksDone
+}
+
+// compressionSummary - Describes how much compression saved on what we sent to this peer
+func (session *PeerSession) compressionSummary() string {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	return compressionSummary(session.Compression, session.rawBytes, session.encodedBytes)
+}
+
+// throughputSummary - Describes how fast the peer received from us and whether striping helped
+func (session *PeerSession) throughputSummary() string {
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+
+	single, striped := session.single.bytesPerSecond(), session.striped.bytesPerSecond()
+	count := len(session.channels())
+	switch {
+	case count < 2:
+		return fmt.Sprintf("%.2f MB/s", session.single.merge(session.striped).bytesPerSecond()/1e6)
+	case single == 0 || striped == 0:
+		return fmt.Sprintf("%.2f MB/s striped over %d channels, too little data to compare with a single channel", striped/1e6, count)
+	case striped > single*1.1:
+		return fmt.Sprintf("striping over %d channels helped: %.2f MB/s vs %.2f MB/s on one channel (%.1fx)", count, striped/1e6, single/1e6, striped/single)
+	default:
+		return fmt.Sprintf("striping over %d channels did not help: %.2f MB/s vs %.2f MB/s on one channel", count, striped/1e6, single/1e6)
+	}
+}
+
+// newBitfield - Packs a list of flags into a bitfield
+func newBitfield(have []bool) []byte {
+	bitfield := make([]byte, (len(have)+7)/8)
+	for index, ok := range have {
+		if ok {
+			bitfield[index/8] |= 1 << uint(index%8)
+		}
+	}
+	return bitfield
+}
+
+// bitfieldHas - Reports whether chunk index is set in the bitfield
+func bitfieldHas(bitfield []byte, index int) bool {
+	return index/8 < len(bitfield) && bitfield[index/8]&(1<<uint(index%8)) != 0
+}
+
+// bitfieldCount - Number of chunks set in the bitfield
+func bitfieldCount(bitfield []byte) int {
+	count := 0
+	for _, b := range bitfield {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  frameHeader
+		payload []byte
+	}{
+		{name: "an empty payload", header: frameHeader{Index: 0, Offset: 0, Length: 0, Codec: codecNone}},
+		{name: "a piece of a chunk", header: frameHeader{Index: 7, Offset: 65522, Length: 1 << 20, Codec: codecZstd}, payload: []byte("piece")},
+		{name: "the largest index", header: frameHeader{Index: 1<<32 - 1, Offset: 1, Length: 2, Codec: codecGzip}, payload: []byte{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, payload, err := decodeFrame(encodeFrame(test.header, test.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header != test.header || !bytes.Equal(payload, test.payload) {
+				t.Errorf("Decoded %+v %q, want %+v %q", header, payload, test.header, test.payload)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncatedFrame(t *testing.T) {
+	for length := 0; length < frameHeaderSize; length++ {
+		if _, _, err := decodeFrame(make([]byte, length)); err == nil {
+			t.Errorf("Decoding a frame of %d bytes succeeded", length)
+		}
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	tests := []struct {
+		name      string
+		have      []bool
+		want      []byte
+		wantCount int
+	}{
+		{name: "no chunks", have: []bool{}, want: []byte{}},
+		{name: "none held", have: []bool{false, false, false}, want: []byte{0}},
+		{name: "the first", have: []bool{true, false, false}, want: []byte{1}, wantCount: 1},
+		{name: "a full byte", have: []bool{true, true, true, true, true, true, true, true}, want: []byte{0xff}, wantCount: 8},
+		{name: "into a second byte", have: []bool{false, true, false, false, false, false, false, false, true}, want: []byte{2, 1}, wantCount: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bitfield := newBitfield(test.have)
+			if !bytes.Equal(bitfield, test.want) {
+				t.Fatalf("newBitfield = %v, want %v", bitfield, test.want)
+			}
+			if count := bitfieldCount(bitfield); count != test.wantCount {
+				t.Errorf("bitfieldCount = %d, want %d", count, test.wantCount)
+			}
+			for index, have := range test.have {
+				if bitfieldHas(bitfield, index) != have {
+					t.Errorf("bitfieldHas(%d) = %t, want %t", index, !have, have)
+				}
+			}
+			if bitfieldHas(bitfield, len(bitfield)*8) {
+				t.Errorf("bitfieldHas past the end = true")
+			}
+		})
+	}
+}
+
+func TestDataChannelLabel(t *testing.T) {
+	tests := []struct {
+		label     string
+		wantIndex int
+		wantCount int
+		wantErr   bool
+	}{
+		{label: dataChannelLabel(0, 1), wantIndex: 0, wantCount: 1},
+		{label: dataChannelLabel(3, 4), wantIndex: 3, wantCount: 4},
+		{label: "data/4/4", wantErr: true},
+		{label: "data/-1/4", wantErr: true},
+		{label: "data/0/0", wantErr: true},
+		{label: "control", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			index, count, err := parseDataChannelLabel(test.label)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseDataChannelLabel(%q): got error %v, want error %t", test.label, err, test.wantErr)
+			}
+			if err == nil && (index != test.wantIndex || count != test.wantCount) {
+				t.Errorf("parseDataChannelLabel(%q) = %d, %d, want %d, %d", test.label, index, count, test.wantIndex, test.wantCount)
+			}
+		})
+	}
+}
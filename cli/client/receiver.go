@@ -0,0 +1,683 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/pion/webrtc/v3"
+)
+
+// maxRequestsPerPeer - Number of chunks a receiver asks a single peer for at the same time
+const maxRequestsPerPeer = 4
+
+// partialChunk - An encoded chunk whose frames are still arriving from a single peer, possibly
+// over several data channels and therefore out of order
+type partialChunk struct {
+	from     *PeerSession
+	codec    byte
+	data     []byte
+	offsets  map[int]bool
+	received int
+}
+
+// transfer - The file being received, nil when we send
+func (pionClient *PionClient) transfer() *incomingTransfer {
+	pionClient.incomingMux.Lock()
+	defer pionClient.incomingMux.Unlock()
+	return pionClient.incoming
+}
+
+// setTransfer - Replaces the file being received, a sync receives one file after the other
+func (pionClient *PionClient) setTransfer(transfer *incomingTransfer) {
+	pionClient.incomingMux.Lock()
+	defer pionClient.incomingMux.Unlock()
+	pionClient.incoming = transfer
+}
+
+// incomingTransfer - Receiver side state of a file that may arrive from the sender and, in swarm mode,
+// from other receivers at the same time. Every field is guarded by mux.
+type incomingTransfer struct {
+	mux sync.Mutex
+
+	dir                string
+	compressionSetting string
+	// onConflict - Our conflict policy, empty to follow the sender's, see conflict.go
+	onConflict string
+	// path - Where the verified file ends up, it is received into partPath(path) until then
+	path string
+	// identical - path already held the sender's file, skipped - the policy kept a different one,
+	// resuming - chunks already in the part file are kept if they match
+	identical bool
+	skipped   bool
+	resuming  bool
+	// base - The existing copy a delta is applied to, see delta.go. deltaPending until the sender's
+	// delta has been written, chunks are only requested after that.
+	base         *os.File
+	baseSize     int64
+	blockSize    int
+	deltaPending bool
+	reused       int64
+	// compression - Codec accepted from the sender, also used when serving other receivers
+	compression    string
+	rawBytes       int64
+	encodedBytes   int64
+	manifest       *domain.Manifest
+	hashes         []string
+	hashesReceived int
+	file           *os.File
+	writer         *fileWriter
+	have           []bool
+	// writing - Verified chunks queued for the writer, have is set once they are in the file
+	writing   map[int]bool
+	remaining int
+	partial   map[int]*partialChunk
+	inFlight  map[int]*PeerSession
+	peerHave  map[*PeerSession][]byte
+	seeded    bool
+	complete  bool
+	// verified - The complete file matched the manifest's hash
+	verified bool
+	// sync - The directory sync this file is part of, nil for a single file, see sync.go
+	sync *syncReceiver
+}
+
+func newIncomingTransfer(dir string, compressionSetting string, onConflict string) *incomingTransfer {
+	return &incomingTransfer{
+		dir:                dir,
+		compressionSetting: compressionSetting,
+		onConflict:         onConflict,
+		partial:            make(map[int]*partialChunk),
+		writing:            make(map[int]bool),
+		inFlight:           make(map[int]*PeerSession),
+		peerHave:           make(map[*PeerSession][]byte),
+	}
+}
+
+// ready - Whether the manifest and every chunk hash have arrived
+func (transfer *incomingTransfer) ready() bool {
+	return transfer.manifest != nil && transfer.hashesReceived == transfer.manifest.Chunks
+}
+
+// validIndex - Whether index names a chunk of the manifest, peers are not trusted to send only those
+func (transfer *incomingTransfer) validIndex(index int) bool {
+	return transfer.manifest != nil && index >= 0 && index < transfer.manifest.Chunks
+}
+
+// trimBitfield - Drops the bits past the manifest's last chunk
+func (transfer *incomingTransfer) trimBitfield(bitfield []byte) []byte {
+	if transfer.manifest == nil {
+		return bitfield
+	}
+	if size := (transfer.manifest.Chunks + 7) / 8; len(bitfield) > size {
+		return bitfield[:size]
+	}
+	return bitfield
+}
+
+// handleMessage - Entry point for everything a receiver gets on any of its data channels
+func (transfer *incomingTransfer) handleMessage(pionClient *PionClient, session *PeerSession, msg webrtc.DataChannelMessage) {
+	if !msg.IsString {
+		// Waiting for the writer must not hold the lock, it takes it once a chunk is written
+		if write, ok := transfer.handleFrame(pionClient, session, msg.Data); ok {
+			transfer.writer.enqueue(write)
+		}
+		return
+	}
+
+	var message ControlMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		fmt.Printf("Ignoring malformed message from peer %s: %v\n", session.Peer.ID, err)
+		return
+	}
+	if message.Type == MsgDelta || message.Type == MsgDeltaDone {
+		// Hands writes to the writer as well
+		transfer.applyDelta(pionClient, message)
+		return
+	}
+
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	switch message.Type {
+	case MsgManifest:
+		if err := transfer.start(pionClient, message.Manifest); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrPeerRejected, session.Peer.ID, err))
+			return
+		}
+		transfer.checkReady(pionClient)
+	case MsgHashes:
+		if !transfer.validIndex(message.Index) || message.Index+len(message.Hashes) > len(transfer.hashes) {
+			fmt.Printf("Ignoring unexpected chunk hashes from peer %s\n", session.Peer.ID)
+			return
+		}
+		// A batch sent twice must not count its chunks twice
+		for offset, hash := range message.Hashes {
+			if transfer.hashes[message.Index+offset] == "" && hash != "" {
+				transfer.hashesReceived++
+			}
+			transfer.hashes[message.Index+offset] = hash
+		}
+		transfer.checkReady(pionClient)
+	case MsgBitfield:
+		// Another receiver may be ready before we have the manifest, start trims what it sent
+		transfer.peerHave[session] = transfer.trimBitfield(message.Bitfield)
+		transfer.schedule(pionClient)
+	case MsgHave:
+		if !transfer.validIndex(message.Index) {
+			return
+		}
+		bitfield := transfer.peerHave[session]
+		if needed := message.Index/8 + 1; len(bitfield) < needed {
+			bitfield = append(bitfield, make([]byte, needed-len(bitfield))...)
+		}
+		bitfield[message.Index/8] |= 1 << uint(message.Index%8)
+		transfer.peerHave[session] = bitfield
+		transfer.schedule(pionClient)
+	case MsgRequest:
+		if transfer.ready() && transfer.validIndex(message.Index) && transfer.have[message.Index] {
+			go serveChunk(session, transfer.file, transfer.manifest, message.Index, transfer.compression)
+		}
+	case MsgSeeded:
+		transfer.seeded = true
+		transfer.schedule(pionClient)
+	case MsgBye:
+		// Failing the session takes our lock
+		go pionClient.onPeerLeft(session, message)
+	}
+}
+
+// start - Prepares the destination file described by the manifest
+func (transfer *incomingTransfer) start(pionClient *PionClient, manifest *domain.Manifest) error {
+	if transfer.manifest != nil {
+		return &AppError{"Received a second manifest for the same transfer"}
+	}
+	if manifest == nil || manifest.ChunkSize <= 0 || manifest.ChunkSize > maxChunkSize || manifest.Size < 0 {
+		return &AppError{"Received an invalid manifest"}
+	}
+	policy := transfer.onConflict
+	if policy == "" {
+		policy = manifest.OnConflict
+	}
+	if policy == "" {
+		policy = ConflictRename
+	}
+	if !ValidConflictPolicy(policy) {
+		return &AppError{fmt.Sprintf("Unknown conflict policy %q", policy)}
+	}
+
+	file, err := transfer.openDestination(manifest, policy)
+	if err != nil {
+		return newError(ErrFile, "", err)
+	}
+
+	transfer.manifest = manifest
+	transfer.file = file
+	if file != nil && !transfer.identical {
+		transfer.writer = newFileWriter(file, pionClient.Fsync, pionClient.FsyncInterval, pionClient.Lifecycle.Done(), func(index int, err error) {
+			transfer.onWritten(pionClient, index, err)
+		})
+	}
+	for session, bitfield := range transfer.peerHave {
+		transfer.peerHave[session] = transfer.trimBitfield(bitfield)
+	}
+	transfer.hashes = make([]string, manifest.Chunks)
+	transfer.have = make([]bool, manifest.Chunks)
+	transfer.remaining = manifest.Chunks
+	if transfer.identical {
+		for index := range transfer.have {
+			transfer.have[index] = true
+		}
+		transfer.remaining = 0
+	}
+	pionClient.Lifecycle.Advance(StateTransferring)
+	if !transfer.identical && !transfer.skipped {
+		fmt.Printf("\nReceiving %s into %s (%v bytes in %d chunks)\n", manifest.Name, transfer.path, manifest.Size, manifest.Chunks)
+	}
+	return nil
+}
+
+// destPath - Where the file is written. Only the base name of the sender's file is trusted,
+// unless it is part of a sync where names are paths below the destination directory.
+func (transfer *incomingTransfer) destPath(manifest *domain.Manifest) (string, error) {
+	if transfer.sync != nil {
+		return safeLocalPath(transfer.dir, manifest.Name)
+	}
+	return filepath.Join(transfer.dir, filepath.Base(manifest.Name)), nil
+}
+
+// openDestination - Applies the conflict policy to an existing destination and opens the file chunks
+// are written to. An identical destination is opened read only, a skipped one not at all.
+func (transfer *incomingTransfer) openDestination(manifest *domain.Manifest, policy string) (*os.File, error) {
+	path, err := transfer.destPath(manifest)
+	if err != nil {
+		return nil, err
+	}
+	transfer.path = path
+	if transfer.sync != nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+	existing, err := os.Stat(transfer.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if !existing.Mode().IsRegular() {
+			return nil, &AppError{fmt.Sprintf("%s exists and is not a regular file", transfer.path)}
+		}
+		if existing.Size() == manifest.Size {
+			fileHash, err := hashFile(transfer.path)
+			if err != nil {
+				return nil, err
+			}
+			if fileHash == manifest.Hash {
+				transfer.identical = true
+				return os.Open(transfer.path)
+			}
+		}
+
+		if policy == ConflictAsk {
+			policy = askConflict(transfer.path, os.Stdin)
+		}
+		switch policy {
+		case ConflictSkip:
+			transfer.skipped = true
+			return nil, nil
+		case ConflictRename:
+			transfer.path = renamedPath(transfer.path)
+		case ConflictResume:
+			// Without an interrupted transfer to pick up, the existing file is the best guess
+			if _, err := os.Stat(partPath(transfer.path)); os.IsNotExist(err) {
+				if err := copyFile(transfer.path, partPath(transfer.path)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// An older version about to be replaced, the sender only sends what changed
+		if manifest.Delta && policy == ConflictOverwrite && existing.Size() > 0 {
+			if transfer.base, err = os.Open(transfer.path); err != nil {
+				return nil, err
+			}
+			transfer.baseSize = existing.Size()
+		}
+	}
+
+	flags := os.O_CREATE | os.O_RDWR
+	transfer.resuming = policy == ConflictResume
+	if !transfer.resuming {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath(transfer.path), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(manifest.Size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// keepExisting - Marks the chunks already in the part file that match the sender's as received
+func (transfer *incomingTransfer) keepExisting() error {
+	for index := 0; index < transfer.manifest.Chunks; index++ {
+		chunk, err := readChunk(transfer.file, transfer.manifest, index)
+		if err != nil {
+			return err
+		}
+		if hashChunk(chunk) == transfer.hashes[index] {
+			transfer.have[index] = true
+			transfer.remaining--
+		}
+	}
+	fmt.Printf("Resuming with %d of %d chunks already received\n", transfer.manifest.Chunks-transfer.remaining, transfer.manifest.Chunks)
+	return nil
+}
+
+// checkReady - Once every hash is known, tell our swarm what we hold and start asking for chunks
+func (transfer *incomingTransfer) checkReady(pionClient *PionClient) {
+	if !transfer.ready() {
+		return
+	}
+	if transfer.skipped {
+		if sender := pionClient.senderSession(); sender != nil {
+			if err := sender.sendControl(ControlMessage{Type: MsgAccept, Skip: true}); err != nil {
+				fmt.Printf("Could not tell the sender we skip the file: %v\n", err)
+			}
+		}
+		transfer.complete = true
+		fmt.Printf("\nKept the existing %s, skipping the transfer\n", transfer.path)
+		if transfer.sync != nil {
+			// Only this file is skipped, the sender goes on with the next one
+			transfer.sync.fileDone(transfer.manifest.Name)
+			return
+		}
+		pionClient.Lifecycle.Skip()
+		return
+	}
+	if transfer.resuming {
+		if err := transfer.keepExisting(); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+	}
+
+	// The sender does not send what we already have, or anything at all once it knows we hold its file
+	transfer.compression = acceptedCompression(transfer.compressionSetting, transfer.manifest.Compression)
+	accept := ControlMessage{Type: MsgAccept, Compression: transfer.compression}
+	if transfer.identical {
+		accept.Hash = transfer.manifest.Hash
+	} else if transfer.resuming {
+		accept.Bitfield = newBitfield(transfer.have)
+	} else if transfer.base != nil {
+		if err := transfer.sendSignatures(pionClient, &accept); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+	}
+	if sender := pionClient.senderSession(); sender != nil {
+		if err := sender.sendControl(accept); err != nil {
+			fmt.Printf("Could not accept the transfer: %v\n", err)
+		}
+	}
+	if transfer.remaining == 0 {
+		transfer.finish(pionClient)
+		return
+	}
+	if transfer.manifest.Swarm {
+		for _, session := range pionClient.receiverSessions() {
+			transfer.sendBitfield(session)
+		}
+	}
+	transfer.schedule(pionClient)
+}
+
+// sendBitfield - Advertises the chunks we already hold to another receiver
+func (transfer *incomingTransfer) sendBitfield(session *PeerSession) {
+	if err := session.sendControl(ControlMessage{Type: MsgBitfield, Bitfield: newBitfield(transfer.have)}); err != nil {
+		fmt.Printf("Could not advertise chunks to peer %s: %v\n", session.Peer.ID, err)
+	}
+}
+
+// onChannelOpen - A late joining receiver still needs to learn what we hold
+func (transfer *incomingTransfer) onChannelOpen(session *PeerSession) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	if transfer.ready() && transfer.manifest.Swarm && session.Peer.Mode == "R" {
+		transfer.sendBitfield(session)
+	}
+}
+
+// onSessionFailed - Forgets what a failed peer had and asks someone else for its outstanding chunks
+func (transfer *incomingTransfer) onSessionFailed(pionClient *PionClient, session *PeerSession) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	delete(transfer.peerHave, session)
+	for index, inFlightSession := range transfer.inFlight {
+		if inFlightSession == session {
+			delete(transfer.inFlight, index)
+		}
+	}
+	for index, partial := range transfer.partial {
+		if partial.from == session {
+			delete(transfer.partial, index)
+		}
+	}
+
+	// Without the sender only a swarm may still have the chunks we miss
+	if session.Peer.Mode == "S" {
+		switch {
+		case transfer.verified && transfer.sync == nil:
+			pionClient.Lifecycle.Complete()
+		case transfer.sync != nil && transfer.sync.idle():
+			// A watching sender stopped while everything was in sync
+			pionClient.Lifecycle.Complete()
+		case transfer.manifest == nil || !transfer.manifest.Swarm:
+			pionClient.Lifecycle.Fail(newError(ErrNetwork, session.Peer.ID, session.Err))
+		}
+	}
+	if transfer.ready() {
+		transfer.schedule(pionClient)
+	}
+}
+
+// onSessionReset - The connection to a peer was replaced, whatever it was sending us is lost
+func (transfer *incomingTransfer) onSessionReset(session *PeerSession) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	for index, inFlightSession := range transfer.inFlight {
+		if inFlightSession == session {
+			delete(transfer.inFlight, index)
+		}
+	}
+	for index, partial := range transfer.partial {
+		if partial.from == session {
+			delete(transfer.partial, index)
+		}
+	}
+}
+
+// onSessionResumed - A peer is reachable again. Repeats what it may have missed and asks for chunks again.
+func (transfer *incomingTransfer) onSessionResumed(pionClient *PionClient, session *PeerSession) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	if !transfer.ready() {
+		return
+	}
+	switch {
+	case session.Peer.Mode == "S" && transfer.complete:
+		if err := session.sendControl(ControlMessage{Type: MsgComplete}); err != nil {
+			fmt.Printf("Could not report completion to the sender: %v\n", err)
+		}
+	case session.Peer.Mode == "R" && transfer.manifest.Swarm:
+		transfer.sendBitfield(session)
+	}
+	transfer.schedule(pionClient)
+}
+
+// handleFrame - Assembles chunks out of frames. Returns a chunk that matches its hash, ready to be
+// handed to the writer.
+func (transfer *incomingTransfer) handleFrame(pionClient *PionClient, session *PeerSession, frame []byte) (chunkWrite, bool) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	header, payload, err := decodeFrame(frame)
+	if err != nil {
+		fmt.Printf("Ignoring frame from peer %s: %v\n", session.Peer.ID, err)
+		return chunkWrite{}, false
+	}
+	index := header.Index
+	if !transfer.ready() || transfer.writer == nil || index >= transfer.manifest.Chunks || transfer.have[index] || transfer.writing[index] {
+		return chunkWrite{}, false
+	}
+
+	// An encoded chunk may be slightly larger than the chunk itself, but never by much
+	if header.Length > int(transfer.manifest.ChunkSize)+maxFramePayload || header.Offset+len(payload) > header.Length {
+		fmt.Printf("Ignoring out of range frame for chunk %d from peer %s\n", index, session.Peer.ID)
+		return chunkWrite{}, false
+	}
+	partial := transfer.partial[index]
+	if partial == nil {
+		partial = &partialChunk{from: session, codec: header.Codec, data: make([]byte, header.Length), offsets: make(map[int]bool)}
+		transfer.partial[index] = partial
+	} else if partial.from != session || partial.offsets[header.Offset] || len(partial.data) != header.Length {
+		// Someone else is already sending us this chunk, or this frame is a duplicate
+		return chunkWrite{}, false
+	}
+	partial.offsets[header.Offset] = true
+	copy(partial.data[header.Offset:], payload)
+	partial.received += len(payload)
+	if partial.received < header.Length {
+		return chunkWrite{}, false
+	}
+
+	delete(transfer.partial, index)
+	delete(transfer.inFlight, index)
+	length := transfer.manifest.ChunkLength(index)
+	chunk, err := decompressChunk(partial.codec, partial.data, length)
+	if err != nil || int64(len(chunk)) != length || hashChunk(chunk) != transfer.hashes[index] {
+		fmt.Printf("Chunk %d from peer %s failed verification, asking again\n", index, session.Peer.ID)
+		transfer.schedule(pionClient)
+		return chunkWrite{}, false
+	}
+	transfer.writing[index] = true
+	transfer.rawBytes += int64(len(chunk))
+	transfer.encodedBytes += int64(len(partial.data))
+	// Chunks complete in any order, each is written at its own offset
+	return chunkWrite{index: index, offset: transfer.manifest.ChunkOffset(index), data: chunk}, true
+}
+
+// onWritten - Called by the writer once a chunk is in the file. A failed write ends the transfer,
+// our goodbye tells the sender why.
+func (transfer *incomingTransfer) onWritten(pionClient *PionClient, index int, err error) {
+	transfer.mux.Lock()
+	defer transfer.mux.Unlock()
+
+	delete(transfer.writing, index)
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+	switch index {
+	case deltaWriteIndex:
+		return
+	case deltaDoneIndex:
+		transfer.afterDelta(pionClient)
+		return
+	}
+	if transfer.have[index] {
+		return
+	}
+	transfer.have[index] = true
+	transfer.remaining--
+
+	// Let everyone know, the sender uses it for progress and receivers to ask us for it.
+	for _, other := range pionClient.Sessions {
+		if other.usable() && (other.Peer.Mode == "S" || transfer.manifest.Swarm) {
+			other.sendControl(ControlMessage{Type: MsgHave, Index: index})
+		}
+	}
+
+	if transfer.remaining == 0 {
+		transfer.finish(pionClient)
+	} else {
+		transfer.schedule(pionClient)
+	}
+}
+
+// schedule - Asks peers for missing chunks they advertised, spreading requests across peers.
+// The sender is only asked once it has pushed every chunk and nobody else holds the chunk.
+func (transfer *incomingTransfer) schedule(pionClient *PionClient) {
+	if !transfer.ready() || transfer.complete || transfer.deltaPending {
+		return
+	}
+
+	load := make(map[*PeerSession]int)
+	for _, session := range transfer.inFlight {
+		load[session]++
+	}
+
+	for index := 0; index < transfer.manifest.Chunks; index++ {
+		if transfer.have[index] || transfer.writing[index] || transfer.inFlight[index] != nil || transfer.partial[index] != nil {
+			continue
+		}
+
+		var best *PeerSession
+		for _, session := range pionClient.receiverSessions() {
+			if bitfieldHas(transfer.peerHave[session], index) && load[session] < maxRequestsPerPeer &&
+				(best == nil || load[session] < load[best]) {
+				best = session
+			}
+		}
+		if best == nil && transfer.seeded {
+			if sender := pionClient.senderSession(); sender != nil && sender.usable() && load[sender] < maxRequestsPerPeer {
+				best = sender
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		if err := best.sendControl(ControlMessage{Type: MsgRequest, Index: index}); err != nil {
+			continue
+		}
+		transfer.inFlight[index] = best
+		load[best]++
+	}
+}
+
+// finish - Verifies the whole file, moves it into place and reports completion to the sender
+func (transfer *incomingTransfer) finish(pionClient *PionClient) {
+	transfer.complete = true
+	if transfer.identical {
+		// The sender already knows from our ACCEPT
+		transfer.verified = true
+		fmt.Printf("\n%s is identical to the sender's file, nothing to receive\n", transfer.path)
+	} else {
+		if err := transfer.writer.flush(); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+
+		if transfer.base != nil {
+			transfer.base.Close()
+		}
+		// A corrupt file stays in the part file, a resumed transfer keeps whatever chunks match
+		part := partPath(transfer.path)
+		fileHash, err := hashFile(part)
+		if err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+		if fileHash != transfer.manifest.Hash {
+			pionClient.Lifecycle.Fail(&TransferError{Kind: ErrIntegrity, Err: fmt.Errorf("%s does not match the sender's file", part)})
+			return
+		}
+		if err := os.Rename(part, transfer.path); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+		if transfer.sync != nil {
+			// Keeps the sender's modification time so that the next sync finds the file unchanged
+			if err := os.Chtimes(transfer.path, time.Now(), time.Unix(0, transfer.manifest.ModTime)); err != nil {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+		}
+		transfer.verified = true
+		fmt.Printf("\nReceived and verified %s, %s\n", transfer.path, compressionSummary(transfer.compression, transfer.rawBytes, transfer.encodedBytes))
+
+		if sender := pionClient.senderSession(); sender != nil && sender.healthy() {
+			if err := sender.sendControl(ControlMessage{Type: MsgComplete}); err != nil {
+				fmt.Printf("Could not report completion to the sender: %v\n", err)
+			}
+		}
+	}
+	if transfer.sync != nil {
+		// The sender goes on with the next file
+		if transfer.writer != nil {
+			transfer.writer.close()
+		}
+		if transfer.file != nil {
+			transfer.file.Close()
+		}
+		transfer.sync.fileDone(transfer.manifest.Name)
+		return
+	}
+	if transfer.manifest.Swarm && len(pionClient.receiverSessions()) > 0 {
+		// Other receivers may still need chunks from us, the sender says goodbye once they are done
+		pionClient.Lifecycle.Advance(StateSeeding)
+		return
+	}
+	pionClient.Lifecycle.Complete()
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/mahadevans87/go-send/protocol"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// disconnectGrace - ICE often recovers from "disconnected" on its own, give it a moment
+	disconnectGrace = 5 * time.Second
+	// reconnectTimeout - How long a single ICE restart or new connection may take
+	reconnectTimeout = 15 * time.Second
+)
+
+// errSessionRecovering - Returned by sends while the connection to the peer is being recovered
+var errSessionRecovering = &AppError{"Connection is being recovered"}
+
+// startRecovering - Marks the session as recovering. False if it already is or has failed for good.
+func (session *PeerSession) startRecovering() bool {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	if session.Err != nil || session.recovering {
+		return false
+	}
+	session.recovering = true
+	return true
+}
+
+// stopRecovering - The connection is usable again
+func (session *PeerSession) stopRecovering() {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	session.recovering = false
+}
+
+// isRecovering - Whether sends should wait for the connection to come back
+func (session *PeerSession) isRecovering() bool {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	return session.recovering
+}
+
+// usable - Healthy, not recovering and every data channel open
+func (session *PeerSession) usable() bool {
+	return session.healthy() && !session.isRecovering() && session.open()
+}
+
+// connected - Whether ICE is up and every data channel is open
+func (session *PeerSession) connected() bool {
+	state := session.connection().ICEConnectionState()
+	return (state == webrtc.ICEConnectionStateConnected || state == webrtc.ICEConnectionStateCompleted) && session.open()
+}
+
+// waitUntilConnected - Polls the session until it is connected again or the timeout elapses
+func (session *PeerSession) waitUntilConnected(timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if !session.healthy() {
+			return false
+		}
+		if session.connected() {
+			return true
+		}
+	}
+	return false
+}
+
+// onConnectionLost - Recovers an established session, or fails it when reconnection is disabled
+func (pionClient *PionClient) onConnectionLost(session *PeerSession) {
+	if session.isClosed() {
+		return
+	}
+	if pionClient.ReconnectAttempts <= 0 {
+		pionClient.onSessionFailed(session, &AppError{"Connection lost"})
+		return
+	}
+	if session.startRecovering() {
+		go pionClient.recover(session)
+	}
+}
+
+// recover - The offering side first restarts ICE and then falls back to whole new connections,
+// the answering side follows whatever the offerer sends. Either gives up after ReconnectAttempts.
+func (pionClient *PionClient) recover(session *PeerSession) {
+	attempts := pionClient.ReconnectAttempts
+
+	if !session.Offerer {
+		fmt.Printf("Connection to peer %s lost, waiting for it to reconnect\n", session.Peer.ID)
+		if session.waitUntilConnected(time.Duration(attempts)*reconnectTimeout + disconnectGrace) {
+			pionClient.resume(session)
+			return
+		}
+	} else {
+		for attempt := 1; attempt <= attempts; attempt++ {
+			var err error
+			if attempt == 1 {
+				fmt.Printf("Connection to peer %s lost, restarting ICE (attempt %d/%d)\n", session.Peer.ID, attempt, attempts)
+				err = pionClient.restartICE(session)
+			} else {
+				fmt.Printf("Opening a new connection to peer %s (attempt %d/%d)\n", session.Peer.ID, attempt, attempts)
+				err = pionClient.resetConnection(session)
+			}
+			if err != nil {
+				fmt.Printf("Reconnecting to peer %s failed: %v\n", session.Peer.ID, err)
+				continue
+			}
+			if session.waitUntilConnected(reconnectTimeout) {
+				pionClient.resume(session)
+				return
+			}
+		}
+	}
+
+	session.stopRecovering()
+	pionClient.onSessionFailed(session, &AppError{fmt.Sprintf("Gave up reconnecting to peer %s after %d attempts", session.Peer.ID, attempts)})
+	fmt.Println(session.Err)
+}
+
+// resume - Picks the transfer up where it was. Receivers ask again for whatever they miss.
+func (pionClient *PionClient) resume(session *PeerSession) {
+	fmt.Printf("Reconnected to peer %s\n", session.Peer.ID)
+	session.stopRecovering()
+	if incoming := pionClient.transfer(); incoming != nil {
+		incoming.onSessionResumed(pionClient, session)
+		return
+	}
+	if pionClient.isSeeded() {
+		session.sendControl(ControlMessage{Type: MsgSeeded})
+	}
+	if session.isDeltaSent() {
+		// The end of the delta may have been lost with the old connection
+		session.sendControl(ControlMessage{Type: MsgDeltaDone})
+	}
+}
+
+// restartICE - Renegotiates the existing connection with fresh ICE credentials
+func (pionClient *PionClient) restartICE(session *PeerSession) error {
+	sdpMessage, err := pionClient.createOfferMessage(session, &webrtc.OfferOptions{ICERestart: true}, protocol.TypeSDP)
+	if err != nil {
+		return err
+	}
+	return pionClient.signalDescription(session, sdpMessage)
+}
+
+// resetConnection - Replaces the connection with a new one. The RESET message tells the
+// answering side to do the same before answering.
+func (pionClient *PionClient) resetConnection(session *PeerSession) error {
+	if err := pionClient.replaceConnection(session, session.currentGeneration()+1); err != nil {
+		return err
+	}
+	if err := pionClient.setupDataChannelAsOfferer(session); err != nil {
+		return err
+	}
+
+	sdpMessage, err := pionClient.createOfferMessage(session, nil, protocol.TypeReset)
+	if err != nil {
+		return err
+	}
+	return pionClient.signalDescription(session, sdpMessage)
+}
+
+// handleReset - The offering peer gave up on our connection and sent an offer for a new one
+func handleReset(session *PeerSession, incomingMessage domain.Message, pionClient *PionClient) error {
+	if err := pionClient.replaceConnection(session, incomingMessage.Generation); err != nil {
+		return err
+	}
+	pionClient.setupDataChannelAsAnswerer(session)
+	if session.startRecovering() {
+		go pionClient.recover(session)
+	}
+	return handleSDP(session, incomingMessage, pionClient)
+}
+
+// replaceConnection - Closes the current connection of the session and sets up a new one.
+// Signalling messages of older generations are ignored from now on.
+func (pionClient *PionClient) replaceConnection(session *PeerSession, generation int) error {
+	peerConnection, err := webrtc.NewPeerConnection(pionClient.config)
+	if err != nil {
+		return err
+	}
+
+	session.candidatesMux.Lock()
+	session.pendingCandidates = nil
+	session.remoteCandidates = nil
+	session.candidatesMux.Unlock()
+
+	session.channelsMux.Lock()
+	old := session.PeerConnection
+	session.PeerConnection = peerConnection
+	session.generation = generation
+	session.DataChannels = nil
+	session.channelsOpen = 0
+	session.channelsMux.Unlock()
+
+	pionClient.setupPeerConnection(session, peerConnection)
+	if incoming := pionClient.transfer(); incoming != nil {
+		incoming.onSessionReset(session)
+	} else {
+		// Chunks sent over the old connection will never be acknowledged
+		session.statsMux.Lock()
+		session.sentStriped = make(map[int]bool)
+		session.statsMux.Unlock()
+	}
+	return old.Close()
+}
+
+// createOfferMessage - Creates and applies an offer, holding back our candidates until it is signalled
+func (pionClient *PionClient) createOfferMessage(session *PeerSession, options *webrtc.OfferOptions, messageType string) (domain.Message, error) {
+	peerConnection := session.connection()
+	session.holdCandidates()
+
+	offer, err := peerConnection.CreateOffer(options)
+	if err != nil {
+		return domain.Message{}, err
+	}
+	// Sets the LocalDescription, and starts our UDP listeners
+	// Note: this will start the gathering of ICE candidates
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return domain.Message{}, err
+	}
+	offerBytes, err := json.Marshal(offer)
+	if err != nil {
+		return domain.Message{}, err
+	}
+	// Wrap it onto our Message object
+	return domain.Message{
+		Data:       offerBytes,
+		From:       pionClient.ConnectionInfo.ID,
+		To:         session.Peer.ID,
+		Token:      pionClient.ConnectionInfo.Token,
+		Type:       messageType,
+		Generation: session.currentGeneration(),
+	}, nil
+}
+
+// signalDescription - Sends an offer or answer through the signalling server, then the candidates held back meanwhile
+func (pionClient *PionClient) signalDescription(session *PeerSession, sdpMessage domain.Message) error {
+	payload, err := json.Marshal(sdpMessage)
+	if err != nil {
+		return err
+	}
+	if err := sendSDPToPeer(pionClient.ConnectionInfo, payload); err != nil {
+		return err
+	}
+	return pionClient.releaseCandidates(session)
+}
+
+// holdCandidates - Our candidates must not overtake the description we are about to signal
+func (session *PeerSession) holdCandidates() {
+	session.candidatesMux.Lock()
+	defer session.candidatesMux.Unlock()
+	session.holding = true
+}
+
+// releaseCandidates - Signals the candidates held back, once the peer can make use of them
+func (pionClient *PionClient) releaseCandidates(session *PeerSession) error {
+	session.candidatesMux.Lock()
+	defer session.candidatesMux.Unlock()
+
+	session.holding = false
+	if session.connection().RemoteDescription() == nil {
+		return nil
+	}
+	for _, c := range session.pendingCandidates {
+		if err := signalCandidate(c, session, pionClient.ConnectionInfo); err != nil {
+			return err
+		}
+	}
+	session.pendingCandidates = nil
+	return nil
+}
+
+// currentGeneration - Generation of the current connection
+func (session *PeerSession) currentGeneration() int {
+	session.channelsMux.Lock()
+	defer session.channelsMux.Unlock()
+	return session.generation
+}
+
+// isSeeded - Whether the sender has pushed every chunk once
+func (pionClient *PionClient) isSeeded() bool {
+	pionClient.seededMux.Lock()
+	defer pionClient.seededMux.Unlock()
+	return pionClient.seeded
+}
@@ -5,136 +5,588 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/mahadevans87/go-send/protocol"
 	"github.com/pion/webrtc/v3"
 )
 
-var pionAdapter *PionAdapter
+// PionAdapter - Callbacks invoked by the WebRTC client while negotiating and transferring with peers.
+// Errors that end the transfer are reported to the Lifecycle rather than returned.
+type PionAdapter interface {
+	OnReadyToSendOffer(session *PeerSession) (domain.Message, error)
+	OnReadyToSendAnswer(session *PeerSession) (domain.Message, error)
+	OnDataChannelsOpened(sessions []*PeerSession)
+	OnDataChannelMessage(session *PeerSession, msg webrtc.DataChannelMessage)
+}
 
 // PionClient - Implementation of PionAdapter Interface to interact with Pion WebRTC Library
 type PionClient struct {
 	SenderSourcePath string
 	ReceiverDir      string
 	ConnectionInfo   *domain.ConnectionInfo
-	PeerConnection   *webrtc.PeerConnection
-}
+	Sessions         map[string]*PeerSession
+	// Channels - Number of data channels opened per peer, chunks are striped across them
+	Channels int
+	// Compression - auto, zstd, gzip or none. See compression.go
+	Compression string
+	// OnConflict - What to do when the destination exists. See conflict.go
+	OnConflict string
+	// Delta - Receivers with an older copy of the file only get what changed. See delta.go
+	Delta bool
+	// Sync - Mirror the directory at SenderSourcePath into ReceiverDir. See sync.go
+	Sync bool
+	// SyncDelete - Receivers delete files the sender does not have, SyncDryRun - only print the plan
+	SyncDelete bool
+	SyncDryRun bool
+	// Exclude and Include - Patterns in .gitignore syntax that decide which files a sync covers, on
+	// top of .gitignore and .gosendignore files. With Include only matching files are synced. See ignore.go
+	Exclude []string
+	Include []string
+	// FollowSymlinks - A sync sends what links point to instead of the links. PreserveOwner and
+	// Xattrs - Receivers also take on owners, when running as root, and extended attributes. See tree.go
+	FollowSymlinks bool
+	PreserveOwner  bool
+	Xattrs         bool
+	// Watch - After syncing, keep the connections open and push changes once nothing changed for Debounce. See watch.go
+	Watch    bool
+	Debounce time.Duration
+	// Fsync and FsyncInterval - When received files are flushed to disk. See writer.go
+	Fsync         string
+	FsyncInterval time.Duration
+	// SendLimiter - Shared by every session, limits our total upload. May be nil.
+	SendLimiter *RateLimiter
+	// ReceiveLimiter - Paces how fast we read file data, which makes SCTP slow the peer down. May be nil.
+	ReceiveLimiter *RateLimiter
+	// SignalTransport - How messages from other peers are received, one of the network.Signal* transports
+	SignalTransport string
+	// ReconnectAttempts - How often a lost connection is restarted before giving up on the peer, 0 to never
+	ReconnectAttempts int
+	// Lifecycle - Reports how the transfer ends, see lifecycle.go
+	Lifecycle *Lifecycle
 
-func (pionClient *PionClient) updatePeerConnection(conn *webrtc.PeerConnection) {
-	pionClient.PeerConnection = conn
-}
+	config  webrtc.Configuration
+	settled chan *PeerSession
 
-// OnReadyToSendOffer - Interface implementation of PionAdapter
-func (pionClient *PionClient) OnReadyToSendOffer(peerConn *webrtc.PeerConnection) domain.Message {
+	// Sender side: the file being sent, its manifest and receivers reporting completion or failure.
+	// sourceMux guards the file and manifest, a sync sends one file after the other.
+	sourceFile *os.File
+	manifest   *domain.Manifest
+	sourceMux  sync.RWMutex
+	finished   chan *PeerSession
+	// seeded - Every chunk has been pushed once, receivers may ask us for what they miss
+	seeded    bool
+	seededMux sync.Mutex
 
-	// Store peerConnection so that we can use it later.
-	pionClient.updatePeerConnection(peerConn)
+	// Receiver side: the file being received, replaced by every file of a sync
+	incoming    *incomingTransfer
+	incomingMux sync.Mutex
+	syncing     *syncReceiver
+}
 
-	offer, err := pionClient.PeerConnection.CreateOffer(nil)
-	if err != nil {
-		panic(err)
-	}
+var _ PionAdapter = (*PionClient)(nil)
 
-	// Sets the LocalDescription, and starts our UDP listeners
-	// Note: this will start the gathering of ICE candidates
-	if err = pionClient.PeerConnection.SetLocalDescription(offer); err != nil {
-		panic(err)
-	}
-	var offerBytes []byte
-	if offerBytes, err = json.Marshal(offer); err != nil {
-		panic(err)
-	}
-	// Wrap it onto our Message object
-	sdpMessage := domain.Message{
-		Data:  offerBytes,
-		From:  pionClient.ConnectionInfo.ID,
-		To:    pionClient.ConnectionInfo.Peers[0].ID,
-		Token: pionClient.ConnectionInfo.Token,
-		Type:  "SDP",
-	}
-	return sdpMessage
+// OnReadyToSendOffer - Interface implementation of PionAdapter
+func (pionClient *PionClient) OnReadyToSendOffer(session *PeerSession) (domain.Message, error) {
+	return pionClient.createOfferMessage(session, nil, protocol.TypeSDP)
 }
 
 // OnReadyToSendAnswer - For the receiver primarily.
-func (pionClient *PionClient) OnReadyToSendAnswer(peerConnection *webrtc.PeerConnection) domain.Message {
-	pionClient.updatePeerConnection(peerConnection)
+func (pionClient *PionClient) OnReadyToSendAnswer(session *PeerSession) (domain.Message, error) {
+	peerConnection := session.connection()
 
 	// If this is a peer that is going to send an answer, then
 	// Create an answer to send to the other process
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		panic(err)
+		return domain.Message{}, err
 	}
 	// Sets the LocalDescription, and starts our UDP listeners
 	err = peerConnection.SetLocalDescription(answer)
 	if err != nil {
-		panic(err)
+		return domain.Message{}, err
 	}
 
 	var answerBytes []byte
 	if answerBytes, err = json.Marshal(answer); err != nil {
-		panic(err)
+		return domain.Message{}, err
 	}
 
 	// Wrap it onto our Message object
 	sdpMessage := domain.Message{
-		Data:  answerBytes,
-		From:  pionClient.ConnectionInfo.ID,
-		To:    pionClient.ConnectionInfo.Peers[0].ID,
-		Token: pionClient.ConnectionInfo.Token,
-		Type:  "SDP",
+		Data:       answerBytes,
+		From:       pionClient.ConnectionInfo.ID,
+		To:         session.Peer.ID,
+		Token:      pionClient.ConnectionInfo.Token,
+		Type:       protocol.TypeSDP,
+		Generation: session.currentGeneration(),
 	}
-	return sdpMessage
+	return sdpMessage, nil
 }
 
-// OnDataChannelOpened - Callback when Datachannel is opened - Ref : webrtc_client.go
-func (pionClient *PionClient) OnDataChannelOpened(dataChannel *webrtc.DataChannel) {
-	fmt.Printf("Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n", dataChannel.Label(), dataChannel.ID())
-
+// OnDataChannelsOpened - Called once every receiver has either opened its data channels or failed - Ref : webrtc_client.go
+// Sends the file, or in sync mode every file the receivers lack, and reports how it went to the Lifecycle.
+func (pionClient *PionClient) OnDataChannelsOpened(sessions []*PeerSession) {
 	// Only Send file if mode is "S"
-	if pionClient.ConnectionInfo.Mode == "S" {
-		fileBlock := make([]byte, 65535)
-		file, err := os.Open("/home/mahadevan/apache-maven.tar.gz")
+	if pionClient.ConnectionInfo.Mode != "S" {
+		return
+	}
+	pionClient.Lifecycle.Advance(StateTransferring)
+
+	if pionClient.Sync {
+		pionClient.runSync(sessions)
+		return
+	}
+	failure := pionClient.sendFile(pionClient.SenderSourcePath, filepath.Base(pionClient.SenderSourcePath), sessions)
+	select {
+	case <-pionClient.Lifecycle.Done():
+		return
+	default:
+	}
+	fmt.Println("\nDone!")
+
+	if failure != nil {
+		pionClient.Lifecycle.Fail(failure)
+	} else {
+		pionClient.Lifecycle.Complete()
+	}
+}
+
+// sendFile - Sends the file at path, called name on the receivers, to the healthy sessions.
+// Every receiver gets the manifest first. Without swarm every chunk is then sent to every receiver,
+// with swarm each chunk is pushed to a single receiver and receivers fetch the rest from each other.
+// The first few chunks go over a single channel so that the summary can tell whether striping helped.
+// Returns why some receivers did not get the file. Failures on our side end the transfer through the
+// Lifecycle, the caller checks it before carrying on.
+func (pionClient *PionClient) sendFile(path string, name string, sessions []*PeerSession) error {
+	sessions = healthySessions(sessions)
+	pionClient.finished = make(chan *PeerSession, len(sessions))
+	pionClient.seededMux.Lock()
+	pionClient.seeded = false
+	pionClient.seededMux.Unlock()
+	for _, session := range sessions {
+		session.resetTransfer()
+	}
+
+	manifest, hashes, err := buildManifest(path, DefaultChunkSize)
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return nil
+	}
+	manifest.Name = name
+	manifest.Swarm = pionClient.ConnectionInfo.Swarm
+	manifest.OnConflict = pionClient.OnConflict
+	manifest.Delta = pionClient.Delta && !manifest.Swarm
+	if manifest.Delta && manifest.OnConflict == "" {
+		// The point of a delta is to update the receiver's copy
+		manifest.OnConflict = ConflictOverwrite
+	}
+	sourceFile, err := os.Open(path)
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return nil
+	}
+	pionClient.setSource(sourceFile, manifest)
+	defer pionClient.closeSource()
+
+	var firstChunk []byte
+	if manifest.Chunks > 0 {
+		if firstChunk, err = readChunk(sourceFile, manifest, 0); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return nil
+		}
+	}
+	manifest.Compression = offeredCompression(pionClient.Compression, path, firstChunk)
+
+	for _, session := range sessions {
+		if session.healthy() {
+			if err := sendManifest(session, manifest, hashes); err != nil {
+				pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, err))
+			}
+		} else {
+			session.finish(pionClient.finished)
+		}
+	}
+
+	// Frames on other channels may overtake the manifest, wait for receivers to have all of it
+	for _, session := range healthySessions(sessions) {
+		select {
+		case <-session.Accepted:
+		case <-session.failed:
+		}
+	}
+
+	// Receivers that already hold the file get nothing, those with an older copy a delta
+	receiving := make([]*PeerSession, 0, len(sessions))
+	for _, session := range sessions {
+		if session.blockSize > 0 {
+			go pionClient.sendDelta(session, path)
+		} else if session.skipped == "" {
+			receiving = append(receiving, session)
+		}
+	}
+
+	warmupChunks := 0
+	if pionClient.Channels > 1 {
+		warmupChunks = manifest.Chunks / 10
+		if warmupChunks < 4 {
+			warmupChunks = 4
+		}
+	}
+
+	for index := 0; index < manifest.Chunks && len(receiving) > 0; index++ {
+		select {
+		case <-pionClient.Lifecycle.Done():
+			// Interrupted or failed, the controller says goodbye to the receivers
+			return nil
+		default:
+		}
+		if index == warmupChunks && index > 0 {
+			// Let the single channel phase drain so that it is measured on its own
+			waitForAcknowledgements(receiving)
+		}
+		chunk, err := readChunk(sourceFile, manifest, index)
 		if err != nil {
-			panic(err)
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return nil
 		}
-		defer file.Close()
-		for {
-			n, err := file.Read(fileBlock)
-			if err != nil {
-				if err == io.EOF {
-					break
-				} else {
-					panic(err)
+
+		targets := usableSessions(receiving)
+		if len(targets) == 0 {
+			fmt.Println("\nNo receivers left, aborting.")
+			break
+		}
+		if manifest.Swarm {
+			targets = targets[index%len(targets) : index%len(targets)+1]
+		}
+		// Receivers may have accepted different codecs, encode once per codec
+		encoded := make(map[string][]byte)
+		for _, session := range targets {
+			if bitfieldHas(session.resumed, index) {
+				// Kept from an earlier attempt. In swarm mode others ask the receiver for it.
+				continue
+			}
+			data, ok := encoded[session.Compression]
+			if !ok {
+				if data, err = compressChunk(codecID(session.Compression), chunk); err != nil {
+					pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+					return nil
 				}
+				encoded[session.Compression] = data
 			}
-			fmt.Printf("\n Reading %v bytes from file ...", n)
-			dataErr := dataChannel.Send(fileBlock[:n])
-			if dataErr != nil {
-				panic(dataErr)
+			if err := session.sendEncodedChunk(index, data, codecID(session.Compression), len(chunk), index >= warmupChunks); err == errSessionRecovering {
+				// The receiver asks for whatever it missed once it is back
+				continue
+			} else if err != nil {
+				// Drop this receiver, the others carry on.
+				pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, err))
+				continue
 			}
+			session.addBytesSent(int64(len(chunk)))
+		}
+	}
+
+	// Receivers may now ask us for chunks nobody else has, or that were lost while reconnecting
+	pionClient.seededMux.Lock()
+	pionClient.seeded = true
+	pionClient.seededMux.Unlock()
+	for _, session := range usableSessions(receiving) {
+		session.sendControl(ControlMessage{Type: MsgSeeded})
+	}
+
+	// Wait for every receiver to verify the file or fail
+	for range sessions {
+		<-pionClient.finished
+	}
+
+	failed := 0
+	var failure error
+	for _, session := range sessions {
+		bytesSent, chunksDone := session.progress()
+		if session.skipped != "" {
+			fmt.Printf("Peer %s: skipped, %s\n", session.Peer.ID, session.skipped)
+		} else if session.healthy() && session.blockSize > 0 {
+			fmt.Printf("Peer %s: verified, %v bytes sent by us as a delta and chunks it still missed\n", session.Peer.ID, bytesSent)
+		} else if session.healthy() {
+			fmt.Printf("Peer %s: verified, %v bytes sent by us, %s, %s\n", session.Peer.ID, bytesSent, session.throughputSummary(), session.compressionSummary())
+		} else {
+			failed++
+			fmt.Printf("Peer %s: failed after %d of %d chunks (%v)\n", session.Peer.ID, chunksDone, manifest.Chunks, session.Err)
+			failure = worseFailure(failure, session.Err)
+		}
+	}
+	if failure != nil {
+		return &TransferError{Kind: KindOf(failure), Err: fmt.Errorf("%d of %d receivers did not get %s, %v", failed, len(sessions), name, failure)}
+	}
+	return nil
+}
+
+// worseFailure - The failure that decides the outcome. A receiver that got a corrupt file, could not
+// write it or turned us down outweighs lost connections.
+func worseFailure(failure error, err error) error {
+	if kind := KindOf(err); failure == nil || kind == ErrIntegrity || kind == ErrFile || kind == ErrPeerRejected {
+		return err
+	}
+	return failure
+}
+
+// resetTransfer - Forgets what the receiver of this session made of the previous file
+func (session *PeerSession) resetTransfer() {
+	session.Accepted = make(chan bool, 1)
+	session.Compression = ""
+	session.resumed = nil
+	session.skipped = ""
+	session.signatures = nil
+	session.blockSize = 0
+	session.baseSize = 0
+
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	session.BytesSent = 0
+	session.ChunksDone = 0
+	session.finished = false
+	session.deltaSent = false
+	session.sentStriped = make(map[int]bool)
+}
+
+// setSource - Makes file and manifest those being sent
+func (pionClient *PionClient) setSource(file *os.File, manifest *domain.Manifest) {
+	pionClient.sourceMux.Lock()
+	defer pionClient.sourceMux.Unlock()
+	pionClient.sourceFile, pionClient.manifest = file, manifest
+}
+
+// closeSource - Closes the file being sent once no chunk of it is being read. The manifest stays,
+// late messages about the file still find it.
+func (pionClient *PionClient) closeSource() {
+	pionClient.sourceMux.Lock()
+	defer pionClient.sourceMux.Unlock()
+	if pionClient.sourceFile != nil {
+		pionClient.sourceFile.Close()
+		pionClient.sourceFile = nil
+	}
+}
+
+// currentManifest - The manifest of the file being sent, or last sent
+func (pionClient *PionClient) currentManifest() *domain.Manifest {
+	pionClient.sourceMux.RLock()
+	defer pionClient.sourceMux.RUnlock()
+	return pionClient.manifest
+}
+
+// readSourceChunk - Reads a chunk of the file of manifest. False if that file is no longer being
+// sent, e.g. when a receiver asks for a chunk after a sync moved on to the next file.
+func (pionClient *PionClient) readSourceChunk(manifest *domain.Manifest, index int) ([]byte, bool, error) {
+	pionClient.sourceMux.RLock()
+	defer pionClient.sourceMux.RUnlock()
+	if pionClient.manifest != manifest || pionClient.sourceFile == nil {
+		return nil, false, nil
+	}
+	chunk, err := readChunk(pionClient.sourceFile, manifest, index)
+	return chunk, true, err
+}
+
+// doneWith - The receiver of this session has the file. Unless more files follow, its connection may go away now.
+func (pionClient *PionClient) doneWith(session *PeerSession) {
+	session.finish(pionClient.finished)
+	if !pionClient.Sync {
+		session.markClosed()
+	}
+}
+
+// sendManifest - Describes the file to a receiver, followed by the hash of every chunk
+func sendManifest(session *PeerSession, manifest *domain.Manifest, hashes []string) error {
+	if err := session.sendControl(ControlMessage{Type: MsgManifest, Manifest: manifest}); err != nil {
+		return err
+	}
+	for start := 0; start < len(hashes); start += hashesPerMessage {
+		end := start + hashesPerMessage
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		if err := session.sendControl(ControlMessage{Type: MsgHashes, Index: start, Hashes: hashes[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// waitForAcknowledgements - Blocks until healthy peers have verified every chunk we sent them
+func waitForAcknowledgements(sessions []*PeerSession) {
+	for _, session := range healthySessions(sessions) {
+		for session.usable() && session.unacknowledged() > 0 {
+			time.Sleep(10 * time.Millisecond)
 		}
-		fmt.Println("\nDone!")
+	}
+}
 
+// healthySessions - The sessions that have not failed so far
+func healthySessions(sessions []*PeerSession) []*PeerSession {
+	healthy := make([]*PeerSession, 0, len(sessions))
+	for _, session := range sessions {
+		if session.healthy() {
+			healthy = append(healthy, session)
+		}
 	}
+	return healthy
 }
 
-// OnDataChannelMessage - Typically used by the receiver mode "R"
-func (pionClient *PionClient) OnDataChannelMessage(msg webrtc.DataChannelMessage) {
-	file, err := os.OpenFile("/home/mahadevan/apache-maven_copy.tar.gz", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// usableSessions - The healthy sessions, waiting while every one of them is reconnecting
+func usableSessions(sessions []*PeerSession) []*PeerSession {
+	for {
+		healthy := healthySessions(sessions)
+		usable := make([]*PeerSession, 0, len(healthy))
+		for _, session := range healthy {
+			if session.usable() {
+				usable = append(usable, session)
+			}
+		}
+		if len(usable) > 0 || len(healthy) == 0 {
+			return usable
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// serveChunk - Answers a chunk request from file
+func serveChunk(session *PeerSession, file io.ReaderAt, manifest *domain.Manifest, index int, compression string) {
+	chunk, err := readChunk(file, manifest, index)
 	if err != nil {
-		panic(err)
+		fmt.Printf("Could not read chunk %d for peer %s: %v\n", index, session.Peer.ID, err)
+		return
+	}
+	codec := codecID(compression)
+	encoded, err := compressChunk(codec, chunk)
+	if err != nil {
+		fmt.Printf("Could not compress chunk %d for peer %s: %v\n", index, session.Peer.ID, err)
+		return
+	}
+	if err := session.sendEncodedChunk(index, encoded, codec, len(chunk), true); err != nil {
+		fmt.Printf("Could not send chunk %d to peer %s: %v\n", index, session.Peer.ID, err)
+	}
+}
+
+// finish - Reports the receiver of this session as done, whether it succeeded or failed
+func (session *PeerSession) finish(finished chan<- *PeerSession) {
+	session.statsMux.Lock()
+	reported := session.finished
+	session.finished = true
+	session.statsMux.Unlock()
+	if !reported {
+		finished <- session
 	}
-	defer file.Close()
-	n, writeErr := file.Write(msg.Data)
-	if writeErr != nil {
-		panic(writeErr)
+}
+
+// reportProgress - Accounts for one more verified chunk on this peer and prints progress roughly every 10%.
+func (session *PeerSession) reportProgress(totalChunks int) {
+	if totalChunks <= 0 {
+		return
 	}
-	fSyncErr := file.Sync()
-	if fSyncErr != nil {
-		panic(fSyncErr)
+	session.statsMux.Lock()
+	defer session.statsMux.Unlock()
+	before := session.ChunksDone * 10 / totalChunks
+	session.ChunksDone++
+	if after := session.ChunksDone * 10 / totalChunks; after != before {
+		fmt.Printf("Peer %s: %d%% (%d/%d chunks)\n", session.Peer.ID, session.ChunksDone*100/totalChunks, session.ChunksDone, totalChunks)
 	}
-	fmt.Printf("Wrote %v bytes to file\n", n)
+}
 
+// OnDataChannelMessage - Receivers hand everything to the incoming transfer. The sender only
+// listens for progress, completion and, in swarm mode, requests for chunks nobody else holds.
+func (pionClient *PionClient) OnDataChannelMessage(session *PeerSession, msg webrtc.DataChannelMessage) {
+	if pionClient.syncing != nil && msg.IsString && pionClient.syncing.handleMessage(pionClient, session, msg) {
+		return
+	}
+	if incoming := pionClient.transfer(); incoming != nil {
+		incoming.handleMessage(pionClient, session, msg)
+		return
+	}
+	if !msg.IsString {
+		return
+	}
+
+	var message ControlMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		fmt.Printf("Ignoring malformed message from peer %s: %v\n", session.Peer.ID, err)
+		return
+	}
+	// The file this message is about, a sync may start sending the next one before it is handled
+	manifest := pionClient.currentManifest()
+	if manifest == nil && (message.Type == MsgAccept || message.Type == MsgHave || message.Type == MsgRequest || message.Type == MsgComplete) {
+		fmt.Printf("Ignoring %s from peer %s before any file was offered\n", message.Type, session.Peer.ID)
+		return
+	}
+	switch message.Type {
+	case MsgSignatures:
+		if message.Index != len(session.signatures) {
+			fmt.Printf("Ignoring out of order block signatures from peer %s\n", session.Peer.ID)
+			return
+		}
+		session.signatures = append(session.signatures, message.Signatures...)
+	case MsgPlan:
+		// One PLAN answers each TREE, the round reads it. Another one before that is not waited for.
+		select {
+		case session.planned <- message:
+		default:
+			fmt.Printf("Ignoring an unexpected sync plan from peer %s\n", session.Peer.ID)
+		}
+	case MsgAccept:
+		if message.BlockSize > 0 && message.Blocks == len(session.signatures) && manifest.Delta {
+			session.blockSize = message.BlockSize
+			session.baseSize = message.BaseSize
+		}
+		session.Compression = message.Compression
+		session.resumed = message.Bitfield
+		session.statsMux.Lock()
+		session.ChunksDone = bitfieldCount(message.Bitfield)
+		session.statsMux.Unlock()
+		switch {
+		case message.Hash != "" && message.Hash == manifest.Hash:
+			session.skipped = "it already has an identical copy"
+		case message.Skip:
+			session.skipped = "it keeps its existing file"
+		}
+		session.Accepted <- true
+		if session.skipped != "" {
+			pionClient.doneWith(session)
+		}
+	case MsgHave:
+		if message.Index < 0 || message.Index >= manifest.Chunks {
+			return
+		}
+		session.recordAcknowledged(message.Index, manifest.ChunkLength(message.Index))
+		session.reportProgress(manifest.Chunks)
+	case MsgRequest:
+		if message.Index < 0 || message.Index >= manifest.Chunks {
+			fmt.Printf("Ignoring a request for chunk %d of %d from peer %s\n", message.Index, manifest.Chunks, session.Peer.ID)
+			return
+		}
+		go func() {
+			chunk, current, err := pionClient.readSourceChunk(manifest, message.Index)
+			if !current {
+				// Asked for a file we are done sending
+				return
+			}
+			if err != nil {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+			if err := session.sendChunk(message.Index, chunk, true); err == errSessionRecovering {
+				// Asked again once the connection is back
+				return
+			} else if err != nil {
+				pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, err))
+				return
+			}
+			session.addBytesSent(int64(len(chunk)))
+		}()
+	case MsgComplete:
+		fmt.Printf("Peer %s has received and verified %s\n", session.Peer.ID, manifest.Name)
+		pionClient.doneWith(session)
+	case MsgBye:
+		pionClient.onPeerLeft(session, message)
+	}
 }
@@ -0,0 +1,531 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/pion/webrtc/v3"
+)
+
+// Directory sync. The sender lists every file of its directory with size, modification time and
+// hash (TREE). Each receiver compares the list with its own directory and answers with a PLAN of
+// the files it lacks or holds in another version. The sender then sends those files one after the
+// other as ordinary transfers over the same connections and ends with SYNC_DONE, upon which
+// receivers delete the files the sender does not have when asked to.
+
+// sendTree - Lists the directory, or what changed in it, to a receiver, followed by what we ask of it
+func (pionClient *PionClient) sendTree(session *PeerSession, tree []domain.FileEntry, incremental bool) error {
+	start, size := 0, 0
+	for index, entry := range tree {
+		size += 256 + len(entry.Path) + len(entry.Target)
+		for name, value := range entry.Xattrs {
+			size += len(name) + len(value)*4/3
+		}
+		if size < treeMessageBytes && index < len(tree)-1 {
+			continue
+		}
+		if err := session.sendControl(ControlMessage{Type: MsgTree, Index: start, Files: tree[start : index+1]}); err != nil {
+			return err
+		}
+		start, size = index+1, 0
+	}
+	return session.sendControl(ControlMessage{
+		Type:        MsgTreeDone,
+		Count:       len(tree),
+		Delete:      pionClient.SyncDelete,
+		DryRun:      pionClient.SyncDryRun,
+		Watch:       pionClient.Watch,
+		Incremental: incremental,
+		Exclude:     pionClient.Exclude,
+		Include:     pionClient.Include,
+		Owner:       pionClient.PreserveOwner,
+	})
+}
+
+// excludePatterns - What a sync leaves out on top of ignore files: our -exclude patterns and those
+// of the sender, plus .git when watching
+func (pionClient *PionClient) excludePatterns(watching bool, sender []string) []string {
+	patterns := make([]string, 0)
+	if watching {
+		patterns = append(patterns, watchIgnored...)
+	}
+	patterns = append(patterns, sender...)
+	return append(patterns, pionClient.Exclude...)
+}
+
+// runSync - Sends every receiver the files it lacks, then keeps pushing changes when watching
+func (pionClient *PionClient) runSync(sessions []*PeerSession) {
+	root := pionClient.SenderSourcePath
+	load := func() (*ignoreRules, error) {
+		return loadIgnoreRules(root, pionClient.excludePatterns(pionClient.Watch, nil), pionClient.Include)
+	}
+	rules, err := load()
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+	var watcher *treeWatcher
+	if pionClient.Watch {
+		// Watching starts first so that changes made while syncing are not missed
+		if watcher, err = newTreeWatcher(root, rules, load, pionClient.Lifecycle.Done()); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+	}
+	tree, err := buildTree(root, rules, pionClient.treeOptions())
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+	fmt.Printf("Syncing %s, %d entries\n", root, len(tree))
+
+	failure := pionClient.syncRound(sessions, tree, false)
+	select {
+	case <-pionClient.Lifecycle.Done():
+		return
+	default:
+	}
+	if pionClient.Watch && len(healthySessions(sessions)) > 0 {
+		if failure != nil {
+			fmt.Printf("\n%v\n", failure)
+		}
+		pionClient.watch(sessions, watcher, tree)
+		return
+	}
+	fmt.Println("\nDone!")
+	if failure != nil {
+		pionClient.Lifecycle.Fail(failure)
+	} else {
+		pionClient.Lifecycle.Complete()
+	}
+}
+
+// syncRound - Lists tree to the receivers, sends each the files it asks for and tells them we are done.
+// Returns why some receivers did not get every file.
+func (pionClient *PionClient) syncRound(sessions []*PeerSession, tree []domain.FileEntry, incremental bool) error {
+	for _, session := range healthySessions(sessions) {
+		if err := pionClient.sendTree(session, tree, incremental); err != nil {
+			pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, err))
+		}
+	}
+	dryRun := pionClient.SyncDryRun
+	for _, session := range healthySessions(sessions) {
+		select {
+		case plan := <-session.planned:
+			session.plan = plan.Bitfield
+			session.planDeletes = plan.Count
+			session.planDryRun = plan.DryRun
+		case <-session.failed:
+			continue
+		}
+		files, bytes := 0, int64(0)
+		for index, entry := range tree {
+			if bitfieldHas(session.plan, index) {
+				files++
+				bytes += entry.Size
+			}
+		}
+		fmt.Printf("Peer %s: %d files to send (%d bytes), %d to delete\n", session.Peer.ID, files, bytes, session.planDeletes)
+		dryRun = dryRun || session.planDryRun
+	}
+
+	var failure error
+	for index, entry := range tree {
+		targets := make([]*PeerSession, 0)
+		names := make([]string, 0)
+		for _, session := range healthySessions(sessions) {
+			if bitfieldHas(session.plan, index) {
+				targets = append(targets, session)
+				names = append(names, session.Peer.ID)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("  would send %s (%d bytes) to %s\n", entry.Path, entry.Size, strings.Join(names, ", "))
+			continue
+		}
+
+		fmt.Printf("\nSending %s (%d bytes)\n", entry.Path, entry.Size)
+		if err := pionClient.sendFile(filepath.Join(pionClient.SenderSourcePath, filepath.FromSlash(entry.Path)), entry.Path, targets); err != nil {
+			failure = worseFailure(failure, err)
+		}
+		select {
+		case <-pionClient.Lifecycle.Done():
+			return failure
+		default:
+		}
+	}
+
+	for _, session := range usableSessions(sessions) {
+		if err := session.sendControl(ControlMessage{Type: MsgSyncDone}); err != nil {
+			fmt.Printf("Could not tell peer %s the sync is done: %v\n", session.Peer.ID, err)
+		}
+	}
+	return failure
+}
+
+// syncReceiver - Receiver side of a directory sync. Every field is guarded by mux.
+type syncReceiver struct {
+	mux  sync.Mutex
+	tree []domain.FileEntry
+	// wanted - Paths of the plan that have not been received yet
+	wanted   map[string]bool
+	received int
+	// links - Indexes of the links to create, attributes - of entries whose owner, permissions or
+	// extended attributes are set once everything arrived
+	links      []int
+	attributes []int
+	deletes    []string
+	dryRun     bool
+	owner      bool
+	// watching - The sender pushes changes after the first round, waiting - between rounds
+	watching bool
+	waiting  bool
+}
+
+// handleMessage - Handles the messages of the sync itself and starts a new transfer for every
+// manifest. Returns false for messages the current transfer handles.
+func (receiver *syncReceiver) handleMessage(pionClient *PionClient, session *PeerSession, msg webrtc.DataChannelMessage) bool {
+	var message ControlMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		return false
+	}
+	switch message.Type {
+	case MsgTree:
+		receiver.mux.Lock()
+		defer receiver.mux.Unlock()
+		if message.Index != len(receiver.tree) {
+			fmt.Printf("Ignoring out of order file list from peer %s\n", session.Peer.ID)
+			return true
+		}
+		receiver.waiting = false
+		receiver.tree = append(receiver.tree, message.Files...)
+		return true
+	case MsgTreeDone:
+		receiver.plan(pionClient, session, message)
+		return true
+	case MsgManifest:
+		receiver.mux.Lock()
+		wanted := message.Manifest != nil && receiver.wanted[message.Manifest.Name]
+		receiver.mux.Unlock()
+		if !wanted {
+			pionClient.Lifecycle.Fail(&TransferError{Kind: ErrPeerRejected, Peer: session.Peer.ID, Err: &AppError{"The sender sent a file we did not ask for"}})
+			return true
+		}
+		// Every file is a transfer of its own, the sync decides what to overwrite
+		transfer := newIncomingTransfer(pionClient.ReceiverDir, pionClient.Compression, ConflictOverwrite)
+		transfer.sync = receiver
+		pionClient.setTransfer(transfer)
+		return false
+	case MsgSyncDone:
+		receiver.finish(pionClient)
+		return true
+	}
+	return false
+}
+
+// plan - Compares the sender's listing with ours and tells the sender which files we lack.
+// Directories are created right away, links and attributes wait until every file arrived.
+// An incremental list only holds what changed, entries it marks as removed are deleted if asked to.
+func (receiver *syncReceiver) plan(pionClient *PionClient, session *PeerSession, message ControlMessage) {
+	receiver.mux.Lock()
+	defer receiver.mux.Unlock()
+
+	dir := pionClient.ReceiverDir
+	receiver.dryRun = message.DryRun || pionClient.SyncDryRun
+	receiver.watching = message.Watch
+	receiver.owner = message.Owner && os.Geteuid() == 0
+	if message.Owner && !receiver.owner {
+		fmt.Println("Not running as root, files keep our owner")
+	}
+	deleteExtraneous := message.Delete || pionClient.SyncDelete
+	if len(receiver.tree) != message.Count {
+		pionClient.Lifecycle.Fail(&TransferError{Kind: ErrPeerRejected, Peer: session.Peer.ID, Err: fmt.Errorf("the sender listed %d of %d entries", len(receiver.tree), message.Count)})
+		return
+	}
+	// What the sender leaves out must be left alone here too, or -delete would remove it
+	include := append(append([]string{}, message.Include...), pionClient.Include...)
+	rules, err := loadIgnoreRules(dir, pionClient.excludePatterns(receiver.watching, message.Exclude), include)
+	if err != nil && !os.IsNotExist(err) {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+	local, err := localFiles(dir, rules)
+	if err != nil {
+		pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+		return
+	}
+
+	want := make([]bool, len(receiver.tree))
+	receiver.wanted = make(map[string]bool)
+	listed := make(map[string]bool)
+	for index, entry := range receiver.tree {
+		localPath, err := safeLocalPath(dir, entry.Path)
+		if err == nil && entry.Type == domain.EntrySymlink && !linkStaysInside(entry.Path, entry.Target) {
+			err = &AppError{fmt.Sprintf("Refusing the link %q to %q, it leaves the destination", entry.Path, entry.Target)}
+		}
+		if err == nil && entry.Type != domain.EntryFile && entry.Type != domain.EntryDir && entry.Type != domain.EntrySymlink {
+			err = &AppError{fmt.Sprintf("Refusing %q of unknown type %q", entry.Path, entry.Type)}
+		}
+		if err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrPeerRejected, session.Peer.ID, err))
+			return
+		}
+		listed[entry.Path] = true
+		info, exists := local[entry.Path]
+		if entry.Removed {
+			if exists && deleteExtraneous {
+				receiver.deletes = append(receiver.deletes, entry.Path)
+			}
+			continue
+		}
+		change, err := receiver.compare(localPath, entry, info, exists)
+		if err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+		if change == "" {
+			continue
+		}
+		if receiver.dryRun {
+			fmt.Printf("  %-10s %s\n", change, entry.Path)
+			continue
+		}
+		if change == "replaced" {
+			if err := removeLocal(localPath, info, deleteExtraneous); err != nil {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+		}
+		receiver.attributes = append(receiver.attributes, index)
+		if change == "attributes" {
+			continue
+		}
+		switch entry.Type {
+		case domain.EntryFile:
+			want[index] = true
+			receiver.wanted[entry.Path] = true
+		case domain.EntryDir:
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+		case domain.EntrySymlink:
+			receiver.links = append(receiver.links, index)
+		}
+	}
+	if deleteExtraneous && !message.Incremental {
+		for localPath := range local {
+			if !listed[localPath] {
+				receiver.deletes = append(receiver.deletes, localPath)
+			}
+		}
+	}
+	// Whatever a directory holds goes before the directory
+	sort.Sort(sort.Reverse(sort.StringSlice(receiver.deletes)))
+	if receiver.dryRun {
+		for _, localPath := range receiver.deletes {
+			fmt.Printf("  %-10s %s\n", "delete", localPath)
+		}
+	}
+
+	fmt.Printf("Plan: %d files to receive, %d entries to update, %d to delete", len(receiver.wanted), len(receiver.attributes)-len(receiver.wanted), len(receiver.deletes))
+	if receiver.dryRun {
+		fmt.Printf(" (dry run, nothing is changed)")
+	}
+	fmt.Println()
+	plan := ControlMessage{Type: MsgPlan, Bitfield: newBitfield(want), Count: len(receiver.deletes), DryRun: receiver.dryRun}
+	// The list may arrive before our side of the data channel reports it open
+	go func() {
+		if err := session.sendControlWhenReady(plan, 0, pionClient.Lifecycle.Done()); err != nil {
+			pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, err))
+		}
+	}()
+}
+
+// compare - How our copy of an entry differs from the sender's: "" when it does not, "attributes"
+// when only its owner, permissions or extended attributes do and "replaced" when it is of another
+// type. Files of the same size and modification time are taken to be the same, like rsync does,
+// others are hashed.
+func (receiver *syncReceiver) compare(localPath string, entry domain.FileEntry, info os.FileInfo, exists bool) (string, error) {
+	switch {
+	case !exists:
+		return "new", nil
+	case entryType(info) != entry.Type:
+		return "replaced", nil
+	}
+	switch entry.Type {
+	case domain.EntryFile:
+		if info.Size() != entry.Size {
+			return "changed", nil
+		}
+		if info.ModTime().UnixNano() != entry.ModTime {
+			fileHash, err := hashFile(localPath)
+			if err != nil {
+				return "", err
+			}
+			if fileHash != entry.Hash {
+				return "changed", nil
+			}
+			if !receiver.dryRun {
+				// Saves hashing it again next time
+				os.Chtimes(localPath, time.Now(), time.Unix(0, entry.ModTime))
+			}
+		}
+	case domain.EntrySymlink:
+		target, err := os.Readlink(localPath)
+		if err != nil {
+			return "", err
+		}
+		if filepath.ToSlash(target) != entry.Target {
+			return "changed", nil
+		}
+	}
+	differ, err := attributesDiffer(localPath, info, entry, receiver.owner)
+	if differ {
+		return "attributes", err
+	}
+	return "", err
+}
+
+// removeLocal - Makes way for an entry of another type. A directory that is not empty only goes
+// along with everything in it when deleting extraneous files.
+func removeLocal(localPath string, info os.FileInfo, deleteExtraneous bool) error {
+	if info.IsDir() && deleteExtraneous {
+		return os.RemoveAll(localPath)
+	}
+	return os.Remove(localPath)
+}
+
+// fileDone - A file of the plan has been received and verified
+func (receiver *syncReceiver) fileDone(name string) {
+	receiver.mux.Lock()
+	defer receiver.mux.Unlock()
+	if receiver.wanted[name] {
+		delete(receiver.wanted, name)
+		receiver.received++
+	}
+}
+
+// idle - Whether a watching sender has nothing in progress, so that it may leave
+func (receiver *syncReceiver) idle() bool {
+	receiver.mux.Lock()
+	defer receiver.mux.Unlock()
+	return receiver.watching && receiver.waiting
+}
+
+// finish - The sender is done. Once every file has arrived, creates the links, deletes what the
+// sender does not have and sets attributes, deepest entries first so that directories keep their
+// modification times. A watching sender goes on with the next round once something changes.
+func (receiver *syncReceiver) finish(pionClient *PionClient) {
+	receiver.mux.Lock()
+	defer receiver.mux.Unlock()
+
+	if receiver.dryRun {
+		pionClient.Lifecycle.Complete()
+		return
+	}
+	if len(receiver.wanted) > 0 {
+		pionClient.Lifecycle.Fail(&TransferError{Kind: ErrNetwork, Err: fmt.Errorf("the sender finished with %d files missing", len(receiver.wanted))})
+		return
+	}
+	if err := receiver.createLinks(pionClient.ReceiverDir); err != nil {
+		pionClient.Lifecycle.Fail(err)
+		return
+	}
+	for _, localPath := range receiver.deletes {
+		if err := receiver.remove(pionClient.ReceiverDir, localPath); err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+	}
+	for position := len(receiver.attributes) - 1; position >= 0; position-- {
+		entry := receiver.tree[receiver.attributes[position]]
+		localPath, err := safeLocalPath(pionClient.ReceiverDir, entry.Path)
+		if err == nil {
+			err = applyAttributes(localPath, entry, receiver.owner)
+		}
+		if err != nil {
+			pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+			return
+		}
+	}
+	fmt.Printf("\nSync complete, %d files received, %d entries updated, %d deleted\n", receiver.received, len(receiver.attributes)-receiver.received, len(receiver.deletes))
+	if !receiver.watching {
+		pionClient.Lifecycle.Complete()
+		return
+	}
+	fmt.Println("Waiting for changes")
+	pionClient.Lifecycle.Advance(StateWatching)
+	receiver.tree = nil
+	receiver.wanted = nil
+	receiver.links = nil
+	receiver.attributes = nil
+	receiver.deletes = nil
+	receiver.received = 0
+	receiver.waiting = true
+}
+
+// createLinks - Creates the links of the plan. A link that, through other links, resolves to
+// something outside of dir is removed again.
+func (receiver *syncReceiver) createLinks(dir string) error {
+	for _, index := range receiver.links {
+		entry := receiver.tree[index]
+		localPath, err := safeLocalPath(dir, entry.Path)
+		if err != nil {
+			return newError(ErrPeerRejected, "", err)
+		}
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return newError(ErrFile, "", err)
+		}
+		if err := os.Symlink(filepath.FromSlash(entry.Target), localPath); err != nil {
+			return newError(ErrFile, "", err)
+		}
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return newError(ErrFile, "", err)
+	}
+	for _, index := range receiver.links {
+		localPath := filepath.Join(dir, filepath.FromSlash(receiver.tree[index].Path))
+		if resolved, err := filepath.EvalSymlinks(localPath); err == nil && !within(realDir, resolved) {
+			os.Remove(localPath)
+			return newError(ErrPeerRejected, "", &AppError{fmt.Sprintf("Refusing the link %s, it resolves to %s", localPath, resolved)})
+		}
+	}
+	return nil
+}
+
+// remove - Deletes an entry the sender does not have. Directories that still hold files we leave
+// out are kept.
+func (receiver *syncReceiver) remove(dir string, name string) error {
+	localPath, err := safeLocalPath(dir, name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(localPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(localPath); err != nil {
+		if info.IsDir() {
+			fmt.Printf("Keeping %s, it is not empty\n", name)
+			return nil
+		}
+		return err
+	}
+	fmt.Printf("Deleted %s\n", name)
+	return nil
+}
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+)
+
+// Describing a directory for a sync and reproducing it on the receiver: regular files, directories,
+// symbolic links and permission bits, plus owners and extended attributes when asked for. Nothing
+// the sender lists may lead the receiver to write outside of its destination directory.
+
+// treeMessageBytes - Rough size of the entries sent in one TREE message, well below what a data
+// channel message may hold
+const treeMessageBytes = 32 * 1024
+
+// xattrNamespace - Only extended attributes in this namespace are copied, the others grant privileges
+const xattrNamespace = "user."
+
+// treeOptions - What a listing of a directory describes besides files, directories and links
+type treeOptions struct {
+	// follow - Symbolic links are listed as what they point to
+	follow bool
+	owner  bool
+	xattrs bool
+}
+
+// treeOptions - How the sender lists its directory
+func (pionClient *PionClient) treeOptions() treeOptions {
+	return treeOptions{follow: pionClient.FollowSymlinks, owner: pionClient.PreserveOwner, xattrs: pionClient.Xattrs}
+}
+
+// buildTree - Lists everything below root that is not ignored
+func buildTree(root string, rules *ignoreRules, options treeOptions) ([]domain.FileEntry, error) {
+	return listFiles(root, root, rules, options)
+}
+
+// listFiles - Lists dir and everything below it that is not ignored, with paths relative to root.
+// Parents come before what they hold. Links that point outside of root are left out unless followed,
+// devices, sockets and pipes always are.
+func listFiles(root string, dir string, rules *ignoreRules, options treeOptions) ([]domain.FileEntry, error) {
+	tree := make([]domain.FileEntry, 0)
+	// ancestors - Real paths of the directories being walked, a followed link must not lead into a loop
+	ancestors := make(map[string]bool)
+
+	var walk func(name string, info os.FileInfo) error
+	walk = func(name string, info os.FileInfo) error {
+		relative, err := relativeSlashPath(root, name)
+		if err != nil {
+			return err
+		}
+		if relative != "" && rules.excluded(relative, info.IsDir()) {
+			return nil
+		}
+		source := name
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			if !options.follow {
+				if !linkStaysInside(relative, target) {
+					fmt.Printf("Leaving out %s, it points outside of %s\n", name, root)
+					return nil
+				}
+				entry, err := describeEntry(name, relative, info, options)
+				if err != nil {
+					return err
+				}
+				entry.Type = domain.EntrySymlink
+				entry.Target = filepath.ToSlash(target)
+				tree = append(tree, entry)
+				return nil
+			}
+			if info, err = os.Stat(name); err != nil {
+				fmt.Printf("Leaving out %s, it points to nothing\n", name)
+				return nil
+			}
+			if source, err = filepath.EvalSymlinks(name); err != nil {
+				return err
+			}
+			if relative != "" && rules.excluded(relative, info.IsDir()) {
+				return nil
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			realPath, err := filepath.EvalSymlinks(name)
+			if err != nil {
+				return err
+			}
+			if ancestors[realPath] {
+				fmt.Printf("Leaving out %s, it leads back to %s\n", name, realPath)
+				return nil
+			}
+			ancestors[realPath] = true
+			defer delete(ancestors, realPath)
+			if relative != "" {
+				entry, err := describeEntry(source, relative, info, options)
+				if err != nil {
+					return err
+				}
+				entry.Type = domain.EntryDir
+				tree = append(tree, entry)
+			}
+			children, err := ioutil.ReadDir(name)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if err := walk(filepath.Join(name, child.Name()), child); err != nil {
+					return err
+				}
+			}
+		case info.Mode().IsRegular():
+			entry, err := describeEntry(source, relative, info, options)
+			if err != nil {
+				return err
+			}
+			entry.Size = info.Size()
+			if entry.Hash, err = hashFile(name); os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			tree = append(tree, entry)
+		}
+		return nil
+	}
+
+	info, err := os.Lstat(dir)
+	if err == nil && dir == root {
+		info, err = os.Stat(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree, walk(dir, info)
+}
+
+// describeEntry - What every type of entry carries
+func describeEntry(source string, relative string, info os.FileInfo, options treeOptions) (domain.FileEntry, error) {
+	entry := domain.FileEntry{Path: relative, ModTime: info.ModTime().UnixNano(), Mode: unixMode(info.Mode())}
+	if options.owner {
+		if uid, gid, ok := fileOwner(info); ok {
+			entry.UID, entry.GID = uid, gid
+		}
+	}
+	if options.xattrs {
+		attrs, err := readXattrs(source)
+		if err != nil {
+			return entry, err
+		}
+		entry.Xattrs = attrs
+	}
+	return entry, nil
+}
+
+// sameEntry - Whether two listings of an entry describe the same thing, whenever it was modified
+func sameEntry(a domain.FileEntry, b domain.FileEntry) bool {
+	if a.Type != b.Type || a.Size != b.Size || a.Hash != b.Hash || a.Target != b.Target || a.Mode != b.Mode ||
+		a.UID != b.UID || a.GID != b.GID || len(a.Xattrs) != len(b.Xattrs) {
+		return false
+	}
+	for name, value := range a.Xattrs {
+		if string(b.Xattrs[name]) != string(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// unixMode - Permission bits as chmod takes them
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fileMode - Permission bits as os.Chmod takes them
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// entryType - The type of entry a local file is, empty for regular files and "other" for anything
+// a sync does not reproduce
+func entryType(info os.FileInfo) string {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return domain.EntrySymlink
+	case info.IsDir():
+		return domain.EntryDir
+	case info.Mode().IsRegular():
+		return domain.EntryFile
+	}
+	return "other"
+}
+
+// localFiles - Everything below root that is not ignored by slash separated relative path, leaving
+// out the part files of unfinished transfers. Links are not followed, a missing root holds nothing.
+func localFiles(root string, rules *ignoreRules) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return nil
+			}
+			return err
+		}
+		relative, err := relativeSlashPath(root, name)
+		if err != nil {
+			return err
+		}
+		if relative == "" {
+			return nil
+		}
+		if rules.excluded(relative, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), partSuffix) {
+			return nil
+		}
+		files[relative] = info
+		return nil
+	})
+	return files, err
+}
+
+// safeRelativePath - Where a path listed by the sender ends up below dir. Refuses anything that
+// would end up outside of it.
+func safeRelativePath(dir string, name string) (string, error) {
+	if name == "" || strings.Contains(name, "\\") || path.IsAbs(name) || filepath.IsAbs(name) {
+		return "", &AppError{fmt.Sprintf("Refusing the path %q", name)}
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &AppError{fmt.Sprintf("Refusing the path %q, it leaves the destination", name)}
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// safeLocalPath - Like safeRelativePath, also refusing paths that go through a symbolic link in dir,
+// which may point anywhere
+func safeLocalPath(dir string, name string) (string, error) {
+	localPath, err := safeRelativePath(dir, name)
+	if err != nil {
+		return "", err
+	}
+	elements := strings.Split(path.Clean(name), "/")
+	current := dir
+	for _, element := range elements[:len(elements)-1] {
+		current = filepath.Join(current, element)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", &AppError{fmt.Sprintf("Refusing the path %q, %s is a symbolic link", name, current)}
+		}
+	}
+	return localPath, nil
+}
+
+// linkStaysInside - Whether a link at the slash separated path relative to the root, pointing to
+// target, stays below the root when read as written
+func linkStaysInside(relative string, target string) bool {
+	if target == "" || strings.Contains(target, "\\") || path.IsAbs(target) || filepath.IsAbs(target) {
+		return false
+	}
+	resolved := path.Clean(path.Join(path.Dir(relative), filepath.ToSlash(target)))
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// within - Whether name is dir or below it
+func within(dir string, name string) bool {
+	relative, err := filepath.Rel(dir, name)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// attributesDiffer - Whether our entry's permissions, owner or extended attributes differ from the
+// sender's. Extended attributes we have and the sender does not are kept.
+func attributesDiffer(localPath string, info os.FileInfo, entry domain.FileEntry, owner bool) (bool, error) {
+	if entry.Type != domain.EntrySymlink && entry.Mode != 0 && unixMode(info.Mode()) != unixMode(expectedMode(entry, owner)) {
+		return true, nil
+	}
+	if owner {
+		if uid, gid, ok := fileOwner(info); ok && (uid != entry.UID || gid != entry.GID) {
+			return true, nil
+		}
+	}
+	if len(entry.Xattrs) > 0 {
+		attrs, err := readXattrs(localPath)
+		if err != nil {
+			return false, err
+		}
+		for name, value := range entry.Xattrs {
+			if string(attrs[name]) != string(value) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// expectedMode - The sender's permissions, without setuid and setgid unless it owns the file here too
+func expectedMode(entry domain.FileEntry, owner bool) os.FileMode {
+	mode := fileMode(entry.Mode)
+	if !owner {
+		mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	return mode
+}
+
+// applyAttributes - Gives an entry the sender's owner, permissions and extended attributes, and a
+// directory its modification time, which changes whenever something in it does
+func applyAttributes(localPath string, entry domain.FileEntry, owner bool) error {
+	if owner {
+		if err := os.Lchown(localPath, entry.UID, entry.GID); err != nil {
+			return err
+		}
+	}
+	if entry.Type == domain.EntrySymlink {
+		return nil
+	}
+	if entry.Mode != 0 {
+		if err := os.Chmod(localPath, expectedMode(entry, owner)); err != nil {
+			return err
+		}
+	}
+	if len(entry.Xattrs) > 0 {
+		if err := writeXattrs(localPath, entry.Xattrs); err != nil {
+			fmt.Printf("Could not copy the extended attributes of %s: %v\n", localPath, err)
+		}
+	}
+	if entry.Type == domain.EntryDir {
+		return os.Chtimes(localPath, time.Now(), time.Unix(0, entry.ModTime))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeRelativePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "a file", path: "notes.txt", want: "notes.txt"},
+		{name: "below a directory", path: "docs/notes.txt", want: filepath.Join("docs", "notes.txt")},
+		{name: "cleaned", path: "docs/./old/../notes.txt", want: filepath.Join("docs", "notes.txt")},
+		{name: "dot dot staying inside", path: "docs/../notes.txt", want: "notes.txt"},
+		{name: "empty", path: "", wantErr: true},
+		{name: "the destination itself", path: ".", wantErr: true},
+		{name: "the parent", path: "..", wantErr: true},
+		{name: "leaving the destination", path: "docs/../../etc/passwd", wantErr: true},
+		{name: "absolute", path: "/etc/passwd", wantErr: true},
+		{name: "backslashes", path: "..\\..\\evil", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := safeRelativePath("dest", test.path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("safeRelativePath(%q): got error %v, want error %t", test.path, err, test.wantErr)
+			}
+			if err == nil && got != filepath.Join("dest", test.want) {
+				t.Errorf("safeRelativePath(%q) = %q, want %q", test.path, got, filepath.Join("dest", test.want))
+			}
+		})
+	}
+}
+
+func TestLinkStaysInside(t *testing.T) {
+	tests := []struct {
+		link   string
+		target string
+		want   bool
+	}{
+		{link: "current", target: "releases/v2", want: true},
+		{link: "docs/latest", target: "v2.md", want: true},
+		{link: "docs/latest", target: "../README.md", want: true},
+		{link: "docs/v2/latest", target: "../../bin/tool", want: true},
+		{link: "escape", target: "..", want: false},
+		{link: "docs/escape", target: "../../secret", want: false},
+		{link: "docs/escape", target: "../x/../../secret", want: false},
+		{link: "absolute", target: "/etc/passwd", want: false},
+		{link: "empty", target: "", want: false},
+		{link: "backslashes", target: "..\\..\\secret", want: false},
+	}
+	for _, test := range tests {
+		if got := linkStaysInside(test.link, test.target); got != test.want {
+			t.Errorf("linkStaysInside(%q, %q) = %t, want %t", test.link, test.target, got, test.want)
+		}
+	}
+}
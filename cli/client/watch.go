@@ -0,0 +1,291 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mahadevans87/go-send/cli/domain"
+)
+
+// Watch mode. Once a sync is done the sender keeps the connections open and watches the directory.
+// Changed paths are collected until nothing changed for the debounce interval, then the files that
+// really differ, or are gone, are listed in an incremental TREE and sent like in the first round.
+
+// watchIgnored - Left out while watching on top of ignore files and -exclude
+var watchIgnored = []string{".git/"}
+
+// treeWatcher - Collects the paths below root that changed, leaving out ignored ones
+type treeWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+	// load - Reads the ignore rules again once an ignore file changed
+	load func() (*ignoreRules, error)
+	// changed - Signalled whenever a path is added to pending
+	changed chan struct{}
+
+	mux     sync.Mutex
+	rules   *ignoreRules
+	pending map[string]bool
+}
+
+// newTreeWatcher - Watches every directory below root that is not ignored until stop is closed
+func newTreeWatcher(root string, rules *ignoreRules, load func() (*ignoreRules, error), stop <-chan struct{}) (*treeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	treeWatcher := &treeWatcher{
+		root:    root,
+		watcher: watcher,
+		load:    load,
+		changed: make(chan struct{}, 1),
+		rules:   rules,
+		pending: make(map[string]bool),
+	}
+	if err := treeWatcher.addDirs(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go treeWatcher.run(stop)
+	return treeWatcher, nil
+}
+
+// addDirs - Watches dir and every directory below it that is not ignored
+func (treeWatcher *treeWatcher) addDirs(dir string) error {
+	rules := treeWatcher.ignoreRules()
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Gone again before we got to it
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		relative, err := relativeSlashPath(treeWatcher.root, name)
+		if err != nil {
+			return err
+		}
+		if relative != "" && rules.excluded(relative, true) {
+			return filepath.SkipDir
+		}
+		return treeWatcher.watcher.Add(name)
+	})
+}
+
+// run - Turns file system events into pending paths
+func (treeWatcher *treeWatcher) run(stop <-chan struct{}) {
+	defer treeWatcher.watcher.Close()
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-treeWatcher.watcher.Events:
+			if !ok {
+				return
+			}
+			relative, err := relativeSlashPath(treeWatcher.root, event.Name)
+			if err != nil || relative == "" {
+				continue
+			}
+			info, statErr := os.Lstat(event.Name)
+			isDir := statErr == nil && info.IsDir()
+			if isIgnoreFile(event.Name) {
+				if rules, err := treeWatcher.load(); err == nil {
+					treeWatcher.mux.Lock()
+					treeWatcher.rules = rules
+					treeWatcher.mux.Unlock()
+				} else {
+					fmt.Printf("\nCould not reload ignore rules: %v\n", err)
+				}
+			}
+			if treeWatcher.ignoreRules().excluded(relative, isDir) {
+				continue
+			}
+			if isDir && event.Op&fsnotify.Create != 0 {
+				if err := treeWatcher.addDirs(event.Name); err != nil {
+					fmt.Printf("\nCould not watch %s: %v\n", event.Name, err)
+				}
+			}
+			treeWatcher.mux.Lock()
+			treeWatcher.pending[relative] = true
+			treeWatcher.mux.Unlock()
+			select {
+			case treeWatcher.changed <- struct{}{}:
+			default:
+			}
+		case err, ok := <-treeWatcher.watcher.Errors:
+			if !ok {
+				return
+			}
+			// The kernel dropped events, rescanning everything is the only way to catch up
+			fmt.Printf("\nWatching failed: %v, rescanning\n", err)
+			treeWatcher.mux.Lock()
+			treeWatcher.pending[""] = true
+			treeWatcher.mux.Unlock()
+			select {
+			case treeWatcher.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// isIgnoreFile - Whether name is one of the ignoreFiles
+func isIgnoreFile(name string) bool {
+	for _, ignoreFile := range ignoreFiles {
+		if filepath.Base(name) == ignoreFile {
+			return true
+		}
+	}
+	return false
+}
+
+func (treeWatcher *treeWatcher) ignoreRules() *ignoreRules {
+	treeWatcher.mux.Lock()
+	defer treeWatcher.mux.Unlock()
+	return treeWatcher.rules
+}
+
+// pendingCount - Paths that changed since the last take
+func (treeWatcher *treeWatcher) pendingCount() int {
+	treeWatcher.mux.Lock()
+	defer treeWatcher.mux.Unlock()
+	return len(treeWatcher.pending)
+}
+
+// take - The paths that changed, sorted, forgetting them
+func (treeWatcher *treeWatcher) take() []string {
+	treeWatcher.mux.Lock()
+	defer treeWatcher.mux.Unlock()
+	paths := make([]string, 0, len(treeWatcher.pending))
+	for relative := range treeWatcher.pending {
+		paths = append(paths, relative)
+	}
+	treeWatcher.pending = make(map[string]bool)
+	sort.Strings(paths)
+	return paths
+}
+
+// collectChanges - What the paths that changed hold now compared with known, which is updated.
+// A path may be a file, a directory or something that is gone, the empty path is the whole root.
+func collectChanges(root string, paths []string, known map[string]domain.FileEntry, rules *ignoreRules, options treeOptions) ([]domain.FileEntry, error) {
+	changes := make([]domain.FileEntry, 0)
+	seen := make(map[string]bool)
+	for _, relative := range paths {
+		current, err := listFiles(root, filepath.Join(root, filepath.FromSlash(relative)), rules, options)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		present := make(map[string]bool)
+		for _, entry := range current {
+			present[entry.Path] = true
+			if seen[entry.Path] {
+				continue
+			}
+			seen[entry.Path] = true
+			if previous, ok := known[entry.Path]; ok && sameEntry(previous, entry) {
+				continue
+			}
+			known[entry.Path] = entry
+			changes = append(changes, entry)
+		}
+		for path := range known {
+			below := relative == "" || path == relative || strings.HasPrefix(path, relative+"/")
+			if below && !present[path] && !seen[path] {
+				seen[path] = true
+				delete(known, path)
+				changes = append(changes, domain.FileEntry{Path: path, Removed: true})
+			}
+		}
+	}
+	// Parents before what they hold, like a full listing
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// watch - Keeps the connections open and pushes what changed below the source directory once
+// nothing changed for Debounce. tree is what receivers have been sent so far. Ends when every
+// receiver is gone or the transfer is stopped.
+func (pionClient *PionClient) watch(sessions []*PeerSession, watcher *treeWatcher, tree []domain.FileEntry) {
+	root := pionClient.SenderSourcePath
+	known := make(map[string]domain.FileEntry)
+	for _, entry := range tree {
+		known[entry.Path] = entry
+	}
+	pionClient.Lifecycle.Advance(StateWatching)
+
+	sent := 0
+	status := func() {
+		fmt.Printf("\rWatching %s: %d pending, %d sent ", root, watcher.pendingCount(), sent)
+	}
+	fmt.Println()
+	status()
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pionClient.Lifecycle.Done():
+			return
+		case <-ticker.C:
+			if len(healthySessions(sessions)) > 0 {
+				continue
+			}
+			// Receivers that stop watching end the session, anything else is a failure
+			var failure error
+			for _, session := range sessions {
+				failure = worseFailure(failure, session.Err)
+			}
+			if KindOf(failure) == ErrPeerLeft {
+				fmt.Println("\nEvery receiver has left")
+				pionClient.Lifecycle.Complete()
+			} else {
+				pionClient.Lifecycle.Fail(failure)
+			}
+			return
+		case <-watcher.changed:
+			debounce.Reset(pionClient.Debounce)
+			status()
+		case <-debounce.C:
+			changes, err := collectChanges(root, watcher.take(), known, watcher.ignoreRules(), pionClient.treeOptions())
+			if err != nil {
+				pionClient.Lifecycle.Fail(newError(ErrFile, "", err))
+				return
+			}
+			if len(changes) == 0 {
+				status()
+				continue
+			}
+			fmt.Printf("\n%d changes\n", len(changes))
+			failure := pionClient.syncRound(sessions, changes, true)
+			select {
+			case <-pionClient.Lifecycle.Done():
+				return
+			default:
+			}
+			if len(healthySessions(sessions)) == 0 {
+				if failure == nil {
+					failure = &TransferError{Kind: ErrPeerLeft, Err: &AppError{"Every receiver is gone"}}
+				}
+				pionClient.Lifecycle.Fail(failure)
+				return
+			}
+			if failure != nil {
+				fmt.Printf("\n%v\n", failure)
+			}
+			sent += len(changes)
+			status()
+		}
+	}
+}
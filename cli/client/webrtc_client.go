@@ -1,19 +1,26 @@
 package client
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
 	"sync"
 	"time"
 
 	"github.com/mahadevans87/go-send/cli/domain"
 	"github.com/mahadevans87/go-send/cli/network"
+	"github.com/mahadevans87/go-send/protocol"
 
 	"github.com/pion/webrtc/v3"
 )
 
+const (
+	// messageWait - How long the signalling server may hold a request for messages until one arrives
+	messageWait = 30 * time.Second
+	// pollInterval - How often a server that does not hold requests is asked for messages
+	pollInterval = 2 * time.Second
+)
+
 // AppError holds generic errors that the app reports.
 type AppError struct {
 	Cause string
@@ -23,14 +30,137 @@ func (appError *AppError) Error() string {
 	return fmt.Sprintf(appError.Cause)
 }
 
+// PeerSession holds the WebRTC state for a single remote peer.
+// A sender keeps one session per receiver so that a failing receiver does not affect the others.
+type PeerSession struct {
+	Peer           *domain.PeerInfo
+	PeerConnection *webrtc.PeerConnection
+	DataChannels   []*webrtc.DataChannel
+	Offerer        bool
+	Accepted       chan bool
+	// Compression - Codec the receiver of this session accepted
+	Compression string
+	BytesSent   int64
+	// limiter - Upload limit shared with every other session, may be nil
+	limiter    *RateLimiter
+	ChunksDone int
+	Err        error
+	// resumed - Chunks the receiver already had when it accepted, they are not pushed again
+	resumed []byte
+	// skipped - Why the receiver needs nothing from us, empty if it does
+	skipped string
+	// signatures, blockSize and baseSize - The receiver's older copy, it gets a delta when blockSize
+	// is set. deltaSent once every op has been sent.
+	signatures []BlockSignature
+	blockSize  int
+	baseSize   int64
+	deltaSent  bool
+	// plan - Bitfield of the synced files the receiver lacks, taken from the PLAN on planned by
+	// the sync round
+	plan        []byte
+	planDeletes int
+	planDryRun  bool
+	planned     chan ControlMessage
+
+	channelsMux  sync.Mutex
+	channelsOpen int
+	statsMux     sync.Mutex
+	single       throughput
+	striped      throughput
+	sentStriped  map[int]bool
+	rawBytes     int64
+	encodedBytes int64
+
+	// established - Every data channel has been open at least once
+	established bool
+	// generation - Bumped every time PeerConnection is replaced, see domain.Message
+	generation int
+	// closed - We are done with the peer or it left, losing the connection is expected
+	closed bool
+
+	errMux sync.Mutex
+	failed chan struct{}
+	// recovering - The connection was lost and is being restarted, see reconnect.go
+	recovering        bool
+	candidatesMux     sync.Mutex
+	pendingCandidates []*webrtc.ICECandidate
+	// holding - Our description is being signalled, candidates wait in pendingCandidates
+	holding bool
+	// Candidates of the remote peer that arrived before its session description
+	remoteCandidates []string
+	settleOnce       sync.Once
+	// finished - The receiver was reported done with the current file, guarded by statsMux
+	finished bool
+}
+
+// settle reports the session as either open (err == nil) or failed exactly once.
+func (session *PeerSession) settle(settled chan<- *PeerSession, err error) {
+	session.settleOnce.Do(func() {
+		if err != nil {
+			session.fail(err)
+		}
+		settled <- session
+	})
+}
+
+// fail marks the session as unusable, keeping the first reason.
+func (session *PeerSession) fail(err error) {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	if session.Err == nil {
+		session.Err = err
+		close(session.failed)
+	}
+}
+
+// healthy reports whether the session has not failed so far.
+func (session *PeerSession) healthy() bool {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	return session.Err == nil
+}
+
+// markClosed - From now on a lost connection to the peer is neither recovered nor a failure
+func (session *PeerSession) markClosed() {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	session.closed = true
+}
+
+// isClosed - Whether markClosed was called
+func (session *PeerSession) isClosed() bool {
+	session.errMux.Lock()
+	defer session.errMux.Unlock()
+	return session.closed
+}
+
 // Connect -> Pass in domain.connectionInfo.
-func (pionClient *PionClient) Connect() {
-	var candidatesMux sync.Mutex
-	pendingCandidates := make([]*webrtc.ICECandidate, 0)
+// Opens one PeerConnection per remote peer and waits for their data channels in the background.
+// The sender offers to every receiver. Receivers that share chunks among themselves agree on
+// who offers by comparing peer ids. Errors after Connect returns are reported to the Lifecycle.
+func (pionClient *PionClient) Connect() error {
+	remotePeers := pionClient.ConnectionInfo.RemotePeers()
+	if pionClient.Lifecycle == nil {
+		pionClient.Lifecycle = NewLifecycle()
+	}
+	pionClient.Lifecycle.Advance(StateConnecting)
+	pionClient.Sessions = make(map[string]*PeerSession, len(remotePeers))
+	pionClient.finished = make(chan *PeerSession, len(remotePeers))
+	if pionClient.ConnectionInfo.Mode == "R" {
+		incoming := newIncomingTransfer(pionClient.ReceiverDir, pionClient.Compression, pionClient.OnConflict)
+		if pionClient.Sync {
+			pionClient.syncing = &syncReceiver{}
+			incoming.sync = pionClient.syncing
+		}
+		pionClient.setTransfer(incoming)
+	}
+	settled := make(chan *PeerSession, len(remotePeers))
+	pionClient.settled = settled
+
 	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 
 	// Prepare the configuration
-	config := webrtc.Configuration{
+	pionClient.config = webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{
 				URLs: []string{"stun:stun.l.google.com:19302"},
@@ -38,135 +168,427 @@ func (pionClient *PionClient) Connect() {
 		},
 	}
 
-	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		panic(err)
+	for _, peer := range remotePeers {
+		// Create a new RTCPeerConnection
+		peerConnection, err := webrtc.NewPeerConnection(pionClient.config)
+		if err != nil {
+			return newError(ErrNetwork, peer.ID, err)
+		}
+		session := &PeerSession{
+			Peer:              peer,
+			PeerConnection:    peerConnection,
+			Offerer:           pionClient.ConnectionInfo.Mode == "S" || (peer.Mode == "R" && pionClient.ConnectionInfo.ID < peer.ID),
+			Accepted:          make(chan bool, 1),
+			planned:           make(chan ControlMessage, 1),
+			failed:            make(chan struct{}),
+			sentStriped:       make(map[int]bool),
+			limiter:           pionClient.SendLimiter,
+			pendingCandidates: make([]*webrtc.ICECandidate, 0),
+		}
+		pionClient.Sessions[peer.ID] = session
+		pionClient.setupPeerConnection(session, peerConnection)
 	}
 
-	pionClient.PeerConnection = peerConnection
-
 	// start polling for client messages
 	stopPolling := make(chan bool, 1)
-	go pionClient.pollMessages(stopPolling, peerConnection, &candidatesMux, pendingCandidates, pionClient.ConnectionInfo)
+	signaler := network.NewSignaler(pionClient.SignalTransport, pionClient.ConnectionInfo, messageWait)
+	go func() {
+		defer signaler.Close()
+		if err := pionClient.pollMessages(stopPolling, signaler); err != nil {
+			pionClient.onSignallingFailed(err)
+		}
+	}()
+
+	// Stop polling for any new messages once every connection has been established or has failed,
+	// unless lost connections are to be recovered through the signalling server later on
+	go func() {
+		sessions := make([]*PeerSession, 0, len(remotePeers))
+		for range remotePeers {
+			session := <-settled
+			if !session.healthy() {
+				fmt.Printf("\nPeer %s could not be connected: %v\n", session.Peer.ID, session.Err)
+			}
+			sessions = append(sessions, session)
+		}
+		if pionClient.ReconnectAttempts <= 0 {
+			close(stopPolling)
+		}
+		if pionClient.ConnectionInfo.Mode == "S" {
+			pionClient.OnDataChannelsOpened(sessions)
+		}
+	}()
+
+	// Create an offer to send to the other process
+	for _, session := range pionClient.Sessions {
+		if !session.Offerer {
+			pionClient.setupDataChannelAsAnswerer(session)
+			continue
+		}
+		if err := pionClient.setupDataChannelAsOfferer(session); err != nil {
+			return newError(ErrNetwork, session.Peer.ID, err)
+		}
+		sdpMessage, err := pionClient.OnReadyToSendOffer(session)
+		if err != nil {
+			return newError(ErrNetwork, session.Peer.ID, err)
+		}
+		// Send our offer to the HTTP server listening in the other process
+		payload, err := json.Marshal(sdpMessage)
+		if err != nil {
+			return newError(ErrSignal, session.Peer.ID, err)
+		}
+
+		if err := sendSDPToPeer(pionClient.ConnectionInfo, payload); err != nil {
+			return newError(ErrSignal, session.Peer.ID, err)
+		}
+	}
+	return nil
+}
+
+// senderSession - The session with the sender, as seen by a receiver
+func (pionClient *PionClient) senderSession() *PeerSession {
+	for _, session := range pionClient.Sessions {
+		if session.Peer.Mode == "S" {
+			return session
+		}
+	}
+	return nil
+}
+
+// receiverSessions - Open sessions with other receivers, only present in swarm mode
+func (pionClient *PionClient) receiverSessions() []*PeerSession {
+	sessions := make([]*PeerSession, 0, len(pionClient.Sessions))
+	for _, session := range pionClient.Sessions {
+		if session.Peer.Mode == "R" && session.usable() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// open - Whether every data channel of the session is open
+func (session *PeerSession) open() bool {
+	session.channelsMux.Lock()
+	defer session.channelsMux.Unlock()
+	return len(session.DataChannels) > 0 && session.channelsOpen == len(session.DataChannels)
+}
+
+// connection - The current PeerConnection, which is replaced when reconnecting
+func (session *PeerSession) connection() *webrtc.PeerConnection {
+	session.channelsMux.Lock()
+	defer session.channelsMux.Unlock()
+	return session.PeerConnection
+}
+
+// channels - The current data channels, which are replaced when reconnecting
+func (session *PeerSession) channels() []*webrtc.DataChannel {
+	session.channelsMux.Lock()
+	defer session.channelsMux.Unlock()
+	return session.DataChannels
+}
+
+// current - Whether a data channel belongs to the current connection of the session
+func (session *PeerSession) current(dataChannel *webrtc.DataChannel) bool {
+	for _, channel := range session.channels() {
+		if channel == dataChannel {
+			return true
+		}
+	}
+	return false
+}
+
+func (pionClient *PionClient) setupPeerConnection(session *PeerSession, peerConnection *webrtc.PeerConnection) {
 
 	// When an ICE candidate is available send to the other Pion instance
 	// the other Pion instance will add this candidate by calling AddICECandidate
 	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
+		if c == nil || peerConnection != session.connection() {
 			return
 		}
 
-		candidatesMux.Lock()
-		defer candidatesMux.Unlock()
+		session.candidatesMux.Lock()
+		defer session.candidatesMux.Unlock()
 
 		desc := peerConnection.RemoteDescription()
-		if desc == nil {
-			pendingCandidates = append(pendingCandidates, c)
-		} else if onICECandidateErr := signalCandidate(c, pionClient.ConnectionInfo); err != nil {
-			panic(onICECandidateErr)
+		if desc == nil || session.holding {
+			session.pendingCandidates = append(session.pendingCandidates, c)
+		} else if onICECandidateErr := signalCandidate(c, session, pionClient.ConnectionInfo); onICECandidateErr != nil {
+			pionClient.Lifecycle.Fail(newError(ErrSignal, session.Peer.ID, onICECandidateErr))
 		}
 	})
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		if peerConnection != session.connection() {
+			// A connection we replaced while reconnecting
+			return
+		}
+		fmt.Printf("ICE Connection State with peer %s has changed: %s\n", session.Peer.ID, connectionState.String())
+		switch {
+		case connectionState == webrtc.ICEConnectionStateFailed && !session.isEstablished():
+			pionClient.onSessionFailed(session, &AppError{"ICE connection failed"})
+			session.settle(pionClient.settled, session.Err)
+		case connectionState == webrtc.ICEConnectionStateFailed:
+			pionClient.onConnectionLost(session)
+		case connectionState == webrtc.ICEConnectionStateDisconnected && session.isEstablished():
+			go func() {
+				time.Sleep(disconnectGrace)
+				if peerConnection == session.connection() && peerConnection.ICEConnectionState() == webrtc.ICEConnectionStateDisconnected {
+					pionClient.onConnectionLost(session)
+				}
+			}()
+		}
 	})
+}
 
-	// Create an offer to send to the other process
-	if pionClient.ConnectionInfo.Mode == "S" {
-		pionClient.setupDataChannelForSender(stopPolling)
-		sdpMessage := pionClient.OnReadyToSendOffer(peerConnection)
-		// Send our offer to the HTTP server listening in the other process
-		payload, err := json.Marshal(sdpMessage)
+func (pionClient *PionClient) setupDataChannelAsOfferer(session *PeerSession) error {
+	count := pionClient.Channels
+	if count < 1 {
+		count = 1
+	}
+	session.channelsMux.Lock()
+	session.DataChannels = make([]*webrtc.DataChannel, count)
+	session.channelsMux.Unlock()
+
+	// Create the data channels, labelled so the other side knows how many to expect
+	for index := 0; index < count; index++ {
+		dataChannel, err := session.connection().CreateDataChannel(dataChannelLabel(index, count), nil)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		pionClient.registerDataChannel(session, index, dataChannel)
+	}
+	return nil
+}
 
-		if err := sendSDPToPeer(payload); err != nil {
-			panic(err)
+func (pionClient *PionClient) setupDataChannelAsAnswerer(session *PeerSession) {
+	// Register data channel creation handling
+	peerConnection := session.connection()
+	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		if peerConnection != session.connection() {
+			return
+		}
+		fmt.Printf("\nNew DataChannel to receive ...%s %d\n", d.Label(), d.ID())
+		index, count, err := parseDataChannelLabel(d.Label())
+		if err != nil {
+			fmt.Printf("Ignoring data channel from peer %s: %v\n", session.Peer.ID, err)
+			return
 		}
 
-	} else if pionClient.ConnectionInfo.Mode == "R" {
-		pionClient.setupDataChannelForReceiver(stopPolling)
-	}
-
+		session.channelsMux.Lock()
+		if session.DataChannels == nil {
+			session.DataChannels = make([]*webrtc.DataChannel, count)
+		}
+		expected := len(session.DataChannels)
+		session.channelsMux.Unlock()
+		if count != expected {
+			fmt.Printf("Ignoring data channel %q from peer %s, expected %d channels\n", d.Label(), session.Peer.ID, expected)
+			return
+		}
+		pionClient.registerDataChannel(session, index, d)
+	})
 }
 
-func (pionClient *PionClient) setupDataChannelForSender(stopPolling chan bool) {
-	// Create a datachannel with label 'data'
-	dataChannel, err := pionClient.PeerConnection.CreateDataChannel("data", nil)
-	if err != nil {
-		panic(err)
-	}
-	// Register channel opening handling Only for sender
+func (pionClient *PionClient) registerDataChannel(session *PeerSession, index int, dataChannel *webrtc.DataChannel) {
+	session.channelsMux.Lock()
+	session.DataChannels[index] = dataChannel
+	session.channelsMux.Unlock()
+
+	// Register channel opening handling. The session is usable once all of its channels are open.
 	dataChannel.OnOpen(func() {
-		// Stop polling for any new messages. Connection has been established
-		stopPolling <- true
-		close(stopPolling)
-		pionClient.OnDataChannelOpened(dataChannel)
+		if !session.current(dataChannel) {
+			return
+		}
+		fmt.Printf("\nData channel '%s'-'%d' with peer %s open. \n", dataChannel.Label(), dataChannel.ID(), session.Peer.ID)
+		session.channelsMux.Lock()
+		session.channelsOpen++
+		opened := session.channelsOpen == len(session.DataChannels) && !session.established
+		if opened {
+			session.established = true
+		}
+		session.channelsMux.Unlock()
+		// Channels reopened after a reconnect are taken care of by recover
+		if !opened {
+			return
+		}
+		session.settle(pionClient.settled, nil)
+		if incoming := pionClient.transfer(); incoming != nil {
+			incoming.onChannelOpen(session)
+		}
+	})
+
+	dataChannel.OnClose(func() {
+		switch {
+		case !session.current(dataChannel) || session.isRecovering():
+			// Closed along with a connection we are replacing
+		case session.isEstablished():
+			pionClient.onConnectionLost(session)
+		default:
+			pionClient.onSessionFailed(session, &AppError{"Data channel closed"})
+		}
 	})
 
-	// Register text message handling
+	// Register message handling
 	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		fmt.Printf("Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
+		if !session.current(dataChannel) {
+			return
+		}
+		pionClient.Lifecycle.Touch()
+		if !msg.IsString {
+			pionClient.ReceiveLimiter.Wait(len(msg.Data))
+		}
+		pionClient.OnDataChannelMessage(session, msg)
 	})
 }
 
-func (pionClient *PionClient) setupDataChannelForReceiver(stopPolling chan bool) {
-	// Register data channel creation handling
-	pionClient.PeerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		fmt.Printf("\nNew DataChannel to receive ...%s %d\n", d.Label(), d.ID())
+// isEstablished - Whether the session was open at some point
+func (session *PeerSession) isEstablished() bool {
+	session.channelsMux.Lock()
+	defer session.channelsMux.Unlock()
+	return session.established
+}
 
-		// Register channel opening handling
-		d.OnOpen(func() {
-			stopPolling <- true
-			close(stopPolling)
-			fmt.Printf("\nData channel '%s'-'%d' open. \n", d.Label(), d.ID())
-		})
+// onSessionFailed - Isolates a failed peer so the rest of the transfer can carry on
+func (pionClient *PionClient) onSessionFailed(session *PeerSession, err error) {
+	if !session.healthy() || session.isClosed() {
+		return
+	}
+	session.fail(err)
+	if incoming := pionClient.transfer(); incoming != nil {
+		incoming.onSessionFailed(pionClient, session)
+	} else {
+		session.finish(pionClient.finished)
+	}
+}
+
+// onPeerLeft - The peer said goodbye, there is no point in reconnecting to it.
+// A peer that left because the file failed verification, could not be written or was refused passes that on.
+func (pionClient *PionClient) onPeerLeft(session *PeerSession, message ControlMessage) {
+	if session.isClosed() {
+		return
+	}
+	kind := ErrPeerLeft
+	if message.Kind == ErrIntegrity || message.Kind == ErrFile || message.Kind == ErrPeerRejected {
+		kind = message.Kind
+	}
+	pionClient.onSessionFailed(session, &TransferError{Kind: kind, Peer: session.Peer.ID, Err: errors.New(message.Reason)})
+	session.markClosed()
+}
+
+// onSignallingFailed - Without the signalling server connections can neither be set up nor recovered
+func (pionClient *PionClient) onSignallingFailed(err error) {
+	if state, _ := pionClient.Lifecycle.State(); state < StateTransferring {
+		pionClient.Lifecycle.Fail(newError(ErrSignal, "", err))
+		return
+	}
+	fmt.Printf("Lost the signalling server, dropped connections cannot be recovered: %v\n", err)
+}
 
-		// Register text message handling
-		d.OnMessage(pionClient.OnDataChannelMessage)
+// Close - Tells every peer we are leaving and why, then closes the connections.
+// err is the error that ended the transfer, nil if it succeeded.
+func (pionClient *PionClient) Close(err error) {
+	bye := ControlMessage{Type: MsgBye, Reason: "done"}
+	if err != nil {
+		bye.Reason = err.Error()
+		bye.Kind = KindOf(err)
+	}
+	for _, session := range pionClient.Sessions {
+		session.markClosed()
+	}
+	for _, session := range pionClient.Sessions {
+		if session.open() {
+			if err := session.sendControl(bye); err == nil {
+				continue
+			}
+		}
+		// Not connected yet, the peer may still be polling for our offer or answer
+		if err := pionClient.signalBye(session, bye); err != nil {
+			fmt.Printf("Could not tell peer %s we are leaving: %v\n", session.Peer.ID, err)
+		}
+	}
+
+	// Give the goodbyes a moment to leave before the connections go away
+	deadline := time.Now().Add(2 * time.Second)
+	for _, session := range pionClient.Sessions {
+		if channels := session.channels(); len(channels) > 0 && channels[0] != nil {
+			for channels[0].BufferedAmount() > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	for _, session := range pionClient.Sessions {
+		if err := session.connection().Close(); err != nil {
+			fmt.Printf("Could not close the connection to peer %s: %v\n", session.Peer.ID, err)
+		}
+	}
+}
+
+// signalBye - Sends a goodbye through the signalling server
+func (pionClient *PionClient) signalBye(session *PeerSession, bye ControlMessage) error {
+	byeBytes, err := json.Marshal(bye)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(domain.Message{
+		Data:  byeBytes,
+		From:  pionClient.ConnectionInfo.ID,
+		To:    session.Peer.ID,
+		Token: pionClient.ConnectionInfo.Token,
+		Type:  protocol.TypeBye,
 	})
+	if err != nil {
+		return err
+	}
+	return sendSDPToPeer(pionClient.ConnectionInfo, payload)
 }
 
-// A handler that processes a SessionDescription given to us from the other Pion process
-func handleSDP(peerConnection *webrtc.PeerConnection,
-	candidatesMux *sync.Mutex,
-	pendingCandidates []*webrtc.ICECandidate,
-	incomingMessage domain.Message,
-	pionClient *PionClient) error {
+// A handler that processes a SessionDescription given to us from the other Pion process.
+// Errors of kind ErrSignal concern every peer, others only this one.
+func handleSDP(session *PeerSession, incomingMessage domain.Message, pionClient *PionClient) error {
 
 	sdp := webrtc.SessionDescription{}
 	if err := json.Unmarshal([]byte(incomingMessage.Data), &sdp); err != nil {
-		return err
+		return newError(ErrNetwork, session.Peer.ID, err)
+	}
+	if sdp.Type == webrtc.SDPTypeOffer {
+		// Our candidates must follow the answer
+		session.holdCandidates()
 	}
-	if sdpErr := peerConnection.SetRemoteDescription(sdp); sdpErr != nil {
-		panic(sdpErr)
+	if sdpErr := session.connection().SetRemoteDescription(sdp); sdpErr != nil {
+		return newError(ErrNetwork, session.Peer.ID, sdpErr)
 	}
 
 	// Send our answer to the HTTP server listening in the other process
-	if pionClient.ConnectionInfo.Mode == "R" {
-		sdpMessage := pionClient.OnReadyToSendAnswer(peerConnection)
+	if sdp.Type == webrtc.SDPTypeOffer {
+		sdpMessage, err := pionClient.OnReadyToSendAnswer(session)
+		if err != nil {
+			return newError(ErrNetwork, session.Peer.ID, err)
+		}
+		// An offer for a new connection is answered in kind
+		sdpMessage.Type = incomingMessage.Type
 		payload, err := json.Marshal(sdpMessage)
 		if err != nil {
-			panic(err)
+			return newError(ErrNetwork, session.Peer.ID, err)
 		}
 
-		if err := sendSDPToPeer(payload); err != nil {
-			panic(err)
+		if err := sendSDPToPeer(pionClient.ConnectionInfo, payload); err != nil {
+			return newError(ErrSignal, session.Peer.ID, err)
 		}
 	}
 
-	candidatesMux.Lock()
-	defer candidatesMux.Unlock()
+	if err := pionClient.releaseCandidates(session); err != nil {
+		return newError(ErrSignal, session.Peer.ID, err)
+	}
 
-	for _, c := range pendingCandidates {
-		if onICECandidateErr := signalCandidate(c, pionClient.ConnectionInfo); onICECandidateErr != nil {
-			panic(onICECandidateErr)
+	session.candidatesMux.Lock()
+	defer session.candidatesMux.Unlock()
+
+	for _, candidate := range session.remoteCandidates {
+		if candidateErr := session.connection().AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); candidateErr != nil {
+			return candidateErr
 		}
 	}
+	session.remoteCandidates = nil
 
 	return nil
 }
@@ -175,73 +597,100 @@ func handleSDP(peerConnection *webrtc.PeerConnection,
 // This allows us to add ICE candidates faster, we don't have to wait for STUN or TURN
 // candidates which may be slower
 
-func handleICECandidate(peerConnection *webrtc.PeerConnection, candidatesMux *sync.Mutex, pendingCandidates []*webrtc.ICECandidate, incomingMessage domain.Message) error {
+func handleICECandidate(session *PeerSession, incomingMessage domain.Message) error {
 	var candidate string
 	if err := json.Unmarshal([]byte(incomingMessage.Data), &candidate); err != nil {
 		return &AppError{"There was an error parsing ICE Candidate of peer"}
+	} else if session.connection().RemoteDescription() == nil {
+		// The peer's candidates can overtake its answer, hold on to them until handleSDP
+		session.candidatesMux.Lock()
+		defer session.candidatesMux.Unlock()
+		session.remoteCandidates = append(session.remoteCandidates, candidate)
 	} else {
-		if candidateErr := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); candidateErr != nil {
+		if candidateErr := session.connection().AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); candidateErr != nil {
 			return candidateErr
 		}
 	}
 	return nil
 }
 
-func (pionClient *PionClient) parseMessages(peerConnection *webrtc.PeerConnection, candidatesMux *sync.Mutex, pendingCandidates []*webrtc.ICECandidate, connectionInfo *domain.ConnectionInfo) error {
-	pendingMessages, err := network.FetchPendingMessages(connectionInfo)
+// parseMessages - Waits for messages from the other peers and handles them, returns how many came
+func (pionClient *PionClient) parseMessages(signaler network.Signaler) (int, error) {
+	pendingMessages, err := signaler.Receive()
 	if err != nil {
-		return err
+		return 0, newError(ErrSignal, "", err)
 	}
-	for _, pendingMessage := range pendingMessages.Data {
-		switch pendingMessage.Type {
-		case "SDP":
-			if err := handleSDP(peerConnection, candidatesMux, pendingCandidates, pendingMessage, pionClient); err != nil {
-				return err
+	for _, pendingMessage := range pendingMessages {
+		session := pionClient.Sessions[pendingMessage.From]
+		if session == nil {
+			// A message from a peer we are not connecting to, e.g. another receiver.
+			continue
+		}
+		if pendingMessage.Type == protocol.TypeBye {
+			var bye ControlMessage
+			if err := json.Unmarshal(pendingMessage.Data, &bye); err != nil {
+				bye.Reason = "no reason given"
 			}
-		case "ICE":
-			if err := handleICECandidate(peerConnection, candidatesMux, pendingCandidates, pendingMessage); err != nil {
-				return err
+			pionClient.onPeerLeft(session, bye)
+			continue
+		}
+		var handleErr error
+		if pendingMessage.Type == protocol.TypeReset && pendingMessage.Generation > session.currentGeneration() {
+			handleErr = handleReset(session, pendingMessage, pionClient)
+		} else if pendingMessage.Generation != session.currentGeneration() {
+			// Meant for a connection that has since been replaced
+			continue
+		} else {
+			switch pendingMessage.Type {
+			case protocol.TypeSDP, protocol.TypeReset:
+				// RESET with the current generation is the answer to our offer for a new connection
+				handleErr = handleSDP(session, pendingMessage, pionClient)
+			case protocol.TypeICE:
+				handleErr = handleICECandidate(session, pendingMessage)
+			default:
+				fmt.Printf("Ignoring a message of unknown type %q from peer %s\n", pendingMessage.Type, session.Peer.ID)
 			}
-		case "OFFER":
-		case "ANSWER":
-		default:
-			return &AppError{"There was an error parsing an incoming message of unkown type"}
 		}
+		if handleErr == nil {
+			continue
+		}
+		if KindOf(handleErr) == ErrSignal {
+			// Every other peer depends on the server as well
+			return 0, handleErr
+		}
+		pionClient.onSessionFailed(session, newError(ErrNetwork, session.Peer.ID, handleErr))
 	}
-	return nil
+	return len(pendingMessages), nil
 }
 
-func (pionClient *PionClient) pollMessages(stopPolling chan bool, peerConnection *webrtc.PeerConnection,
-	candidatesMux *sync.Mutex,
-	pendingCandidates []*webrtc.ICECandidate,
-	connectionInfo *domain.ConnectionInfo) error {
+// pollMessages - Receives messages until stopped. Signalers return as soon as there is one, those that
+// return right away with nothing, e.g. polling or a server that does not wait, are asked again every pollInterval.
+func (pionClient *PionClient) pollMessages(stopPolling chan bool, signaler network.Signaler) error {
 	for {
+		started := time.Now()
+		received, parseErr := pionClient.parseMessages(signaler)
+		if parseErr != nil {
+			return parseErr
+		}
+		var pause time.Duration
+		if received == 0 && time.Since(started) < pollInterval {
+			pause = pollInterval
+		}
 		select {
 		case <-stopPolling:
 			return nil
-		default:
-			if parseErr := pionClient.parseMessages(peerConnection, candidatesMux, pendingCandidates, connectionInfo); parseErr != nil {
-				return parseErr
-			} else {
-				time.Sleep(2 * time.Second)
-				return pionClient.pollMessages(stopPolling, peerConnection, candidatesMux, pendingCandidates, connectionInfo)
-			}
-
+		case <-pionClient.Lifecycle.Done():
+			return nil
+		case <-time.After(pause):
 		}
 	}
 }
 
-func sendSDPToPeer(payload []byte) error {
-	resp, err := http.Post(fmt.Sprintf("%s/message", domain.SignalBaseURL), "application/json; charset=utf-8", bytes.NewReader(payload))
-	if err != nil {
-		return err
-	} else if err := resp.Body.Close(); err != nil {
-		return err
-	}
-	return nil
+func sendSDPToPeer(connectionInfo *domain.ConnectionInfo, payload []byte) error {
+	return network.PostMessage(connectionInfo, payload)
 }
 
-func signalCandidate(c *webrtc.ICECandidate, connectionInfo *domain.ConnectionInfo) error {
+func signalCandidate(c *webrtc.ICECandidate, session *PeerSession, connectionInfo *domain.ConnectionInfo) error {
 	//TODO: Send a proper message
 	// Wrap it onto our Message object
 	var candidateBytes []byte
@@ -250,27 +699,23 @@ func signalCandidate(c *webrtc.ICECandidate, connectionInfo *domain.ConnectionIn
 		return err
 	}
 	iceMessage := domain.Message{
-		Data:  candidateBytes,
-		From:  (string)(connectionInfo.ID),
-		To:    connectionInfo.Peers[0].ID,
-		Token: connectionInfo.Token,
-		Type:  "ICE",
+		Data:       candidateBytes,
+		From:       (string)(connectionInfo.ID),
+		To:         session.Peer.ID,
+		Token:      connectionInfo.Token,
+		Type:       protocol.TypeICE,
+		Generation: session.currentGeneration(),
 	}
 	payload, err := json.Marshal(iceMessage)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/message", domain.SignalBaseURL),
-		"application/json; charset=utf-8", bytes.NewReader(payload))
-
-	if err != nil {
-		return err
-	}
-
-	if closeErr := resp.Body.Close(); closeErr != nil {
-		return closeErr
+	// The server refusing a candidate, e.g. for a peer that just left, is not worth failing over
+	if err := network.PostMessage(connectionInfo, payload); err != nil {
+		if _, refused := err.(*network.AppError); !refused {
+			return err
+		}
 	}
-
 	return nil
 }
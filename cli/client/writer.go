@@ -0,0 +1,140 @@
+package client
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// When a receiver flushes the file to disk
+const (
+	// FsyncFile - Once the whole file has arrived, before it is verified and moved into place
+	FsyncFile = "file"
+	// FsyncPeriodic - Every interval while chunks are written and once the file is complete,
+	// so that a crash loses little of what a resumed transfer can keep
+	FsyncPeriodic = "periodic"
+	// FsyncNone - Never, the operating system writes the file back whenever it likes
+	FsyncNone = "none"
+)
+
+// writeQueueLength - Chunks waiting for the disk before receiving blocks, which makes SCTP slow the peer down
+const writeQueueLength = 16
+
+// ValidFsyncPolicy - Whether policy is one of the Fsync constants
+func ValidFsyncPolicy(policy string) bool {
+	return policy == FsyncFile || policy == FsyncPeriodic || policy == FsyncNone
+}
+
+// chunkWrite - A verified chunk on its way to the file
+type chunkWrite struct {
+	index  int
+	offset int64
+	data   []byte
+}
+
+// fileWriter - Writes chunks to the file in the background so that a slow disk does not stall the
+// data channels. onWritten is called from the writer goroutine once a chunk is in the file, or with
+// the error that kept it out. After the first error every later chunk is dropped.
+type fileWriter struct {
+	file      *os.File
+	policy    string
+	interval  time.Duration
+	writes    chan chunkWrite
+	stop      <-chan struct{}
+	quit      chan struct{}
+	onWritten func(index int, err error)
+
+	errMux sync.Mutex
+	err    error
+}
+
+// newFileWriter - Starts writing to file until stop is closed
+func newFileWriter(file *os.File, policy string, interval time.Duration, stop <-chan struct{}, onWritten func(index int, err error)) *fileWriter {
+	writer := &fileWriter{
+		file:      file,
+		policy:    policy,
+		interval:  interval,
+		writes:    make(chan chunkWrite, writeQueueLength),
+		stop:      stop,
+		quit:      make(chan struct{}),
+		onWritten: onWritten,
+	}
+	go writer.run()
+	return writer
+}
+
+// enqueue - Hands a chunk to the writer goroutine, blocking while the queue is full
+func (writer *fileWriter) enqueue(write chunkWrite) {
+	select {
+	case writer.writes <- write:
+	case <-writer.stop:
+	case <-writer.quit:
+	}
+}
+
+// run - The writer goroutine
+func (writer *fileWriter) run() {
+	var tick <-chan time.Time
+	if writer.policy == FsyncPeriodic && writer.interval > 0 {
+		ticker := time.NewTicker(writer.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	dirty := false
+	for {
+		select {
+		case <-writer.stop:
+			return
+		case <-writer.quit:
+			return
+		case write := <-writer.writes:
+			if writer.failed() != nil {
+				continue
+			}
+			if _, err := writer.file.WriteAt(write.data, write.offset); err != nil {
+				writer.fail(err)
+				writer.onWritten(write.index, err)
+				continue
+			}
+			dirty = true
+			writer.onWritten(write.index, nil)
+		case <-tick:
+			if !dirty || writer.failed() != nil {
+				continue
+			}
+			dirty = false
+			if err := writer.file.Sync(); err != nil {
+				writer.fail(err)
+				writer.onWritten(-1, err)
+			}
+		}
+	}
+}
+
+// flush - Syncs the file unless the policy leaves that to the operating system
+func (writer *fileWriter) flush() error {
+	if err := writer.failed(); err != nil {
+		return err
+	}
+	if writer.policy == FsyncNone {
+		return nil
+	}
+	return writer.file.Sync()
+}
+
+// close - Stops the writer goroutine once the file no longer receives chunks
+func (writer *fileWriter) close() {
+	close(writer.quit)
+}
+
+func (writer *fileWriter) fail(err error) {
+	writer.errMux.Lock()
+	defer writer.errMux.Unlock()
+	writer.err = err
+}
+
+func (writer *fileWriter) failed() error {
+	writer.errMux.Lock()
+	defer writer.errMux.Unlock()
+	return writer.err
+}
@@ -1,38 +1,145 @@
 package domain
 
 import (
-	"encoding/json"
+	"time"
+
+	"github.com/mahadevans87/go-send/protocol"
 )
 
-// SignalBaseURL - Signalling Server Base URL
-const SignalBaseURL = "http://localhost:8080"
+// SignalBaseURL - Signalling Server Base URL, set from -signal-url
+var SignalBaseURL = "http://localhost:8080"
 
-// PeerInfo Data Model
-type PeerInfo struct {
-	Token string `json:"token"`
-	ID    string `json:"id"`
-}
+// PeerInfo Data Model, as the signalling server lists peers
+type PeerInfo = protocol.PeerInfo
 
 // ConnectionInfo can be shared between packages
 type ConnectionInfo struct {
 	Message string `json:"message"`
 	ID      string `json:"peerID"`
+	Size    int    `json:"size"`
 	Peers   []*PeerInfo
 	Token   string
 	Mode    string
+	Swarm   bool
+	// Session - Secret the server hands out on registration, sent with every later call
+	Session string `json:"session"`
+	// Version - The protocol version the server agreed to speak, 0 if it predates versions
+	Version int `json:"version"`
+	// Credential - API key or JWT the signalling server authenticates us with, if it asks for one
+	Credential string `json:"-"`
+}
+
+// PeersWithMode - Returns the known peers that registered with the given mode ("S" or "R")
+func (connectionInfo *ConnectionInfo) PeersWithMode(mode string) []*PeerInfo {
+	peers := make([]*PeerInfo, 0, len(connectionInfo.Peers))
+	for _, peer := range connectionInfo.Peers {
+		if peer.Mode == mode {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// RemotePeers - Returns the peers this client should open a connection to.
+// A sender connects to every receiver, a receiver only to the sender unless
+// receivers share chunks among themselves (Swarm), in which case it connects to everyone.
+func (connectionInfo *ConnectionInfo) RemotePeers() []*PeerInfo {
+	if connectionInfo.Mode == "S" {
+		return connectionInfo.PeersWithMode("R")
+	}
+	if connectionInfo.Swarm {
+		return connectionInfo.Peers
+	}
+	return connectionInfo.PeersWithMode("S")
+}
+
+// Manifest describes a file split into numbered, fixed size chunks.
+// The per chunk hashes are sent separately since they may not fit in a single data channel message.
+type Manifest struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	Chunks    int    `json:"chunks"`
+	Hash      string `json:"hash"`
+	Swarm     bool   `json:"swarm"`
+	// Compression - Codecs the sender offers, in order of preference. Empty means uncompressed.
+	Compression []string `json:"compression,omitempty"`
+	// Delta - The sender sends receivers with an older copy only what changed
+	Delta bool `json:"delta,omitempty"`
+	// OnConflict - The sender's conflict policy, used by receivers that did not pick their own
+	OnConflict string `json:"onConflict,omitempty"`
+	// ModTime - Modification time of the sender's file in nanoseconds since the epoch
+	ModTime int64 `json:"modTime,omitempty"`
+}
+
+// Types of FileEntry
+const (
+	// EntryFile - A regular file, its content is transferred
+	EntryFile = ""
+	// EntryDir - A directory, listed so that empty ones are created too
+	EntryDir = "dir"
+	// EntrySymlink - A symbolic link to Target
+	EntrySymlink = "symlink"
+)
+
+// FileEntry describes a file, directory or symbolic link of a directory being synced. Path is
+// relative to the synced directory and always uses forward slashes. Mode holds the Unix permission
+// bits, UID and GID the owner when the sender preserves ownership and Xattrs the extended attributes
+// when it preserves those. Removed marks an entry that is gone in an incremental list.
+type FileEntry struct {
+	Path    string            `json:"path"`
+	Type    string            `json:"type,omitempty"`
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"modTime"`
+	Hash    string            `json:"hash,omitempty"`
+	Mode    uint32            `json:"mode,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	UID     int               `json:"uid,omitempty"`
+	GID     int               `json:"gid,omitempty"`
+	Xattrs  map[string][]byte `json:"xattrs,omitempty"`
+	Removed bool              `json:"removed,omitempty"`
 }
 
-// Message Data Model
-type Message struct {
-	Type  string
-	Token string          `json:"token"`
-	From  string          `json:"from"`
-	To    string          `json:"to"`
-	Data  json.RawMessage `json:"data"`
+// ChunkOffset - Offset of the chunk within the file
+func (manifest *Manifest) ChunkOffset(index int) int64 {
+	return int64(index) * manifest.ChunkSize
 }
 
+// ChunkLength - Length of the chunk, the last chunk may be shorter than ChunkSize
+func (manifest *Manifest) ChunkLength(index int) int64 {
+	if remaining := manifest.Size - manifest.ChunkOffset(index); remaining < manifest.ChunkSize {
+		return remaining
+	}
+	return manifest.ChunkSize
+}
+
+// Message - What peers relay to each other through the signalling server
+type Message = protocol.Message
+
 // Messages -> Pending SDP / Candidate Messages from other clients
-type Messages struct {
-	Message string    `json:"message"`
-	Data    []Message `json:"data"`
+type Messages = protocol.Messages
+
+// ServerStatus - What the signalling server's admin API reports about it
+type ServerStatus struct {
+	Draining       bool `json:"draining"`
+	Rooms          int  `json:"rooms"`
+	Peers          int  `json:"peers"`
+	QueuedMessages int  `json:"queuedMessages"`
+}
+
+// PeerStatus - A peer as the admin API shows it. LastSeen is when it last called the server.
+type PeerStatus struct {
+	ID       string    `json:"id"`
+	Mode     string    `json:"mode"`
+	LastSeen time.Time `json:"lastSeen"`
+	Queued   int       `json:"queued"`
+}
+
+// RoomStatus - A room as the admin API shows it
+type RoomStatus struct {
+	Token   string       `json:"token"`
+	Size    int          `json:"size"`
+	Owner   string       `json:"owner"`
+	Created time.Time    `json:"created"`
+	Peers   []PeerStatus `json:"peers"`
 }
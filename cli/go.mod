@@ -2,4 +2,12 @@ module github.com/mahadevans87/go-send/cli
 
 go 1.15
 
-require github.com/pion/webrtc/v3 v3.0.3
+require (
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/klauspost/compress v1.11.13
+	github.com/mahadevans87/go-send/protocol v0.0.0
+	github.com/pion/webrtc/v3 v3.0.3
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
+)
+
+replace github.com/mahadevans87/go-send/protocol => ../protocol
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mahadevans87/go-send/cli/client"
+)
+
+// minAdjustedRate - Halving never turns a limit into "unlimited"
+const minAdjustedRate = 1024
+
+// watchLimitSignals - SIGUSR1 doubles and SIGUSR2 halves the bandwidth limits while a transfer runs.
+// Unlimited directions stay unlimited.
+func watchLimitSignals(sendLimiter *client.RateLimiter, receiveLimiter *client.RateLimiter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			for _, limiter := range []*client.RateLimiter{sendLimiter, receiveLimiter} {
+				rate := limiter.Rate()
+				if rate == 0 {
+					continue
+				}
+				if sig == syscall.SIGUSR1 {
+					rate *= 2
+				} else if rate /= 2; rate < minAdjustedRate {
+					rate = minAdjustedRate
+				}
+				limiter.SetRate(rate)
+			}
+			log.Printf("Send limit is now %s, receive limit %s\n", client.FormatRate(sendLimiter.Rate()), client.FormatRate(receiveLimiter.Rate()))
+		}
+	}()
+}
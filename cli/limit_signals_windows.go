@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/mahadevans87/go-send/cli/client"
+)
+
+// watchLimitSignals - Windows has no SIGUSR1/SIGUSR2, limits stay as given on the command line
+func watchLimitSignals(sendLimiter *client.RateLimiter, receiveLimiter *client.RateLimiter) {
+}
@@ -11,6 +11,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -35,65 +38,220 @@ func getJSON(url string, target interface{}) error {
 	return json.NewDecoder(r.Body).Decode(target)
 }
 
-func fetchPeerList(peersFound chan bool, connectionInfoPtr *domain.ConnectionInfo) {
-	// Fetch PeerInfo
-	if peerInfoFetchErr := network.FetchPeerListFromServer(connectionInfoPtr); peerInfoFetchErr != nil {
-		log.Fatal(peerInfoFetchErr)
-	} else {
-		if len(connectionInfoPtr.Peers) == 0 {
-			log.Println("Waiting for peers...")
-			time.Sleep(2 * time.Second) // Don't flood the server, sleep for a while
-			fetchPeerList(peersFound, connectionInfoPtr)
-		} else {
-			peersFound <- true
+// waitForPeers - Polls the server until the peers we need are in the room.
+// A sender waits for wantReceivers receivers, a receiver waits for the sender,
+// or for the sender and every other receiver when chunks are shared among receivers.
+// Returns early without error once the lifecycle has ended, e.g. on -wait-timeout.
+func waitForPeers(connectionInfoPtr *domain.ConnectionInfo, wantReceivers int, lifecycle *client.Lifecycle) error {
+	want := 1
+	if connectionInfoPtr.Mode == "S" || connectionInfoPtr.Swarm {
+		want = wantReceivers
+	}
+	for {
+		if err := network.FetchPeerListFromServer(connectionInfoPtr); err != nil {
+			return err
+		}
+		found := len(connectionInfoPtr.RemotePeers())
+		if found >= want {
+			return nil
 		}
+		log.Printf("Waiting for peers... (%d/%d)\n", found, want)
+		select {
+		case <-lifecycle.Done():
+			return nil
+		case <-time.After(2 * time.Second): // Don't flood the server, sleep for a while
+		}
+	}
+}
+
+// patternList - A flag that may be passed more than once, each time with one or more comma separated patterns
+type patternList []string
+
+func (list *patternList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *patternList) Set(value string) error {
+	*list = append(*list, strings.Split(value, ",")...)
+	return nil
+}
+
+// signalURLFromEnv - GO_SEND_SIGNAL_URL, else the default signalling server
+func signalURLFromEnv() string {
+	if signalURL := os.Getenv("GO_SEND_SIGNAL_URL"); signalURL != "" {
+		return signalURL
+	}
+	return domain.SignalBaseURL
+}
+
+// exit - Reports how the transfer ended and exits with the code of its final state
+func exit(state client.TransferState, err error) {
+	if err != nil {
+		log.Printf("Transfer ended: %s: %v\n", state, err)
+	} else {
+		log.Printf("Transfer ended: %s\n", state)
 	}
+	os.Exit(state.ExitCode())
 }
 
 func main() {
+	// go-send admin manages the signalling server rather than transferring anything
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		runAdmin(os.Args[2:])
+		return
+	}
+
 	mode := flag.String("mode", "S", "S for send, R for receive. Default is S")
 	sourcePath := flag.String("src", "/home/mahadevan/test.txt", "Path of the file to send")
+	destDir := flag.String("dest", ".", "Directory to write received files to")
 	token := flag.String("token", "", "Token which the sender and receiver must know (Required)")
+	signalTransport := flag.String("signal-transport", network.SignalLongPoll, "How messages from other peers are received from the signalling server: poll, long-poll or sse (server-sent events)")
+	signalURL := flag.String("signal-url", signalURLFromEnv(), "Base URL of the signalling server, https:// when it serves TLS (or GO_SEND_SIGNAL_URL)")
+	apiKey := flag.String("api-key", os.Getenv("GO_SEND_API_KEY"), "API key or JWT for signalling servers that require authentication (or GO_SEND_API_KEY)")
+	receivers := flag.Int("peers", 1, "Number of receivers in the room. The sender waits for all of them before sending")
+	swarm := flag.Bool("swarm", false, "Receivers fetch chunks from each other instead of all from the sender. Pass on every peer")
+	channels := flag.Int("channels", 1, "Number of parallel data channels per peer. More channels help on high latency links")
+	limit := flag.String("limit", "", "Upload bandwidth limit, e.g. 5MB/s or 500KB/s. SIGUSR1 doubles it, SIGUSR2 halves it while running")
+	receiveLimit := flag.String("recv-limit", "", "Download bandwidth limit, paces how fast we read so that the peer slows down")
+	reconnect := flag.Int("reconnect", 3, "Attempts to restart a lost connection to a peer before giving up on it, 0 to give up immediately")
+	waitTimeout := flag.Duration("wait-timeout", 5*time.Minute, "Give up if the peers have not joined and connected within this time, 0 to wait forever")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "Give up if nothing arrives from any peer for this long during the transfer, 0 to never")
+	onConflict := flag.String("on-conflict", "", "What a receiver does when the file already exists: overwrite, rename, skip, resume or ask. A receiver's choice wins over the sender's, the default is rename")
+	delta := flag.Bool("delta", false, "Receivers with an older version of the file only get what changed, rsync style. Makes overwrite the default -on-conflict. Not with -swarm")
+	fsync := flag.String("fsync", client.FsyncFile, "When a receiver flushes the file to disk: file (once complete), periodic (also every -fsync-interval) or none")
+	fsyncInterval := flag.Duration("fsync-interval", 5*time.Second, "How often -fsync periodic flushes")
+	compression := flag.String("compress", client.CompressionAuto, "Compression of file data: auto, zstd, gzip or none. auto skips files that are already compressed. A receiver passing none refuses compression")
+	deleteExtraneous := flag.Bool("delete", false, "sync: receivers delete the files the sender does not have")
+	dryRun := flag.Bool("n", false, "sync: only list what would be sent and deleted. Either side may ask for it")
+	watch := flag.Bool("watch", false, "sync: the sender keeps the connections open and pushes changes to -src as they happen, leaving out what .gitignore files ignore")
+	var exclude, include patternList
+	flag.Var(&exclude, "exclude", "sync: leave out files matching these .gitignore style patterns, e.g. node_modules/,.git/,*.o. .gitignore and .gosendignore files are honoured as well")
+	flag.Var(&include, "include", "sync: only sync files matching these .gitignore style patterns, or in directories matching them")
+	followSymlinks := flag.Bool("follow-symlinks", false, "sync: send what symbolic links point to instead of the links")
+	owner := flag.Bool("owner", false, "sync: receivers running as root give entries the sender's owner and group")
+	xattrs := flag.Bool("xattrs", false, "sync: copy extended attributes in the user namespace")
+	debounce := flag.Duration("debounce", 500*time.Millisecond, "sync -watch: push changes once nothing changed for this long")
 
-	flag.Parse()
+	// go-send sync -src <dir> mirrors a directory to receivers running go-send sync -dest <dir>
+	syncing := len(os.Args) > 1 && os.Args[1] == "sync"
+	if syncing {
+		flag.CommandLine.Parse(os.Args[2:])
+		passed := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+		switch {
+		case passed["src"] && !passed["dest"]:
+			*mode = "S"
+		case passed["dest"] && !passed["src"]:
+			*mode = "R"
+		default:
+			*mode = ""
+		}
+		if *swarm || *watch && (*mode != "S" || *dryRun) {
+			*mode = ""
+		}
+		if *mode == "" {
+			fmt.Println("Usage: go-send sync -token <token> -src <dir> [-watch] [-follow-symlinks] [-owner] [-xattrs] | -dest <dir> [-delete] [-n] [-exclude patterns] [-include patterns]. Not with -swarm, -watch not with -n")
+		}
+		if *mode == "S" {
+			if info, err := os.Stat(*sourcePath); err != nil || !info.IsDir() {
+				log.Fatalf("%s is not a directory", *sourcePath)
+			}
+		}
+	} else {
+		flag.Parse()
+		if *watch || len(exclude) > 0 || len(include) > 0 || *followSymlinks || *owner || *xattrs {
+			*mode = ""
+		}
+	}
 
-	if *mode != "S" && *mode != "R" || *token == "" {
+	if *mode != "S" && *mode != "R" || *token == "" || *receivers < 1 || *channels < 1 || !client.ValidConflictPolicy(*onConflict) || !client.ValidFsyncPolicy(*fsync) || !network.ValidSignalTransport(*signalTransport) ||
+		*compression != client.CompressionAuto && *compression != client.CompressionZstd && *compression != client.CompressionGzip && *compression != client.CompressionNone {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	var connectionInfo = domain.ConnectionInfo{}
-
-	if err := network.RegisterToken(*token, &connectionInfo); err != nil {
-		log.Fatal(err)
-	} else {
-		// success we have connected
-		log.Println(connectionInfo.ID, sourcePath)
+	sendRate, limitErr := client.ParseRate(*limit)
+	if limitErr != nil {
+		log.Fatal(limitErr)
+	}
+	receiveRate, limitErr := client.ParseRate(*receiveLimit)
+	if limitErr != nil {
+		log.Fatal(limitErr)
+	}
+	sendLimiter := client.NewRateLimiter(sendRate)
+	receiveLimiter := client.NewRateLimiter(receiveRate)
+	watchLimitSignals(sendLimiter, receiveLimiter)
 
-		peersAvailable := make(chan bool)
-		go fetchPeerList(peersAvailable, &connectionInfo)
+	lifecycle := client.NewLifecycle()
+	lifecycle.Watch(*waitTimeout, *idleTimeout)
 
-		// Wait till peers are available.
-		<-peersAvailable
-		log.Println(connectionInfo.Peers)
+	// Ctrl-C ends the transfer, we still say goodbye before exiting. A second one kills us right away.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-interrupts
+		signal.Stop(interrupts)
+		lifecycle.Fail(&client.TransferError{Kind: client.ErrInterrupted, Err: &AppError{fmt.Sprintf("Received %v", received)}})
+	}()
 
-		switch *mode {
-		case "S":
-			connectionInfo.Mode = "S"
-		case "R":
-			connectionInfo.Mode = "R"
-		default:
-			flag.PrintDefaults()
-			os.Exit(1)
-		}
+	domain.SignalBaseURL = strings.TrimSuffix(*signalURL, "/")
+	var connectionInfo = domain.ConnectionInfo{Swarm: *swarm, Credential: *apiKey}
 
-		pionClient := &client.PionClient{
-			ConnectionInfo: &connectionInfo,
+	// The room holds the sender plus every receiver.
+	if err := network.RegisterToken(*token, *mode, *receivers+1, &connectionInfo); err != nil {
+		if _, rejected := err.(*network.AppError); rejected {
+			exit(client.StateRejected, err)
 		}
-		pionClient.Connect()
+		exit(client.StateNetworkFailed, err)
+	}
+	// success we have connected
+	log.Println(connectionInfo.ID, sourcePath)
 
+	// Wait till peers are available.
+	if err := waitForPeers(&connectionInfo, *receivers, lifecycle); err != nil {
+		lifecycle.Fail(&client.TransferError{Kind: client.ErrSignal, Err: err})
 	}
 
-	select {}
+	pionClient := &client.PionClient{
+		SenderSourcePath:  *sourcePath,
+		ReceiverDir:       *destDir,
+		ConnectionInfo:    &connectionInfo,
+		Channels:          *channels,
+		Compression:       *compression,
+		OnConflict:        *onConflict,
+		Delta:             *delta,
+		Sync:              syncing,
+		SyncDelete:        *deleteExtraneous,
+		SyncDryRun:        *dryRun,
+		Exclude:           exclude,
+		Include:           include,
+		FollowSymlinks:    *followSymlinks,
+		PreserveOwner:     *owner,
+		Xattrs:            *xattrs,
+		Watch:             *watch,
+		Debounce:          *debounce,
+		Fsync:             *fsync,
+		FsyncInterval:     *fsyncInterval,
+		SendLimiter:       sendLimiter,
+		ReceiveLimiter:    receiveLimiter,
+		SignalTransport:   *signalTransport,
+		ReconnectAttempts: *reconnect,
+		Lifecycle:         lifecycle,
+	}
+	select {
+	case <-lifecycle.Done():
+	default:
+		log.Println(connectionInfo.Peers)
+		if err := pionClient.Connect(); err != nil {
+			lifecycle.Fail(err)
+		}
+	}
 
+	<-lifecycle.Done()
+	state, err := lifecycle.State()
+	pionClient.Close(err)
+	if leaveErr := network.LeaveRoom(&connectionInfo); leaveErr != nil {
+		log.Println(leaveErr)
+	}
+	exit(state, err)
 }
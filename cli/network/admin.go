@@ -0,0 +1,88 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+)
+
+// adminCall - Calls the signalling server's admin API with adminKey, decoding the answer into target
+// unless it is nil
+func adminCall(method string, path string, adminKey string, target interface{}) error {
+	var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+	request, err := http.NewRequest(method, domain.SignalBaseURL+"/admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+adminKey)
+	resp, err := do(httpClient, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errorMap := make(map[string]string)
+		if decodeErr := json.NewDecoder(resp.Body).Decode(&errorMap); decodeErr == nil && errorMap["error"] != "" {
+			return &AppError{errorMap["error"]}
+		}
+		return &AppError{fmt.Sprintf("The signalling server answered %s", resp.Status)}
+	}
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// FetchServerStatus - Whether the server is draining and how much it holds
+func FetchServerStatus(adminKey string) (*domain.ServerStatus, error) {
+	var status domain.ServerStatus
+	if err := adminCall("GET", "/status", adminKey, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// FetchRooms - Every room of the server, oldest first
+func FetchRooms(adminKey string) ([]domain.RoomStatus, error) {
+	var rooms struct {
+		Rooms []domain.RoomStatus `json:"rooms"`
+	}
+	if err := adminCall("GET", "/rooms", adminKey, &rooms); err != nil {
+		return nil, err
+	}
+	return rooms.Rooms, nil
+}
+
+// FetchRoom - The room of token
+func FetchRoom(adminKey string, token string) (*domain.RoomStatus, error) {
+	var room domain.RoomStatus
+	if err := adminCall("GET", "/rooms/"+url.PathEscape(token), adminKey, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// KickPeer - Removes a peer from its room
+func KickPeer(adminKey string, token string, id string) error {
+	return adminCall("DELETE", fmt.Sprintf("/rooms/%s/peers/%s", url.PathEscape(token), url.PathEscape(id)), adminKey, nil)
+}
+
+// CloseRoom - Removes a room with all of its peers
+func CloseRoom(adminKey string, token string) error {
+	return adminCall("DELETE", "/rooms/"+url.PathEscape(token), adminKey, nil)
+}
+
+// Drain - Stops the server from opening new rooms, or lets it open them again
+func Drain(adminKey string, draining bool) error {
+	method := "POST"
+	if !draining {
+		method = "DELETE"
+	}
+	return adminCall(method, "/drain", adminKey, nil)
+}
@@ -1,14 +1,18 @@
 package network
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/mahadevans87/go-send/protocol"
 )
 
 // AppError holds generic errors that the app reports.
@@ -20,13 +24,83 @@ func (appError *AppError) Error() string {
 	return fmt.Sprintf(appError.Cause)
 }
 
-// RegisterToken - API that is used to register a client to the signalling server
-func RegisterToken(token string, connectionInfo *domain.ConnectionInfo) error {
+// SessionHeader - Carries our session token on every call after registering
+const SessionHeader = "X-Session-Token"
+
+// newRequest - A request to the signalling server carrying our credential and session, as far as we have them
+func newRequest(method string, address string, body io.Reader, connectionInfo *domain.ConnectionInfo) (*http.Request, error) {
+	request, err := http.NewRequest(method, address, body)
+	if err != nil {
+		return nil, err
+	}
+	if connectionInfo.Credential != "" {
+		request.Header.Set("Authorization", "Bearer "+connectionInfo.Credential)
+	}
+	if connectionInfo.Session != "" {
+		request.Header.Set(SessionHeader, connectionInfo.Session)
+	}
+	return request, nil
+}
+
+// signalURL - The address of path on the signalling server with query escaped, query may be nil
+func signalURL(path string, query url.Values) string {
+	if len(query) == 0 {
+		return domain.SignalBaseURL + path
+	}
+	return domain.SignalBaseURL + path + "?" + query.Encode()
+}
+
+// peerQuery - The query naming our room and ourselves in it. Tokens are chosen by users and may
+// hold anything, e.g. & or #.
+func peerQuery(connectionInfo *domain.ConnectionInfo) url.Values {
+	return url.Values{"token": {connectionInfo.Token}, "id": {connectionInfo.ID}}
+}
+
+// errRemoved - The server no longer knows our session, we left or were removed from the room
+var errRemoved = &AppError{"The signalling server no longer knows us, we were removed from the room"}
+
+// maxRetryWait - Calls the server turns away as too busy are repeated if it asks us to wait no longer than this
+const maxRetryWait = 5 * time.Second
+
+// maxRetries - How often such a call is repeated
+const maxRetries = 3
+
+// do - Sends request, repeating it a few times while the server answers 429 or 503
+func do(httpClient *http.Client, request *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := httpClient.Do(request)
+		if err != nil || attempt > maxRetries || resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, err
+		}
+		wait := time.Second
+		if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > maxRetryWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		time.Sleep(wait)
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// RegisterToken - API that is used to register a client to the signalling server.
+// roomSize opens the room if this client is the first to join the token, otherwise it must be the
+// room's size. Fails right away when the room holds a different number of peers.
+func RegisterToken(token string, mode string, roomSize int, connectionInfo *domain.ConnectionInfo) error {
 	var httpClient = &http.Client{Timeout: 10 * time.Second}
 
-	resp, err := httpClient.Post(fmt.Sprintf("%s/register?token=%s", domain.SignalBaseURL, token), "", strings.NewReader(""))
+	request, err := newRequest("POST", signalURL("/register", url.Values{"token": {token}, "mode": {mode}, "size": {strconv.Itoa(roomSize)}, protocol.VersionParam: {strconv.Itoa(protocol.Version)}}), strings.NewReader(""), connectionInfo)
+	if err != nil {
+		return err
+	}
+	resp, err := do(httpClient, request)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -34,12 +108,22 @@ func RegisterToken(token string, connectionInfo *domain.ConnectionInfo) error {
 	if resp.StatusCode == http.StatusOK {
 		decodeErr := json.NewDecoder(resp.Body).Decode(connectionInfo)
 		if decodeErr != nil {
-			log.Fatal(decodeErr)
 			return decodeErr
 		}
 
-		// set the token to connectionInfo
+		// set the token and mode to connectionInfo
 		connectionInfo.Token = token
+		connectionInfo.Mode = mode
+		if connectionInfo.Version == 0 {
+			// The server predates versions, it speaks the first
+			connectionInfo.Version = protocol.MinVersion
+		}
+		// Servers that do not check sizes let us into a room we would wait in until timing out
+		if connectionInfo.Size != roomSize {
+			// Frees our place, the size is what we report either way
+			LeaveRoom(connectionInfo)
+			return &AppError{fmt.Sprintf("The room holds %d peers, not %d. Every peer must pass the same -peers", connectionInfo.Size, roomSize)}
+		}
 	} else {
 		errorMap := make(map[string]string)
 		if decodeErr := json.NewDecoder(resp.Body).Decode(&errorMap); decodeErr == nil {
@@ -56,9 +140,12 @@ func RegisterToken(token string, connectionInfo *domain.ConnectionInfo) error {
 func FetchPeerListFromServer(connectionInfo *domain.ConnectionInfo) error {
 	var httpClient = &http.Client{Timeout: 10 * time.Second}
 
-	resp, err := httpClient.Get(fmt.Sprintf("%s/peers?token=%s&id=%s", domain.SignalBaseURL, connectionInfo.Token, connectionInfo.ID))
+	request, err := newRequest("GET", signalURL("/peers", peerQuery(connectionInfo)), nil, connectionInfo)
+	if err != nil {
+		return err
+	}
+	resp, err := do(httpClient, request)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -72,25 +159,32 @@ func FetchPeerListFromServer(connectionInfo *domain.ConnectionInfo) error {
 
 		decodeErr := json.NewDecoder(resp.Body).Decode(&peerResponse)
 		if decodeErr != nil {
-			log.Fatal(decodeErr)
 			return decodeErr
 		} else {
 			// For now there is only one peer. We need to write a proper client later on
 			connectionInfo.Peers = peerResponse.Peers
 			return nil
 		}
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return errRemoved
 	} else {
 		return &AppError{"There was an internal server error."}
 	}
 }
 
-// FetchPendingMessages - Fetches SDP / ICE messages from other clients
-func FetchPendingMessages(connectionInfo *domain.ConnectionInfo) (*domain.Messages, error) {
-	var httpClient = &http.Client{Timeout: 60 * time.Second}
+// FetchPendingMessages - Fetches SDP / ICE messages from other clients. The server holds the request
+// for up to wait until one arrives, 0 asks for whatever is there right away.
+func FetchPendingMessages(connectionInfo *domain.ConnectionInfo, wait time.Duration) (*domain.Messages, error) {
+	var httpClient = &http.Client{Timeout: wait + 30*time.Second}
 
-	resp, err := httpClient.Get(fmt.Sprintf("%s/messages?token=%s&id=%s", domain.SignalBaseURL, connectionInfo.Token, connectionInfo.ID))
+	query := peerQuery(connectionInfo)
+	query.Set("wait", wait.String())
+	request, err := newRequest("GET", signalURL("/messages", query), nil, connectionInfo)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(httpClient, request)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -100,13 +194,59 @@ func FetchPendingMessages(connectionInfo *domain.ConnectionInfo) (*domain.Messag
 
 		decodeErr := json.NewDecoder(resp.Body).Decode(&pendingMessages)
 		if decodeErr != nil {
-			log.Fatal(decodeErr)
 			return nil, decodeErr
 		} else {
 			// For now there is only one peer. We need to write a proper client later on
 			return &pendingMessages, nil
 		}
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errRemoved
 	} else {
 		return nil, &AppError{"There was an internal server error."}
 	}
 }
+
+// LeaveRoom - Tells the signalling server we are gone so that our place in the room is freed
+func LeaveRoom(connectionInfo *domain.ConnectionInfo) error {
+	var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+	request, err := newRequest("POST", signalURL("/leave", peerQuery(connectionInfo)), strings.NewReader(""), connectionInfo)
+	if err != nil {
+		return err
+	}
+	resp, err := do(httpClient, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest {
+		// Removed already, or the room closed, e.g. after we went silent for too long
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &AppError{fmt.Sprintf("Could not leave the room, the server answered %s", resp.Status)}
+	}
+	return nil
+}
+
+// PostMessage - Relays an SDP or ICE message, already encoded as JSON, to another peer of the room
+func PostMessage(connectionInfo *domain.ConnectionInfo, payload []byte) error {
+	var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+	request, err := newRequest("POST", signalURL("/message", nil), bytes.NewReader(payload), connectionInfo)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := do(httpClient, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &AppError{fmt.Sprintf("The signalling server refused our message: %s", resp.Status)}
+	}
+	return nil
+}
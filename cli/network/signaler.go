@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahadevans87/go-send/cli/domain"
+	"github.com/mahadevans87/go-send/protocol"
+)
+
+// Transports a Signaler receives messages over
+const (
+	// SignalPoll - Asks the server for messages every few seconds
+	SignalPoll = "poll"
+	// SignalLongPoll - Asks the server for messages, which holds the request until one arrives
+	SignalLongPoll = "long-poll"
+	// SignalSSE - Listens to the room's server-sent events and fetches messages when told about one
+	SignalSSE = "sse"
+)
+
+// ValidSignalTransport - Whether transport is one of the Signal* transports
+func ValidSignalTransport(transport string) bool {
+	return transport == SignalPoll || transport == SignalLongPoll || transport == SignalSSE
+}
+
+// Signaler - Receives what the other peers of the room send us through the signalling server
+type Signaler interface {
+	// Receive - Waits up to a while for messages, returns those that arrived, possibly none
+	Receive() ([]domain.Message, error)
+	// Close - Stops listening
+	Close()
+}
+
+// NewSignaler - A Signaler of the given transport, waiting up to wait for messages in every Receive
+func NewSignaler(transport string, connectionInfo *domain.ConnectionInfo, wait time.Duration) Signaler {
+	switch transport {
+	case SignalPoll:
+		return &pollingSignaler{connectionInfo: connectionInfo}
+	case SignalSSE:
+		return newSSESignaler(connectionInfo, wait)
+	}
+	return &pollingSignaler{connectionInfo: connectionInfo, wait: wait}
+}
+
+// pollingSignaler - Fetches messages over plain HTTP, long-polling if wait is set
+type pollingSignaler struct {
+	connectionInfo *domain.ConnectionInfo
+	wait           time.Duration
+}
+
+func (signaler *pollingSignaler) Receive() ([]domain.Message, error) {
+	messages, err := FetchPendingMessages(signaler.connectionInfo, signaler.wait)
+	if err != nil {
+		return nil, err
+	}
+	return messages.Data, nil
+}
+
+func (signaler *pollingSignaler) Close() {
+}
+
+// sseSignaler - Listens to GET /rooms/:token/events and fetches our messages whenever a
+// message-available event names us, or wait passed without one
+type sseSignaler struct {
+	connectionInfo *domain.ConnectionInfo
+	wait           time.Duration
+	// available - Signalled when there may be messages for us
+	available chan struct{}
+	cancel    context.CancelFunc
+	ctx       context.Context
+
+	mux sync.Mutex
+	err error
+}
+
+func newSSESignaler(connectionInfo *domain.ConnectionInfo, wait time.Duration) *sseSignaler {
+	ctx, cancel := context.WithCancel(context.Background())
+	signaler := &sseSignaler{
+		connectionInfo: connectionInfo,
+		wait:           wait,
+		available:      make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	// Messages sent before we listened are waiting already
+	signaler.notify()
+	go signaler.listen()
+	return signaler
+}
+
+func (signaler *sseSignaler) Receive() ([]domain.Message, error) {
+	timer := time.NewTimer(signaler.wait)
+	defer timer.Stop()
+	select {
+	case <-signaler.available:
+	case <-timer.C:
+	case <-signaler.ctx.Done():
+		return nil, nil
+	}
+	signaler.mux.Lock()
+	err := signaler.err
+	signaler.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := FetchPendingMessages(signaler.connectionInfo, 0)
+	if err != nil {
+		return nil, err
+	}
+	return messages.Data, nil
+}
+
+func (signaler *sseSignaler) Close() {
+	signaler.cancel()
+}
+
+func (signaler *sseSignaler) notify() {
+	select {
+	case signaler.available <- struct{}{}:
+	default:
+	}
+}
+
+// listen - Keeps the event stream open until closed. A refused stream is reported by the next Receive.
+func (signaler *sseSignaler) listen() {
+	for {
+		err := signaler.stream()
+		if signaler.ctx.Err() != nil {
+			return
+		}
+		if _, refused := err.(*AppError); refused {
+			signaler.mux.Lock()
+			signaler.err = err
+			signaler.mux.Unlock()
+			signaler.notify()
+			return
+		}
+		// Events may have been missed while the stream was down
+		signaler.notify()
+		select {
+		case <-signaler.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// stream - Reads events until the stream ends
+func (signaler *sseSignaler) stream() error {
+	connectionInfo := signaler.connectionInfo
+	request, err := newRequest("GET", fmt.Sprintf("%s/rooms/%s/events", domain.SignalBaseURL, url.PathEscape(connectionInfo.Token)), nil, connectionInfo)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	// No timeout, the stream stays open for as long as we are in the room
+	resp, err := http.DefaultClient.Do(request.WithContext(signaler.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &AppError{fmt.Sprintf("The signalling server refused to stream events: %s", resp.Status)}
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			if event == protocol.EventMessageAvailable {
+				var available struct {
+					To string `json:"to"`
+				}
+				if json.Unmarshal([]byte(data), &available) == nil && available.To == connectionInfo.ID {
+					signaler.notify()
+				}
+			}
+			event, data = "", ""
+		}
+	}
+	return scanner.Err()
+}
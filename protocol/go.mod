@@ -0,0 +1,3 @@
+module github.com/mahadevans87/go-send/protocol
+
+go 1.15
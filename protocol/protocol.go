@@ -0,0 +1,118 @@
+// Package protocol holds what go-send clients and the signalling server say to each other over HTTP.
+// Both build against it so that they cannot drift apart; openapi.yaml describes the endpoints.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Version - The protocol version of this build. Clients pass theirs to /register as VersionParam and
+// the server answers with the version both speak.
+const Version = 1
+
+// MinVersion - The oldest version still spoken. Clients that pass none speak version 1.
+const MinVersion = 1
+
+// VersionParam - Query parameter of /register carrying the client's version
+const VersionParam = "version"
+
+// ParseVersion - The version a client passed as VersionParam. Clients that pass none predate
+// versions and speak version 1.
+func ParseVersion(param string) (int, error) {
+	if param == "" {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, fmt.Errorf("Protocol version %q is not a number", param)
+	}
+	return version, nil
+}
+
+// Negotiate - The version to speak with a client of version offered, false if there is none
+func Negotiate(offered int) (int, bool) {
+	if offered < MinVersion {
+		return 0, false
+	}
+	if offered > Version {
+		return Version, true
+	}
+	return offered, true
+}
+
+// Types of Message
+const (
+	// TypeSDP - Data is a session description, an offer or the answer to one
+	TypeSDP = "SDP"
+	// TypeICE - Data is an ICE candidate
+	TypeICE = "ICE"
+	// TypeReset - Data is the offer, or the answer to it, for a new connection replacing a lost one.
+	// Generation is that of the new connection.
+	TypeReset = "RESET"
+	// TypeBye - Data is the reason the sender leaves, for peers it has no connection to
+	TypeBye = "BYE"
+)
+
+// ValidType - Whether messageType is one of the Type* types
+func ValidType(messageType string) bool {
+	return messageType == TypeSDP || messageType == TypeICE || messageType == TypeReset || messageType == TypeBye
+}
+
+// Message - What one peer relays to another through POST /message and GET /messages. Data is
+// passed on untouched.
+type Message struct {
+	Type  string          `json:"type"`
+	Token string          `json:"token"`
+	From  string          `json:"from"`
+	To    string          `json:"to"`
+	Data  json.RawMessage `json:"data"`
+	// Generation - Which connection between the two peers an SDP or ICE message belongs to.
+	// Bumped whenever a lost connection is replaced by a new one.
+	Generation int `json:"generation,omitempty"`
+}
+
+// Validate - Rejects messages of unknown types and those missing where they go
+func (message *Message) Validate() error {
+	if !ValidType(message.Type) {
+		return fmt.Errorf("Unknown message type %q", message.Type)
+	}
+	if message.Token == "" || message.From == "" || message.To == "" {
+		return errors.New("A message needs a token, from and to")
+	}
+	return nil
+}
+
+// Messages - Answer of GET /messages
+type Messages struct {
+	Message string    `json:"message"`
+	Data    []Message `json:"data"`
+}
+
+// PeerInfo - A peer of a room as GET /peers lists it
+type PeerInfo struct {
+	Token string `json:"token"`
+	ID    string `json:"id"`
+	Mode  string `json:"mode"`
+}
+
+// Names of RoomEvent
+const (
+	EventPeerJoined       = "peer-joined"
+	EventPeerLeft         = "peer-left"
+	EventMessageAvailable = "message-available"
+	// EventRoomClosed - The last peer left or the room was closed, the room's streams end with it
+	EventRoomClosed = "room-closed"
+	// EventServerClosing - The server shuts down and ends the stream, clients reconnect to another
+	// replica or once it is back
+	EventServerClosing = "server-closing"
+)
+
+// RoomEvent - Something that happened in a room, streamed by GET /rooms/{token}/events with Name as
+// the event and Data as its JSON data
+type RoomEvent struct {
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    int
+		wantErr bool
+	}{
+		{name: "missing speaks version 1", param: "", want: 1},
+		{name: "a version", param: "1", want: 1},
+		{name: "a newer version", param: "7", want: 7},
+		{name: "malformed", param: "v2", wantErr: true},
+		{name: "not a whole number", param: "1.5", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := ParseVersion(test.param)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseVersion(%q): got error %v, want error %t", test.param, err, test.wantErr)
+			}
+			if err == nil && version != test.want {
+				t.Errorf("ParseVersion(%q) = %d, want %d", test.param, version, test.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered int
+		want    int
+		wantOK  bool
+	}{
+		{name: "the current version", offered: Version, want: Version, wantOK: true},
+		{name: "the oldest version still spoken", offered: MinVersion, want: MinVersion, wantOK: true},
+		{name: "a newer client speaks ours", offered: Version + 1, want: Version, wantOK: true},
+		{name: "an older client than supported", offered: MinVersion - 1, wantOK: false},
+		{name: "a negative version", offered: -3, wantOK: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, ok := Negotiate(test.offered)
+			if ok != test.wantOK || (ok && version != test.want) {
+				t.Errorf("Negotiate(%d) = %d, %t, want %d, %t", test.offered, version, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// identityKey - Where the authentication middleware leaves the caller's identity in the gin context
+const identityKey = "identity"
+
+// SessionHeader - Carries the session token /register hands out on every later call of that peer
+const SessionHeader = "X-Session-Token"
+
+// Authenticator - Decides who a client is from the bearer credential it sends. With neither API keys
+// nor a JWT secret authentication is off, everyone is anonymous and rooms belong to nobody.
+type Authenticator struct {
+	// APIKeys - The team owning each key
+	APIKeys map[string]string
+	// JWTSecret - HMAC key JWTs are signed with. Their subject is the identity.
+	JWTSecret []byte
+}
+
+// Enabled - Whether clients must authenticate
+func (authenticator *Authenticator) Enabled() bool {
+	return len(authenticator.APIKeys) > 0 || len(authenticator.JWTSecret) > 0
+}
+
+// LoadAPIKeys - Reads a file of "team key" lines, blank lines and those starting with # are skipped
+func LoadAPIKeys(file string) (map[string]string, error) {
+	keysFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer keysFile.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(keysFile)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a team and a key", file, line)
+		}
+		keys[fields[1]] = fields[0]
+	}
+	return keys, scanner.Err()
+}
+
+// Identify - The identity a credential belongs to, an API key or a JWT
+func (authenticator *Authenticator) Identify(credential string) (string, error) {
+	for key, team := range authenticator.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(credential)) == 1 {
+			return team, nil
+		}
+	}
+	if len(authenticator.JWTSecret) == 0 {
+		return "", errors.New("Unknown API key")
+	}
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(credential, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+		}
+		return authenticator.JWTSecret, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("The token names no subject")
+	}
+	return claims.Subject, nil
+}
+
+// Middleware - Rejects requests without a valid "Authorization: Bearer" credential when authentication
+// is enabled, counting them against the client IP in lockout, and otherwise leaves the caller's
+// identity under identityKey
+func (authenticator *Authenticator) Middleware(lockout *Lockout) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authenticator.Enabled() {
+			c.Set(identityKey, "")
+			return
+		}
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": "Authentication required",
+			})
+			return
+		}
+		identity, err := authenticator.Identify(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			lockout.Fail(c.ClientIP())
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": fmt.Sprintf("Authentication failed: %v", err),
+			})
+			return
+		}
+		c.Set(identityKey, identity)
+	}
+}
+
+// AdminOnly - Rejects requests that do not carry key as their "Authorization: Bearer" credential,
+// counting them against the client IP in lockout
+func AdminOnly(key string, lockout *Lockout) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") || !sameSecret(key, strings.TrimPrefix(header, "Bearer ")) {
+			lockout.Fail(c.ClientIP())
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": "Admin authentication required",
+			})
+		}
+	}
+}
+
+// NewSessionToken - A secret handed to a peer on registration, proving later calls come from it
+func NewSessionToken() (string, error) {
+	return randomHex(32)
+}
+
+// NewPeerID - An id nobody can guess, so that knowing a room's token reveals nothing about its peers
+func NewPeerID() (string, error) {
+	return randomHex(16)
+}
+
+// randomHex - size random bytes, hex encoded
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// peerWithSession - The peer of room holding session if it is the peer with id, or any peer when id is
+// empty. nil if there is none, or no room.
+func peerWithSession(room *Room, id string, session string) *PeerInfo {
+	if room == nil || session == "" {
+		return nil
+	}
+	for _, peer := range room.Peers {
+		if (id == "" || peer.ID == id) && sameSecret(peer.Session, session) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// sameSecret - Compares secrets in constant time
+func sameSecret(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
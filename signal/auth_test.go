@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// signedToken - A JWT for subject signed with secret, expiring after ttl
+func signedToken(t *testing.T, method jwt.SigningMethod, secret interface{}, subject string, ttl time.Duration) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, jwt.StandardClaims{Subject: subject, ExpiresAt: time.Now().Add(ttl).Unix()}).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestIdentify(t *testing.T) {
+	secret := []byte("jwt-secret")
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		credential    string
+		want          string
+		wantErr       bool
+	}{
+		{name: "an API key", authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}}, credential: "k-alpha", want: "alpha"},
+		{name: "an unknown API key", authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}}, credential: "k-beta", wantErr: true},
+		{name: "a prefix of an API key", authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}}, credential: "k-al", wantErr: true},
+		{name: "a JWT", authenticator: Authenticator{JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodHS256, secret, "beta", time.Hour), want: "beta"},
+		{name: "a JWT next to API keys", authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}, JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodHS512, secret, "beta", time.Hour), want: "beta"},
+		{name: "a JWT signed with another secret", authenticator: Authenticator{JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodHS256, []byte("other"), "beta", time.Hour), wantErr: true},
+		{name: "an expired JWT", authenticator: Authenticator{JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodHS256, secret, "beta", -time.Hour), wantErr: true},
+		{name: "a JWT without a subject", authenticator: Authenticator{JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodHS256, secret, "", time.Hour), wantErr: true},
+		{name: "an unsigned JWT", authenticator: Authenticator{JWTSecret: secret}, credential: signedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "beta", time.Hour), wantErr: true},
+		{name: "a JWT without a JWT secret", authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}}, credential: signedToken(t, jwt.SigningMethodHS256, secret, "beta", time.Hour), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := test.authenticator.Identify(test.credential)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Identify: got error %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && identity != test.want {
+				t.Errorf("Identify = %q, want %q", identity, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	type call struct {
+		authorization string
+		wantStatus    int
+		wantIdentity  string
+	}
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		calls         []call
+	}{
+		{
+			name:  "anyone is anonymous without keys",
+			calls: []call{{authorization: "", wantStatus: 200}, {authorization: "Bearer whatever", wantStatus: 200}},
+		},
+		{
+			name:          "a key identifies its team",
+			authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}},
+			calls:         []call{{authorization: "Bearer k-alpha", wantStatus: 200, wantIdentity: "alpha"}},
+		},
+		{
+			name:          "no credential is refused without locking out",
+			authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}},
+			calls: []call{
+				{authorization: "", wantStatus: 401}, {authorization: "Basic k-alpha", wantStatus: 401},
+				{authorization: "", wantStatus: 401}, {authorization: "Bearer k-alpha", wantStatus: 200, wantIdentity: "alpha"},
+			},
+		},
+		{
+			name:          "bad credentials lock out",
+			authenticator: Authenticator{APIKeys: map[string]string{"k-alpha": "alpha"}},
+			calls: []call{
+				{authorization: "Bearer k-beta", wantStatus: 401}, {authorization: "Bearer k-gamma", wantStatus: 401},
+				{authorization: "Bearer k-alpha", wantStatus: 429},
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			lockout := NewLockout(2, time.Minute)
+			r := gin.New()
+			r.GET("/", lockout.Middleware(), test.authenticator.Middleware(lockout), func(c *gin.Context) {
+				c.String(200, c.GetString(identityKey))
+			})
+			for index, call := range test.calls {
+				request := httptest.NewRequest(http.MethodGet, "/", nil)
+				if call.authorization != "" {
+					request.Header.Set("Authorization", call.authorization)
+				}
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, request)
+				if recorder.Code != call.wantStatus {
+					t.Fatalf("Call %d: status %d, want %d", index, recorder.Code, call.wantStatus)
+				}
+				if call.wantStatus == 200 && recorder.Body.String() != call.wantIdentity {
+					t.Errorf("Call %d: identity %q, want %q", index, recorder.Body.String(), call.wantIdentity)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerWithSession(t *testing.T) {
+	room := &Room{Size: 2, Peers: []*PeerInfo{{Token: "t", ID: "a", Mode: "S", Session: "session-a"}, {Token: "t", ID: "b", Mode: "R", Session: "session-b"}}}
+	tests := []struct {
+		name    string
+		room    *Room
+		id      string
+		session string
+		want    string
+	}{
+		{name: "any peer", room: room, session: "session-b", want: "b"},
+		{name: "the peer asked for", room: room, id: "a", session: "session-a", want: "a"},
+		{name: "another peer's session", room: room, id: "a", session: "session-b"},
+		{name: "an unknown session", room: room, session: "session-c"},
+		{name: "no session", room: room},
+		{name: "no room", session: "session-a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := ""
+			if peer := peerWithSession(test.room, test.id, test.session); peer != nil {
+				id = peer.ID
+			}
+			if id != test.want {
+				t.Errorf("peerWithSession(%q, %q) is peer %q, want %q", test.id, test.session, id, test.want)
+			}
+		})
+	}
+}
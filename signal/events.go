@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahadevans87/go-send/protocol"
+)
+
+// Events of a room, streamed to subscribers of GET /rooms/:token/events as server-sent events.
+// Long-polls for messages wait for them as well.
+
+// eventBuffer - Events a subscriber may fall behind by before further ones are dropped for it
+const eventBuffer = 64
+
+// keepAliveInterval - How often an idle stream gets a comment, so that proxies leave it open
+const keepAliveInterval = 15 * time.Second
+
+// retakeInterval - How often a long-poll looks for messages anyway, in case their wake-up got lost
+// on the way from another replica
+const retakeInterval = 5 * time.Second
+
+// logFormatter - gin's access log line, without the session an event stream may be given in its URL
+func logFormatter(param gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactSession(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// redactSession - path with the value of its session parameter replaced
+func redactSession(path string) string {
+	index := strings.IndexByte(path, '?')
+	if index < 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[index+1:])
+	if err != nil {
+		// Whatever it holds is not worth the risk
+		return path[:index]
+	}
+	if _, ok := query["session"]; !ok {
+		return path
+	}
+	query.Set("session", "REDACTED")
+	return path[:index+1] + query.Encode()
+}
+
+// hub - Hands the events of each room to the subscribers in this process and wakes up the long-polls
+// of peers that got a message
+type hub struct {
+	mux         sync.Mutex
+	subscribers map[string]map[chan protocol.RoomEvent]bool
+	// waiters - The long-polls of each room and the peer each waits for. A wake-up is set rather than
+	// queued, however many messages arrive it is never dropped.
+	waiters map[string]map[chan struct{}]string
+}
+
+func newHub() *hub {
+	return &hub{subscribers: make(map[string]map[chan protocol.RoomEvent]bool), waiters: make(map[string]map[chan struct{}]string)}
+}
+
+// waitFor - A channel signalled once a message for peer id of the room token is announced, or the room
+// closes, until cancelled
+func (hub *hub) waitFor(token string, id string) (<-chan struct{}, func()) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	if hub.waiters[token] == nil {
+		hub.waiters[token] = make(map[chan struct{}]string)
+	}
+	wake := make(chan struct{}, 1)
+	hub.waiters[token][wake] = id
+	return wake, func() {
+		hub.mux.Lock()
+		defer hub.mux.Unlock()
+		delete(hub.waiters[token], wake)
+		if len(hub.waiters[token]) == 0 {
+			delete(hub.waiters, token)
+		}
+	}
+}
+
+// subscribe - A channel receiving the events of the room token until cancelled, or closed with the room
+func (hub *hub) subscribe(token string) (<-chan protocol.RoomEvent, func()) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	if hub.subscribers[token] == nil {
+		hub.subscribers[token] = make(map[chan protocol.RoomEvent]bool)
+	}
+	events := make(chan protocol.RoomEvent, eventBuffer)
+	hub.subscribers[token][events] = true
+	return events, func() {
+		hub.mux.Lock()
+		defer hub.mux.Unlock()
+		if hub.subscribers[token][events] {
+			delete(hub.subscribers[token], events)
+			if len(hub.subscribers[token]) == 0 {
+				delete(hub.subscribers, token)
+			}
+		}
+	}
+}
+
+// publish - Sends an event to every subscriber of the room that keeps up and wakes up the long-polls
+// it concerns
+func (hub *hub) publish(token string, event protocol.RoomEvent) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	for wake, id := range hub.waiters[token] {
+		if event.Name == protocol.EventRoomClosed || (event.Name == protocol.EventMessageAvailable && event.Data["to"] == id) {
+			select {
+			case wake <- struct{}{}:
+			default:
+				// Already set
+			}
+		}
+	}
+	for events := range hub.subscribers[token] {
+		select {
+		case events <- event:
+		default:
+		}
+		if event.Name == protocol.EventRoomClosed {
+			close(events)
+		}
+	}
+	if event.Name == protocol.EventRoomClosed {
+		delete(hub.subscribers, token)
+	}
+}
+
+// waitForMessages - Takes the messages waiting for peer id, waiting up to wait for one to be announced
+// if there are none. take must be safe to call while messages arrive.
+func (hub *hub) waitForMessages(ctx context.Context, token string, id string, wait time.Duration, take func() ([]protocol.Message, error)) ([]protocol.Message, error) {
+	// Waiting before looking, nothing announced in between is missed
+	wake, cancel := hub.waitFor(token, id)
+	defer cancel()
+	messages, err := take()
+	if err != nil || len(messages) > 0 || wait <= 0 {
+		return messages, err
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	retake := time.NewTicker(retakeInterval)
+	defer retake.Stop()
+	for {
+		select {
+		case <-wake:
+			return take()
+		case <-retake.C:
+			if messages, err := take(); err != nil || len(messages) > 0 {
+				return messages, err
+			}
+		case <-timer.C:
+			return take()
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
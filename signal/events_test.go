@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedactSession(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "no query", path: "/rooms/t/events", want: "/rooms/t/events"},
+		{name: "no session", path: "/rooms/t/messages?wait=30", want: "/rooms/t/messages?wait=30"},
+		{name: "a session", path: "/rooms/t/events?session=secret", want: "/rooms/t/events?session=REDACTED"},
+		{name: "a session among others", path: "/rooms/t/events?v=1&session=secret", want: "/rooms/t/events?session=REDACTED&v=1"},
+		{name: "an empty session", path: "/rooms/t/events?session=", want: "/rooms/t/events?session=REDACTED"},
+		{name: "a malformed query", path: "/rooms/t/events?session=%zz", want: "/rooms/t/events"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := redactSession(test.path); got != test.want {
+				t.Errorf("redactSession(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,16 @@ module github.com/mahadevans87/go-send/signal
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/dgraph-io/badger v1.6.1
 	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/gin-gonic/gin v1.6.3
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/mahadevans87/go-send/protocol v0.0.0
+	github.com/prometheus/client_golang v1.10.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 )
+
+replace github.com/mahadevans87/go-send/protocol => ../protocol
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Protection against floods and token guessing: token buckets per client IP and per room, and a
+// lockout for IPs that keep failing to authenticate or join.
+
+// forgetAfter - Buckets and failure counts not touched for this long are dropped
+const forgetAfter = 10 * time.Minute
+
+// bucket - Token bucket refilled at rate tokens per second up to burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// KeyedLimiter - A token bucket per key, e.g. per client IP. A rate of 0 means unlimited.
+type KeyedLimiter struct {
+	rate  float64
+	burst float64
+
+	mux     sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewKeyedLimiter - Allows rate requests per second and key, and bursts of up to burst requests
+func NewKeyedLimiter(rate float64, burst int) *KeyedLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &KeyedLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow - Takes a token for key. Otherwise returns how long until the next one is available.
+func (limiter *KeyedLimiter) Allow(key string) (bool, time.Duration) {
+	if limiter.rate <= 0 {
+		return true, 0
+	}
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+
+	now := time.Now()
+	keyBucket := limiter.buckets[key]
+	if keyBucket == nil {
+		keyBucket = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = keyBucket
+	}
+	keyBucket.tokens = math.Min(limiter.burst, keyBucket.tokens+now.Sub(keyBucket.last).Seconds()*limiter.rate)
+	keyBucket.last = now
+	if keyBucket.tokens < 1 {
+		return false, time.Duration((1 - keyBucket.tokens) / limiter.rate * float64(time.Second))
+	}
+	keyBucket.tokens--
+	return true, 0
+}
+
+// forget - Drops buckets that have been full for a while
+func (limiter *KeyedLimiter) forget() {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+	for key, keyBucket := range limiter.buckets {
+		if time.Since(keyBucket.last) > forgetAfter {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// failures - Failed attempts of one IP
+type failures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// Lockout - Locks IPs out for a while once they failed too often within that time
+type Lockout struct {
+	max      int
+	duration time.Duration
+
+	mux      sync.Mutex
+	failures map[string]*failures
+}
+
+// NewLockout - Locks an IP out for duration after max failures within duration, max 0 never does
+func NewLockout(max int, duration time.Duration) *Lockout {
+	return &Lockout{max: max, duration: duration, failures: make(map[string]*failures)}
+}
+
+// LockedFor - How much longer ip is locked out, 0 if it is not
+func (lockout *Lockout) LockedFor(ip string) time.Duration {
+	lockout.mux.Lock()
+	defer lockout.mux.Unlock()
+	if ipFailures := lockout.failures[ip]; ipFailures != nil {
+		if remaining := time.Until(ipFailures.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// Fail - Counts a failed attempt of ip
+func (lockout *Lockout) Fail(ip string) {
+	if lockout.max <= 0 {
+		return
+	}
+	lockout.mux.Lock()
+	defer lockout.mux.Unlock()
+
+	now := time.Now()
+	ipFailures := lockout.failures[ip]
+	if ipFailures == nil || now.Sub(ipFailures.first) > lockout.duration {
+		ipFailures = &failures{first: now}
+		lockout.failures[ip] = ipFailures
+	}
+	ipFailures.count++
+	if ipFailures.count >= lockout.max {
+		ipFailures.lockedUntil = now.Add(lockout.duration)
+	}
+}
+
+// forget - Drops the failures of IPs that are neither locked out nor failed recently
+func (lockout *Lockout) forget() {
+	lockout.mux.Lock()
+	defer lockout.mux.Unlock()
+	for ip, ipFailures := range lockout.failures {
+		if time.Since(ipFailures.first) > lockout.duration && time.Now().After(ipFailures.lockedUntil) {
+			delete(lockout.failures, ip)
+		}
+	}
+}
+
+// Middleware - Turns away locked out IPs. Handlers count failures themselves, only bad credentials,
+// joins of someone else's room and guessed sessions do, so that other 401s and 403s lock nobody out.
+func (lockout *Lockout) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if remaining := lockout.LockedFor(c.ClientIP()); remaining > 0 {
+			tooMany(c, remaining, "Too many failed attempts")
+		}
+	}
+}
+
+// RateLimit - Answers 429 once the client IP runs out of tokens
+func RateLimit(limiter *KeyedLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := limiter.Allow(c.ClientIP()); !ok {
+			tooMany(c, wait, "Too many requests")
+		}
+	}
+}
+
+// tooMany - Aborts with 429, telling the client when to try again
+func tooMany(c *gin.Context, wait time.Duration, reason string) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", fmt.Sprint(retryAfter))
+	c.AbortWithStatusJSON(429, gin.H{
+		"error": fmt.Sprintf("%s, try again in %ds", reason, retryAfter),
+	})
+}
+
+// forgetIdle - Regularly drops what the limiters and lockouts no longer need
+func forgetIdle(lockouts []*Lockout, limiters ...*KeyedLimiter) {
+	for range time.Tick(time.Minute) {
+		for _, lockout := range lockouts {
+			lockout.forget()
+		}
+		for _, limiter := range limiters {
+			limiter.forget()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	type take struct {
+		key    string
+		wantOK bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []take
+	}{
+		{name: "unlimited", rate: 0, burst: 1, takes: []take{{"a", true}, {"a", true}, {"a", true}}},
+		{name: "a burst, then nothing", rate: 0.1, burst: 3, takes: []take{{"a", true}, {"a", true}, {"a", true}, {"a", false}}},
+		{name: "at least one", rate: 0.1, burst: 0, takes: []take{{"a", true}, {"a", false}}},
+		{name: "a bucket per key", rate: 0.1, burst: 1, takes: []take{{"a", true}, {"a", false}, {"b", true}, {"b", false}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewKeyedLimiter(test.rate, test.burst)
+			for index, take := range test.takes {
+				ok, wait := limiter.Allow(take.key)
+				if ok != take.wantOK {
+					t.Fatalf("Take %d of %s: allowed %t, want %t", index, take.key, ok, take.wantOK)
+				}
+				if !ok && (wait <= 0 || wait > time.Duration(float64(time.Second)/test.rate)) {
+					t.Errorf("Take %d of %s: wait %v, want up to %v", index, take.key, wait, time.Duration(float64(time.Second)/test.rate))
+				}
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterRefills(t *testing.T) {
+	limiter := NewKeyedLimiter(50, 1)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("The first take was refused")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatal("A take beyond the burst was allowed")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("The bucket did not refill")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		failures   int
+		pause      time.Duration
+		more       int
+		wantLocked bool
+	}{
+		{name: "below the limit", max: 3, failures: 2},
+		{name: "at the limit", max: 3, failures: 3, wantLocked: true},
+		{name: "never with a limit of 0", max: 0, failures: 10},
+		{name: "failures spread out", max: 3, failures: 2, pause: 150 * time.Millisecond, more: 2},
+		{name: "failures close together", max: 3, failures: 2, pause: 10 * time.Millisecond, more: 1, wantLocked: true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			lockout := NewLockout(test.max, 100*time.Millisecond)
+			for i := 0; i < test.failures; i++ {
+				lockout.Fail("192.0.2.1")
+			}
+			time.Sleep(test.pause)
+			for i := 0; i < test.more; i++ {
+				lockout.Fail("192.0.2.1")
+			}
+			if locked := lockout.LockedFor("192.0.2.1") > 0; locked != test.wantLocked {
+				t.Errorf("Locked out %t, want %t", locked, test.wantLocked)
+			}
+			if lockout.LockedFor("192.0.2.2") > 0 {
+				t.Error("Another IP is locked out")
+			}
+		})
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	lockout := NewLockout(1, 50*time.Millisecond)
+	lockout.Fail("192.0.2.1")
+	if lockout.LockedFor("192.0.2.1") <= 0 {
+		t.Fatal("Not locked out")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if remaining := lockout.LockedFor("192.0.2.1"); remaining > 0 {
+		t.Errorf("Still locked out for %v", remaining)
+	}
+}
@@ -1,159 +1,675 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mahadevans87/go-send/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// DefaultRoomSize - Number of peers a room holds when the first peer does not ask for a size
+const DefaultRoomSize = 2
+
 // PeerInfo Data Model
 type PeerInfo struct {
-	Token    string       `json:"token"`
-	ID       string       `json:"id"`
-	Messages chan Message `json:"-"`
+	Token string `json:"token"`
+	ID    string `json:"id"`
+	Mode  string `json:"mode"`
+	// Session - Secret the peer proves its later calls with
+	Session string `json:"-"`
 }
 
-// Message Data Model
-type Message struct {
-	Type  string
-	Token string      `json:"token"`
-	From  string      `json:"from"`
-	To    string      `json:"to"`
-	Data  interface{} `json:"data"`
+// Room holds the peers registered against a token. Size is fixed by the first peer to register.
+// Peer ids are random and never reused, even after a peer has left.
+type Room struct {
+	Size  int
+	Peers []*PeerInfo
+	// Owner - Identity of the first peer, only peers with the same identity may join
+	Owner string
+	// Created - When the first peer joined
+	Created time.Time
 }
 
 func main() {
-	r := gin.Default()
+	addr := flag.String("addr", defaultAddr(), "Address to listen on (or GO_SEND_ADDR, or :$PORT)")
+	tlsCert := flag.String("tls-cert", os.Getenv("GO_SEND_TLS_CERT"), "Certificate file to serve HTTPS with, together with -tls-key (or GO_SEND_TLS_CERT)")
+	tlsKey := flag.String("tls-key", os.Getenv("GO_SEND_TLS_KEY"), "Private key file of -tls-cert (or GO_SEND_TLS_KEY)")
+	acmeDomains := flag.String("acme-domains", os.Getenv("GO_SEND_ACME_DOMAINS"), "Comma separated domains to get certificates for from Let's Encrypt instead of -tls-cert. -addr must be reachable on port 443 (or GO_SEND_ACME_DOMAINS)")
+	acmeCache := flag.String("acme-cache", "acme-cache", "Directory ACME certificates are kept in between restarts")
+	acmeEmail := flag.String("acme-email", "", "Contact address given to the ACME certificate authority")
+	acmeHTTPAddr := flag.String("acme-http-addr", "", "Also answer ACME HTTP challenges on this address, e.g. :80, redirecting everything else to HTTPS")
+	useHTTP2 := flag.Bool("http2", true, "Offer HTTP/2 to clients over TLS")
+	useH2C := flag.Bool("h2c", false, "Serve HTTP/2 without TLS too, for proxies speaking it to their backends")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Longest time to read a request, 0 for none")
+	writeTimeout := flag.Duration("write-timeout", 0, "Longest time to write a response, 0 for none. Must exceed -max-wait, and ends event streams when it passes")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "How long an idle keep-alive connection is kept open")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("GO_SEND_TRUSTED_PROXIES"), "Comma separated IPs and CIDR ranges of proxies whose X-Forwarded-For is believed. Without any, clients are told apart by the address they connect from (or GO_SEND_TRUSTED_PROXIES)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 90*time.Second, "How long a SIGTERM waits for requests in flight, long-polls included, before closing them")
+	maxRoomSize := flag.Int("max-room-size", 32, "Maximum number of peers a single room may hold")
+	apiKeys := flag.String("api-keys", "", "File of \"team key\" lines. Clients must send one of the keys as a bearer token, rooms belong to the team that opened them")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("GO_SEND_JWT_SECRET"), "HMAC secret of the JWTs clients may authenticate with instead, their subject owns the rooms it opens (or GO_SEND_JWT_SECRET)")
+	ipRate := flag.Float64("ip-rate", 20, "Requests per second a client IP may make on average, 0 for unlimited")
+	ipBurst := flag.Int("ip-burst", 60, "Requests a client IP may make at once")
+	roomRate := flag.Float64("room-rate", 50, "Messages per second a room may relay on average, 0 for unlimited")
+	roomBurst := flag.Int("room-burst", 200, "Messages a room may relay at once")
+	maxMessageBytes := flag.Int64("max-message-bytes", 64*1024, "Largest message relayed")
+	maxQueuedMessages := flag.Int("max-queued-messages", 500, "Most messages waiting for a peer to fetch them, further ones are refused until it does")
+	maxFailedJoins := flag.Int("max-failed-joins", 10, "Failed authentications or joins after which a client IP is locked out, 0 to never lock out")
+	lockoutDuration := flag.Duration("lockout", 15*time.Minute, "How long a client IP stays locked out, failures within this time add up")
+	storeURL := flag.String("store", "memory", "Where rooms and messages are kept: memory, or a redis://host:port/db URL shared by every replica behind a load balancer")
+	metricsAddr := flag.String("metrics-addr", "", "Serve /metrics on this address, e.g. :9090, instead of with the API where it needs the same authentication")
+	adminKey := flag.String("admin-key", os.Getenv("GO_SEND_ADMIN_KEY"), "Bearer credential of the /admin API, which is off without one (or GO_SEND_ADMIN_KEY)")
+	maxWait := flag.Duration("max-wait", time.Minute, "Longest a GET /messages?wait= request is held waiting for a message")
+	peerTimeout := flag.Duration("peer-timeout", 10*time.Minute, "Peers that have not called the server for this long are removed from their room, which closes once empty. 0 keeps them until they leave")
+	flag.Parse()
+
+	if (*tlsCert == "") != (*tlsKey == "") || *tlsCert != "" && *acmeDomains != "" {
+		log.Fatal("Pass -tls-cert with -tls-key, or -acme-domains")
+	}
+	proxies, err := ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authenticator := &Authenticator{JWTSecret: []byte(*jwtSecret)}
+	if *apiKeys != "" {
+		keys, err := LoadAPIKeys(*apiKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authenticator.APIKeys = keys
+	}
+
+	store, err := NewStore(*storeURL, *peerTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	lockout := NewLockout(*maxFailedJoins, *lockoutDuration)
+	// Operators guessing wrong lock themselves out of the admin API only, and clients sharing their
+	// address do not lock them out of it
+	adminLockout := NewLockout(*maxFailedJoins, *lockoutDuration)
+	ipLimiter := NewKeyedLimiter(*ipRate, *ipBurst)
+	roomLimiter := NewKeyedLimiter(*roomRate, *roomBurst)
+	go forgetIdle([]*Lockout{lockout, adminLockout}, ipLimiter, roomLimiter)
+	if *peerTimeout > 0 {
+		go reapSilentPeers(store, *peerTimeout)
+	}
+
+	metrics := NewMetrics(prometheus.DefaultRegisterer, store)
+
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery())
+	// Tokens in paths are escaped by clients and may hold an escaped /
+	r.UseRawPath = true
+	r.Use(TrustProxies(proxies), metrics.Middleware(), RateLimit(ipLimiter))
+	api := r.Group("/", lockout.Middleware(), authenticator.Middleware(lockout))
+
+	if *metricsAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, promhttp.Handler()))
+		}()
+	} else {
+		api.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	}
 
-	// Make a map of token-peerInfos
-	tokenPeers := make(map[string][]*PeerInfo)
+	// sessionPeer returns the peer of the room whose session token the request carries if it is the
+	// peer with id, or any peer when id is empty, and records that it was seen. nil if the session
+	// matches none of them, which counts as a failed attempt of the client.
+	sessionPeer := func(c *gin.Context, room *Room, id string) *PeerInfo {
+		peer := peerWithSession(room, id, c.GetHeader(SessionHeader))
+		if peer == nil {
+			lockout.Fail(c.ClientIP())
+			return nil
+		}
+		if err := store.Touch(peer.Token, peer.ID); err != nil {
+			log.Printf("Store: %v", err)
+		}
+		return peer
+	}
+
+	// storeFailed answers 500 when the store could not be reached
+	storeFailed := func(c *gin.Context, err error) {
+		log.Printf("Store: %v", err)
+		c.JSON(500, gin.H{
+			"error": "The server could not reach its store",
+		})
+	}
 
-	r.POST("/register", func(c *gin.Context) {
+	// draining is 1 while the server opens no new rooms, see /admin/drain. It is set for good on
+	// shutdown, when shuttingDown is closed as well.
+	var draining int32
+	shuttingDown := make(chan struct{})
+
+	api.POST("/register", func(c *gin.Context) {
 		var peerInfo PeerInfo
 		token := c.Query("token")
-		peers := tokenPeers[token]
-		if peers == nil {
-			peers = make([]*PeerInfo, 0)
-			tokenPeers[token] = peers
+		identity := c.GetString(identityKey)
+
+		offered, err := protocol.ParseVersion(c.Query(protocol.VersionParam))
+		if err != nil {
+			metrics.RejectedJoins.WithLabelValues("version").Inc()
+			c.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
 		}
-		if len(peers) == 2 {
+		version, ok := protocol.Negotiate(offered)
+		if !ok {
+			metrics.RejectedJoins.WithLabelValues("version").Inc()
 			c.JSON(400, gin.H{
-				"error": "Cannot add additional peer to token",
-			})
-		} else {
-			peerID := len(peers) + 1
-			peerInfo.ID = fmt.Sprint(peerID)
-			peerInfo.Token = token
-			peerInfo.Messages = make(chan Message, 10)
-			peers = append(peers, &peerInfo)
-			tokenPeers[token] = peers
+				"error": fmt.Sprintf("Protocol version %s is not supported, the server speaks %d to %d", c.Query(protocol.VersionParam), protocol.MinVersion, protocol.Version),
+			})
+			return
+		}
+
+		// The first peer's size opens the room, every later peer passing one must pass the same. Without
+		// one a peer joins a room of any size.
+		size := 0
+		if sizeParam := c.Query("size"); sizeParam != "" {
+			var err error
+			if size, err = strconv.Atoi(sizeParam); err != nil || size < 2 || size > *maxRoomSize {
+				c.JSON(400, gin.H{
+					"error": fmt.Sprintf("Room size must be between 2 and %d", *maxRoomSize),
+				})
+				return
+			}
+		}
+		if atomic.LoadInt32(&draining) == 1 {
+			room, err := store.Room(token)
+			if err != nil {
+				storeFailed(c, err)
+				return
+			}
+			// Rooms that are open already may still fill up, new ones are left to other replicas
+			if room == nil {
+				metrics.RejectedJoins.WithLabelValues("draining").Inc()
+				c.Header("Retry-After", "1")
+				c.JSON(503, gin.H{
+					"error": "The server is draining and opens no new rooms",
+				})
+				return
+			}
+		}
+		session, err := NewSessionToken()
+		if err == nil {
+			peerInfo.ID, err = NewPeerID()
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": "Could not create a session",
+			})
+			return
+		}
+		peerInfo.Token = token
+		peerInfo.Mode = c.Query("mode")
+		peerInfo.Session = session
+
+		room, err := store.Join(token, size, identity, &peerInfo)
+		switch err {
+		case nil:
+			metrics.Registrations.Inc()
+			// The room may have closed again already
+			if room != nil {
+				size = room.Size
+				if len(room.Peers) == room.Size {
+					metrics.TimeToPair.Observe(time.Since(room.Created).Seconds())
+				}
+			}
 			c.JSON(200, gin.H{
 				"message": "OK",
 				"peerId":  peerInfo.ID,
+				"size":    size,
+				"session": session,
+				"version": version,
+			})
+		case ErrNotOwner:
+			metrics.RejectedJoins.WithLabelValues("not_owner").Inc()
+			lockout.Fail(c.ClientIP())
+			c.JSON(403, gin.H{
+				"error": err.Error(),
+			})
+		case ErrRoomSize:
+			metrics.RejectedJoins.WithLabelValues("room_size").Inc()
+			c.JSON(409, gin.H{
+				"error": err.Error(),
+			})
+		case ErrRoomFull:
+			metrics.RejectedJoins.WithLabelValues("room_full").Inc()
+			c.JSON(400, gin.H{
+				"error": err.Error(),
 			})
+		default:
+			storeFailed(c, err)
 		}
 	})
 
-	r.GET("/peers", func(c *gin.Context) {
+	// A peer leaving frees its place in the room. The room goes away with its last peer.
+	api.POST("/leave", func(c *gin.Context) {
 		token := c.Query("token")
 		peerID := c.Query("id")
-		foundPeer := false
-		resultPeers := make([]*PeerInfo, 0)
-		if peers := tokenPeers[token]; peers != nil {
-			for _, peer := range peers {
-				if peerID == peer.ID {
-					foundPeer = true
-				} else {
-					resultPeers = append(resultPeers, peer)
-				}
-			}
-			if foundPeer {
-				c.JSON(200, gin.H{
-					"message": "OK",
-					"peers":   resultPeers,
-				})
-			} else {
-				c.JSON(401, gin.H{
-					"message": "UnAuthorized",
-				})
-			}
+
+		room, err := store.Room(token)
+		if err != nil {
+			storeFailed(c, err)
+			return
 		}
+		if room == nil {
+			c.JSON(400, gin.H{
+				"message": "Invalid Token",
+			})
+			return
+		}
+		if sessionPeer(c, room, peerID) == nil {
+			c.JSON(401, gin.H{
+				"message": "UnAuthorized. No such peer",
+			})
+			return
+		}
+		if err := store.Leave(token, peerID); err != nil && err != ErrNoSuchPeer {
+			storeFailed(c, err)
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "OK",
+		})
 	})
 
-	// Set the offer by the first peer.
-	r.POST("/message", func(c *gin.Context) {
-		var message Message
-		c.BindJSON(&message)
-		if peers := tokenPeers[message.Token]; peers != nil {
-			foundSender := false
-			foundReceiver := false
-			var receiverPeer *PeerInfo
-			for _, peer := range peers {
-				if peer.ID == message.From {
-					foundSender = true
-				}
-				if peer.ID == message.To {
-					foundReceiver = true
-					receiverPeer = peer
-				}
+	api.GET("/peers", func(c *gin.Context) {
+		token := c.Query("token")
+		peerID := c.Query("id")
+		room, err := store.Room(token)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		// Peers that were kicked, or whose room was closed, are no longer known either
+		if sessionPeer(c, room, peerID) == nil {
+			c.JSON(401, gin.H{
+				"message": "UnAuthorized",
+			})
+			return
+		}
+		resultPeers := make([]*PeerInfo, 0)
+		for _, peer := range room.Peers {
+			if peerID != peer.ID {
+				resultPeers = append(resultPeers, peer)
 			}
-			if foundSender && foundReceiver {
-				receiverPeer.Messages <- message
-				c.JSON(200, gin.H{
-					"message": "OK. Offer Submitted",
-				})
+		}
+		c.JSON(200, gin.H{
+			"message": "OK",
+			"peers":   resultPeers,
+		})
+	})
 
-			} else {
-				c.JSON(401, gin.H{
-					"message": "UnAuthorized. No such peer",
-				})
-			}
-		} else {
+	// Relays a message to another peer of the room. Only the types of the protocol are relayed.
+	api.POST("/message", func(c *gin.Context) {
+		var message protocol.Message
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, *maxMessageBytes+1))
+		if err != nil {
+			c.JSON(400, gin.H{
+				"message": "Could not read the message",
+			})
+			return
+		}
+		if int64(len(body)) > *maxMessageBytes {
+			c.JSON(413, gin.H{
+				"message": fmt.Sprintf("Messages may not exceed %d bytes", *maxMessageBytes),
+			})
+			return
+		}
+		if err := json.Unmarshal(body, &message); err != nil {
+			c.JSON(400, gin.H{
+				"message": "Invalid message",
+			})
+			return
+		}
+		if err := message.Validate(); err != nil {
+			c.JSON(400, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		if ok, wait := roomLimiter.Allow(message.Token); !ok {
+			tooMany(c, wait, "Too many messages in this room")
+			return
+		}
+		room, err := store.Room(message.Token)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if room == nil {
 			c.JSON(400, gin.H{
 				"message": "Invalid Token",
 			})
+			return
+		}
+		// Only peers of the room may post to it, in their own name
+		sender := sessionPeer(c, room, "")
+		if sender == nil {
+			c.JSON(401, gin.H{
+				"message": "UnAuthorized. No such peer",
+			})
+			return
+		}
+		if sender.ID != message.From {
+			c.JSON(403, gin.H{
+				"message": "The message is not from the authenticated peer",
+			})
+			return
+		}
+		queueSize := 10 * room.Size
+		if queueSize > *maxQueuedMessages {
+			queueSize = *maxQueuedMessages
+		}
+		// A peer that does not fetch its messages must not hold up the sender
+		switch err := store.Enqueue(message, queueSize); err {
+		case nil:
+			metrics.Messages.WithLabelValues(message.Type).Inc()
+			c.JSON(200, gin.H{
+				"message": "OK. Offer Submitted",
+			})
+		case ErrNoSuchPeer:
+			// Most likely the peer just left, not worth a failed attempt
+			c.JSON(404, gin.H{
+				"message": "No such peer",
+			})
+		case ErrQueueFull:
+			c.Header("Retry-After", "1")
+			c.JSON(503, gin.H{
+				"message": err.Error(),
+			})
+		default:
+			storeFailed(c, err)
 		}
 	})
 
-	// Get the offer from the first peer by the other peer(s)
-	r.GET("/messages", func(c *gin.Context) {
+	// Get the offer from the first peer by the other peer(s). With wait, e.g. wait=30s, the request
+	// is held until a message arrives or the time is up rather than answered right away.
+	api.GET("/messages", func(c *gin.Context) {
 		token := c.Query("token")
 		peerID := c.Query("id")
+		var wait time.Duration
+		if waitParam := c.Query("wait"); waitParam != "" {
+			var err error
+			if wait, err = time.ParseDuration(waitParam); err != nil || wait < 0 {
+				c.JSON(400, gin.H{
+					"error": "wait must be a duration such as 30s",
+				})
+				return
+			}
+			if wait > *maxWait {
+				wait = *maxWait
+			}
+		}
 
-		if peers := tokenPeers[token]; peers != nil {
-			var foundPeer *PeerInfo
-			messages := make([]Message, 0)
+		room, err := store.Room(token)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if sessionPeer(c, room, peerID) == nil {
+			c.JSON(401, gin.H{
+				"message": "UnAuthorized. No such peer",
+			})
+			return
+		}
+		// Released on shutdown rather than holding it up, the client asks again, of another replica
+		// or once the server is back
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-shuttingDown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		messages, err := store.Dequeue(ctx, token, peerID, wait)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if len(messages) == 0 && ctx.Err() != nil && c.Request.Context().Err() == nil {
+			c.Header("Retry-After", "1")
+			c.JSON(503, gin.H{
+				"error": "The server is shutting down",
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "OK",
+			"data":    messages,
+		})
+	})
+	// Streams the events of a room to its peers, and to its owner when clients authenticate. Browsers'
+	// EventSource cannot set headers, they may pass the session as ?session= instead, which is left out
+	// of the access log.
+	api.GET("/rooms/:token/events", func(c *gin.Context) {
+		token := c.Param("token")
+		if c.GetHeader(SessionHeader) == "" {
+			c.Request.Header.Set(SessionHeader, c.Query("session"))
+		}
+
+		// Subscribed before looking at the room, it may close in between
+		events, cancel := store.Subscribe(token)
+		defer cancel()
+		room, err := store.Room(token)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		owner := room != nil && authenticator.Enabled() && room.Owner == c.GetString(identityKey)
+		if !owner && sessionPeer(c, room, "") == nil {
+			c.JSON(401, gin.H{
+				"message": "UnAuthorized",
+			})
+			return
+		}
 
-			for _, peer := range peers {
-				if peer.ID == peerID {
-					foundPeer = peer
-					break
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(200)
+		c.Writer.Flush()
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return false
 				}
+				c.SSEvent(event.Name, event.Data)
+				return true
+			case <-keepAlive.C:
+				_, err := io.WriteString(w, ": keep-alive\n\n")
+				return err == nil
+			case <-shuttingDown:
+				c.SSEvent(protocol.EventServerClosing, map[string]string{})
+				return false
+			case <-c.Request.Context().Done():
+				return false
 			}
-			if foundPeer != nil {
-				hasMoreMessages := true
-				for {
-					if !hasMoreMessages {
-						break
-					}
-					select {
-					case msg := <-foundPeer.Messages:
-						messages = append(messages, msg)
-					default:
-						hasMoreMessages = false
-					}
-				}
+		})
+	})
+
+	// The admin API lets operators look into rooms and manage them. It is authenticated with its own
+	// key rather than the clients' credentials.
+	if *adminKey != "" {
+		admin := r.Group("/admin", adminLockout.Middleware(), AdminOnly(*adminKey, adminLockout))
+
+		admin.GET("/status", func(c *gin.Context) {
+			stats, err := store.Stats()
+			if err != nil {
+				storeFailed(c, err)
+				return
+			}
+			c.JSON(200, gin.H{
+				"draining":       atomic.LoadInt32(&draining) == 1,
+				"rooms":          stats.Rooms,
+				"peers":          stats.Peers,
+				"queuedMessages": stats.QueuedMessages,
+			})
+		})
+
+		// Rooms are listed oldest first
+		admin.GET("/rooms", func(c *gin.Context) {
+			rooms, err := store.Rooms()
+			if err != nil {
+				storeFailed(c, err)
+				return
+			}
+			sort.Slice(rooms, func(i, j int) bool { return rooms[i].Created.Before(rooms[j].Created) })
+			c.JSON(200, gin.H{
+				"rooms": rooms,
+			})
+		})
+
+		admin.GET("/rooms/:token", func(c *gin.Context) {
+			room, err := store.RoomStatus(c.Param("token"))
+			if err != nil {
+				storeFailed(c, err)
+				return
+			}
+			if room == nil {
+				c.JSON(404, gin.H{
+					"error": ErrNoSuchRoom.Error(),
+				})
+				return
+			}
+			c.JSON(200, room)
+		})
+
+		// Closing a room removes all of its peers, their next calls are refused
+		admin.DELETE("/rooms/:token", func(c *gin.Context) {
+			switch err := store.CloseRoom(c.Param("token")); err {
+			case nil:
 				c.JSON(200, gin.H{
 					"message": "OK",
-					"data":    messages,
 				})
-			} else {
-				c.JSON(401, gin.H{
-					"message": "UnAuthorized. No such peer",
+			case ErrNoSuchRoom:
+				c.JSON(404, gin.H{
+					"error": err.Error(),
 				})
+			default:
+				storeFailed(c, err)
 			}
+		})
+
+		// Kicking a peer frees its place in the room as if it had left
+		admin.DELETE("/rooms/:token/peers/:id", func(c *gin.Context) {
+			switch err := store.Leave(c.Param("token"), c.Param("id")); err {
+			case nil:
+				c.JSON(200, gin.H{
+					"message": "OK",
+				})
+			case ErrNoSuchPeer:
+				c.JSON(404, gin.H{
+					"error": err.Error(),
+				})
+			default:
+				storeFailed(c, err)
+			}
+		})
+
+		// A draining server opens no new rooms while those it has finish, GET /admin/status tells when
+		// none are left. Each replica drains on its own, the rooms counted are those of the store.
+		admin.POST("/drain", func(c *gin.Context) {
+			atomic.StoreInt32(&draining, 1)
+			c.JSON(200, gin.H{
+				"draining": true,
+			})
+		})
+
+		admin.DELETE("/drain", func(c *gin.Context) {
+			atomic.StoreInt32(&draining, 0)
+			c.JSON(200, gin.H{
+				"draining": false,
+			})
+		})
+	}
+
+	server := &http.Server{
+		Addr:         *addr,
+		Handler:      r,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	if !*useHTTP2 {
+		// A non-nil map keeps net/http from negotiating HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// On SIGTERM the server stops opening rooms, ends event streams telling their peers it is closing,
+	// releases long-polls and stops accepting connections while the requests in flight complete
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		received := <-signals
+		log.Printf("Received %v, shutting down", received)
+		atomic.StoreInt32(&draining, 1)
+		close(shuttingDown)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Requests were still running: %v", err)
 		}
+		close(stopped)
+	}()
 
-	})
-	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+	switch {
+	case *acmeDomains != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(*acmeDomains, ",")...),
+			Cache:      autocert.DirCache(*acmeCache),
+			Email:      *acmeEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		if !*useHTTP2 {
+			server.TLSConfig.NextProtos = []string{"http/1.1", "acme-tls/1"}
+		}
+		if *acmeHTTPAddr != "" {
+			go func() {
+				log.Fatal(http.ListenAndServe(*acmeHTTPAddr, manager.HTTPHandler(nil)))
+			}()
+		}
+		err = server.ListenAndServeTLS("", "")
+	case *tlsCert != "":
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	default:
+		if *useH2C {
+			server.Handler = h2c.NewHandler(r, &http2.Server{IdleTimeout: *idleTimeout})
+		}
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exposed at /metrics for Prometheus to scrape
+
+// Metrics - Counters and histograms of the server, plus what the store holds at scrape time
+type Metrics struct {
+	Registrations   prometheus.Counter
+	RejectedJoins   *prometheus.CounterVec
+	Messages        *prometheus.CounterVec
+	TimeToPair      prometheus.Histogram
+	RequestDuration *prometheus.HistogramVec
+}
+
+// NewMetrics - Creates the metrics and registers them, with those of store, on registerer
+func NewMetrics(registerer prometheus.Registerer, store Store) *Metrics {
+	metrics := &Metrics{
+		Registrations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gosend_registrations_total",
+			Help: "Peers that joined a room.",
+		}),
+		RejectedJoins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gosend_rejected_joins_total",
+			Help: "Peers refused a place in a room, by reason.",
+		}, []string{"reason"}),
+		Messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gosend_messages_relayed_total",
+			Help: "Messages queued for a peer, by type. The server only relays the types of the protocol.",
+		}, []string{"type"}),
+		TimeToPair: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gosend_time_to_pair_seconds",
+			Help:    "Time from the first peer joining a room until it is full.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gosend_http_request_duration_seconds",
+			Help:    "Time taken to answer HTTP requests, by route. Long-polls and event streams last as long as they are held open.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+	registerer.MustRegister(metrics.Registrations, metrics.RejectedJoins, metrics.Messages, metrics.TimeToPair,
+		metrics.RequestDuration, &storeCollector{store: store})
+	return metrics
+}
+
+// Middleware - Measures how long each route takes to answer
+func (metrics *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.RequestDuration.WithLabelValues(c.Request.Method, route, fmt.Sprint(c.Writer.Status())).Observe(time.Since(started).Seconds())
+	}
+}
+
+var (
+	activeRoomsDesc    = prometheus.NewDesc("gosend_active_rooms", "Rooms with at least one peer.", nil, nil)
+	activePeersDesc    = prometheus.NewDesc("gosend_active_peers", "Peers in a room.", nil, nil)
+	queuedMessagesDesc = prometheus.NewDesc("gosend_queued_messages", "Messages waiting for their peer to fetch them.", nil, nil)
+)
+
+// storeCollector - Reads the gauges from the store when scraped, so that every replica sharing a
+// store reports the same numbers
+type storeCollector struct {
+	store Store
+}
+
+func (collector *storeCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- activeRoomsDesc
+	descs <- activePeersDesc
+	descs <- queuedMessagesDesc
+}
+
+func (collector *storeCollector) Collect(metrics chan<- prometheus.Metric) {
+	stats, err := collector.store.Stats()
+	if err != nil {
+		log.Printf("Store: %v", err)
+		return
+	}
+	metrics <- prometheus.MustNewConstMetric(activeRoomsDesc, prometheus.GaugeValue, float64(stats.Rooms))
+	metrics <- prometheus.MustNewConstMetric(activePeersDesc, prometheus.GaugeValue, float64(stats.Peers))
+	metrics <- prometheus.MustNewConstMetric(queuedMessagesDesc, prometheus.GaugeValue, float64(stats.QueuedMessages))
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mahadevans87/go-send/protocol"
+)
+
+// Rooms in Redis, shared by every replica using the same instance. Each room has a hash with its size
+// and owner, a hash of its peers, a hash of when each peer was last seen and a list per peer queueing
+// its messages. Changes that check something first run as Lua scripts, which Redis runs atomically.
+// Every replica reaps peers that went silent; should none be left to do so the keys of a room expire
+// once its peers stop calling. Events are published on a channel per room; every replica listens to
+// all of them on a single connection and hands them to its subscribers. Keys carry the token as a
+// hash tag so that a room stays on one cluster node.
+
+// redisPrefix - Prefix of every key and channel
+const redisPrefix = "gosend:"
+
+// redisPoolSize - Connections to Redis per replica. Long-polls do not hold one while waiting.
+const redisPoolSize = 64
+
+var (
+	// joinScript - KEYS room, peers, seen; ARGV size, owner, creation time, peer id, peer, size of a new
+	// room, milliseconds until the room expires or 0. Returns -1 for someone else's room, -2 for a full
+	// one, -3 if the size is not 0 and not the room's.
+	joinScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('HSET', KEYS[1], 'size', ARGV[6], 'owner', ARGV[2], 'created', ARGV[3])
+end
+local room = redis.call('HMGET', KEYS[1], 'size', 'owner')
+if room[2] ~= ARGV[2] then
+	return -1
+end
+if ARGV[1] ~= '0' and ARGV[1] ~= room[1] then
+	return -3
+end
+if redis.call('HLEN', KEYS[2]) >= tonumber(room[1]) then
+	return -2
+end
+redis.call('HSET', KEYS[2], ARGV[4], ARGV[5])
+redis.call('HSET', KEYS[3], ARGV[4], ARGV[3])
+if ARGV[7] ~= '0' then
+	for _, key in ipairs(KEYS) do
+		redis.call('PEXPIRE', key, ARGV[7])
+	end
+end
+return 0
+`)
+	// leaveScript - KEYS room, peers, queue, seen; ARGV peer id, time the peer must not have been seen
+	// since or 0. Returns the peers left, -1 if there was no such peer, -2 if it was seen since.
+	leaveScript = redis.NewScript(`
+if ARGV[2] ~= '0' and tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0') >= tonumber(ARGV[2]) then
+	return -2
+end
+if redis.call('HDEL', KEYS[2], ARGV[1]) == 0 then
+	return -1
+end
+redis.call('DEL', KEYS[3])
+redis.call('HDEL', KEYS[4], ARGV[1])
+local left = redis.call('HLEN', KEYS[2])
+if left == 0 then
+	redis.call('DEL', KEYS[1], KEYS[4])
+end
+return left
+`)
+	// touchScript - KEYS peers, seen, room, queue; ARGV peer id, time, milliseconds until the room
+	// expires or 0. Leaves peers that are gone alone.
+	touchScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+	if ARGV[3] ~= '0' then
+		for _, key in ipairs(KEYS) do
+			redis.call('PEXPIRE', key, ARGV[3])
+		end
+	end
+end
+return 0
+`)
+	// closeScript - KEYS room, peers, seen and the queue of every peer; ARGV the ids of those peers.
+	// Returns 1 when closed, -1 if there was no such room, -2 if its peers are no longer those.
+	closeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+if redis.call('HLEN', KEYS[2]) ~= #ARGV then
+	return -2
+end
+for _, id in ipairs(ARGV) do
+	if redis.call('HEXISTS', KEYS[2], id) == 0 then
+		return -2
+	end
+end
+redis.call('DEL', unpack(KEYS))
+return 1
+`)
+	// enqueueScript - KEYS peers, queue; ARGV peer id, capacity, message, milliseconds until the queue
+	// expires or 0. Returns 1 when queued, 0 for a full queue, -1 if there is no such peer.
+	enqueueScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+if redis.call('LLEN', KEYS[2]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('RPUSH', KEYS[2], ARGV[3])
+if ARGV[4] ~= '0' then
+	redis.call('PEXPIRE', KEYS[2], ARGV[4])
+end
+return 1
+`)
+	// takeScript - KEYS queue. Returns and removes every message in it.
+	takeScript = redis.NewScript(`
+local messages = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return messages
+`)
+)
+
+// redisPeer - A peer as stored, with what PeerInfo leaves out of JSON
+type redisPeer struct {
+	ID      string `json:"id"`
+	Mode    string `json:"mode"`
+	Session string `json:"session"`
+	// Joined - Nanoseconds since the epoch, peers are listed in the order they joined
+	Joined int64 `json:"joined"`
+}
+
+// redisStore - Keeps rooms in Redis
+type redisStore struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	hub    *hub
+	// ttl - How long the keys of a room outlive the last call of any of its peers, 0 for ever
+	ttl time.Duration
+}
+
+func newRedisStore(url string, ttl time.Duration) (*redisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	options.PoolSize = redisPoolSize
+	client := redis.NewClient(options)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	store := &redisStore{client: client, hub: newHub(), ttl: ttl}
+	store.pubsub = client.PSubscribe(redisPrefix + "{*}:events")
+	if _, err := store.pubsub.Receive(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	go store.dispatch()
+	return store, nil
+}
+
+func roomKey(token string) string {
+	return fmt.Sprintf("%s{%s}:room", redisPrefix, token)
+}
+
+func peersKey(token string) string {
+	return fmt.Sprintf("%s{%s}:peers", redisPrefix, token)
+}
+
+func seenKey(token string) string {
+	return fmt.Sprintf("%s{%s}:seen", redisPrefix, token)
+}
+
+func queueKey(token string, id string) string {
+	return fmt.Sprintf("%s{%s}:queue:%s", redisPrefix, token, id)
+}
+
+func eventsChannel(token string) string {
+	return fmt.Sprintf("%s{%s}:events", redisPrefix, token)
+}
+
+// dispatch - Hands the events published by every replica to our subscribers
+func (store *redisStore) dispatch() {
+	for message := range store.pubsub.Channel() {
+		token := strings.TrimSuffix(strings.TrimPrefix(message.Channel, redisPrefix+"{"), "}:events")
+		var event protocol.RoomEvent
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			log.Printf("Ignoring an event on %s: %v", message.Channel, err)
+			continue
+		}
+		store.hub.publish(token, event)
+	}
+}
+
+// publish - Sends an event to the subscribers of every replica
+func (store *redisStore) publish(token string, event protocol.RoomEvent) {
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = store.client.Publish(eventsChannel(token), payload).Err()
+	}
+	if err != nil {
+		log.Printf("Could not publish %s in a room: %v", event.Name, err)
+	}
+}
+
+func (store *redisStore) Join(token string, size int, owner string, peer *PeerInfo) (*Room, error) {
+	now := time.Now().UnixNano()
+	stored, err := json.Marshal(redisPeer{ID: peer.ID, Mode: peer.Mode, Session: peer.Session, Joined: now})
+	if err != nil {
+		return nil, err
+	}
+	opened := size
+	if opened == 0 {
+		opened = DefaultRoomSize
+	}
+	result, err := joinScript.Run(store.client, []string{roomKey(token), peersKey(token), seenKey(token)}, size, owner, now, peer.ID, stored, opened, store.ttl.Milliseconds()).Int()
+	if err != nil {
+		return nil, err
+	}
+	switch result {
+	case -1:
+		return nil, ErrNotOwner
+	case -2:
+		return nil, ErrRoomFull
+	case -3:
+		return nil, ErrRoomSize
+	}
+	store.publish(token, protocol.RoomEvent{Name: protocol.EventPeerJoined, Data: map[string]string{"id": peer.ID, "mode": peer.Mode}})
+	return store.Room(token)
+}
+
+func (store *redisStore) Leave(token string, id string) error {
+	removed, err := store.remove(token, id, time.Time{})
+	if err == nil && !removed {
+		err = ErrNoSuchPeer
+	}
+	return err
+}
+
+// remove - Removes a peer unless it was seen at or after unseenSince, when that is not zero, closing
+// the room with its last peer. False if there was no such peer or it was seen since.
+func (store *redisStore) remove(token string, id string, unseenSince time.Time) (bool, error) {
+	var cutoff int64
+	if !unseenSince.IsZero() {
+		cutoff = unseenSince.UnixNano()
+	}
+	left, err := leaveScript.Run(store.client, []string{roomKey(token), peersKey(token), queueKey(token, id), seenKey(token)}, id, cutoff).Int()
+	if err != nil {
+		return false, err
+	}
+	if left < 0 {
+		return false, nil
+	}
+	store.publish(token, protocol.RoomEvent{Name: protocol.EventPeerLeft, Data: map[string]string{"id": id}})
+	if left == 0 {
+		store.publish(token, protocol.RoomEvent{Name: protocol.EventRoomClosed, Data: map[string]string{}})
+	}
+	return true, nil
+}
+
+func (store *redisStore) Room(token string) (*Room, error) {
+	pipeline := store.client.Pipeline()
+	roomFields := pipeline.HGetAll(roomKey(token))
+	peerFields := pipeline.HGetAll(peersKey(token))
+	if _, err := pipeline.Exec(); err != nil {
+		return nil, err
+	}
+	return parseRoom(token, roomFields.Val(), peerFields.Val())
+}
+
+// parseRoom - The room stored in the fields of its hashes, nil if there are none
+func parseRoom(token string, fields map[string]string, peerFields map[string]string) (*Room, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	size, err := strconv.Atoi(fields["size"])
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make([]redisPeer, 0, len(peerFields))
+	for _, value := range peerFields {
+		var peer redisPeer
+		if err := json.Unmarshal([]byte(value), &peer); err != nil {
+			return nil, err
+		}
+		stored = append(stored, peer)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Joined < stored[j].Joined })
+	created, _ := strconv.ParseInt(fields["created"], 10, 64)
+	room := &Room{Size: size, Owner: fields["owner"], Created: time.Unix(0, created), Peers: make([]*PeerInfo, 0, len(stored))}
+	for _, peer := range stored {
+		room.Peers = append(room.Peers, &PeerInfo{Token: token, ID: peer.ID, Mode: peer.Mode, Session: peer.Session})
+	}
+	return room, nil
+}
+
+func (store *redisStore) Touch(token string, id string) error {
+	return touchScript.Run(store.client, []string{peersKey(token), seenKey(token), roomKey(token), queueKey(token, id)}, id, time.Now().UnixNano(), store.ttl.Milliseconds()).Err()
+}
+
+// Rooms - Scans every room, like Stats
+func (store *redisStore) Rooms() ([]RoomStatus, error) {
+	keys, err := store.scan(redisPrefix + "{*}:room")
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, 0, len(keys))
+	pipeline := store.client.Pipeline()
+	roomFields := make([]*redis.StringStringMapCmd, 0, len(keys))
+	peerFields := make([]*redis.StringStringMapCmd, 0, len(keys))
+	seenFields := make([]*redis.StringStringMapCmd, 0, len(keys))
+	for _, key := range keys {
+		token := strings.TrimSuffix(strings.TrimPrefix(key, redisPrefix+"{"), "}:room")
+		tokens = append(tokens, token)
+		roomFields = append(roomFields, pipeline.HGetAll(roomKey(token)))
+		peerFields = append(peerFields, pipeline.HGetAll(peersKey(token)))
+		seenFields = append(seenFields, pipeline.HGetAll(seenKey(token)))
+	}
+	if len(keys) > 0 {
+		if _, err := pipeline.Exec(); err != nil {
+			return nil, err
+		}
+	}
+
+	rooms := make([]RoomStatus, 0, len(tokens))
+	queueLengths := make([][]*redis.IntCmd, 0, len(tokens))
+	pipeline = store.client.Pipeline()
+	for index, token := range tokens {
+		room, err := parseRoom(token, roomFields[index].Val(), peerFields[index].Val())
+		if err != nil {
+			return nil, err
+		}
+		if room == nil {
+			// Closed since the scan
+			continue
+		}
+		status, lengths := roomStatus(pipeline, token, room, seenFields[index].Val())
+		rooms = append(rooms, status)
+		queueLengths = append(queueLengths, lengths)
+	}
+	if len(rooms) > 0 {
+		if _, err := pipeline.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	for index := range rooms {
+		for peer, length := range queueLengths[index] {
+			rooms[index].Peers[peer].Queued = int(length.Val())
+		}
+	}
+	return rooms, nil
+}
+
+// RoomStatus - Reads a single room, like Rooms does for each
+func (store *redisStore) RoomStatus(token string) (*RoomStatus, error) {
+	pipeline := store.client.Pipeline()
+	roomFields := pipeline.HGetAll(roomKey(token))
+	peerFields := pipeline.HGetAll(peersKey(token))
+	seenFields := pipeline.HGetAll(seenKey(token))
+	if _, err := pipeline.Exec(); err != nil {
+		return nil, err
+	}
+	room, err := parseRoom(token, roomFields.Val(), peerFields.Val())
+	if err != nil || room == nil {
+		return nil, err
+	}
+	pipeline = store.client.Pipeline()
+	status, lengths := roomStatus(pipeline, token, room, seenFields.Val())
+	if len(lengths) > 0 {
+		if _, err := pipeline.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	for peer, length := range lengths {
+		status.Peers[peer].Queued = int(length.Val())
+	}
+	return &status, nil
+}
+
+// roomStatus - The status of room with when its peers were last seen as stored in seenFields. The
+// lengths of their queues are queued on pipeline, in the order of the peers.
+func roomStatus(pipeline redis.Pipeliner, token string, room *Room, seenFields map[string]string) (RoomStatus, []*redis.IntCmd) {
+	status := RoomStatus{Token: token, Size: room.Size, Owner: room.Owner, Created: room.Created, Peers: make([]PeerStatus, 0, len(room.Peers))}
+	lengths := make([]*redis.IntCmd, 0, len(room.Peers))
+	for _, peer := range room.Peers {
+		seen, _ := strconv.ParseInt(seenFields[peer.ID], 10, 64)
+		status.Peers = append(status.Peers, PeerStatus{ID: peer.ID, Mode: peer.Mode, LastSeen: time.Unix(0, seen)})
+		lengths = append(lengths, pipeline.LLen(queueKey(token, peer.ID)))
+	}
+	return status, lengths
+}
+
+// closeAttempts - How often CloseRoom reads the peers again when they changed before it could close
+const closeAttempts = 5
+
+// CloseRoom - Scripts may only touch the keys they are given, the ids of the peers are read first to
+// name their queues. A peer joining or leaving in between makes it start over.
+func (store *redisStore) CloseRoom(token string) error {
+	for attempt := 0; attempt < closeAttempts; attempt++ {
+		ids, err := store.client.HKeys(peersKey(token)).Result()
+		if err != nil {
+			return err
+		}
+		keys := []string{roomKey(token), peersKey(token), seenKey(token)}
+		arguments := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			keys = append(keys, queueKey(token, id))
+			arguments = append(arguments, id)
+		}
+		result, err := closeScript.Run(store.client, keys, arguments...).Int()
+		if err != nil {
+			return err
+		}
+		switch result {
+		case -1:
+			return ErrNoSuchRoom
+		case -2:
+			continue
+		}
+		for _, id := range ids {
+			store.publish(token, protocol.RoomEvent{Name: protocol.EventPeerLeft, Data: map[string]string{"id": id}})
+		}
+		store.publish(token, protocol.RoomEvent{Name: protocol.EventRoomClosed, Data: map[string]string{}})
+		return nil
+	}
+	return fmt.Errorf("The peers of room %s kept changing while closing it", token)
+}
+
+func (store *redisStore) Enqueue(message protocol.Message, capacity int) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	result, err := enqueueScript.Run(store.client, []string{peersKey(message.Token), queueKey(message.Token, message.To)}, message.To, capacity, payload, store.ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case -1:
+		return ErrNoSuchPeer
+	case 0:
+		return ErrQueueFull
+	}
+	store.publish(message.Token, protocol.RoomEvent{Name: protocol.EventMessageAvailable, Data: map[string]string{"from": message.From, "to": message.To, "type": message.Type}})
+	return nil
+}
+
+func (store *redisStore) Dequeue(ctx context.Context, token string, id string, wait time.Duration) ([]protocol.Message, error) {
+	return store.hub.waitForMessages(ctx, token, id, wait, func() ([]protocol.Message, error) {
+		payloads, err := takeScript.Run(store.client, []string{queueKey(token, id)}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		values, _ := payloads.([]interface{})
+		messages := make([]protocol.Message, 0, len(values))
+		for _, value := range values {
+			payload, _ := value.(string)
+			var message protocol.Message
+			if err := json.Unmarshal([]byte(payload), &message); err != nil {
+				return nil, err
+			}
+			messages = append(messages, message)
+		}
+		return messages, nil
+	})
+}
+
+func (store *redisStore) Subscribe(token string) (<-chan protocol.RoomEvent, func()) {
+	return store.hub.subscribe(token)
+}
+
+// Stats - Scans every room, which is fine for a scrape every few seconds
+func (store *redisStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+	rooms, err := store.scan(redisPrefix + "{*}:room")
+	if err != nil {
+		return stats, err
+	}
+	queues, err := store.scan(redisPrefix + "{*}:queue:*")
+	if err != nil {
+		return stats, err
+	}
+	pipeline := store.client.Pipeline()
+	peerCounts := make([]*redis.IntCmd, 0, len(rooms))
+	for _, key := range rooms {
+		peerCounts = append(peerCounts, pipeline.HLen(strings.TrimSuffix(key, ":room")+":peers"))
+	}
+	queueLengths := make([]*redis.IntCmd, 0, len(queues))
+	for _, key := range queues {
+		queueLengths = append(queueLengths, pipeline.LLen(key))
+	}
+	if len(rooms)+len(queues) > 0 {
+		if _, err := pipeline.Exec(); err != nil {
+			return stats, err
+		}
+	}
+	stats.Rooms = len(rooms)
+	for _, count := range peerCounts {
+		stats.Peers += int(count.Val())
+	}
+	for _, length := range queueLengths {
+		stats.QueuedMessages += int(length.Val())
+	}
+	return stats, nil
+}
+
+// Reap - Scans every room, replicas reaping at the same time remove each peer only once
+func (store *redisStore) Reap(timeout time.Duration) (int, error) {
+	keys, err := store.scan(redisPrefix + "{*}:room")
+	if err != nil {
+		return 0, err
+	}
+	tokens := make([]string, 0, len(keys))
+	pipeline := store.client.Pipeline()
+	seenFields := make([]*redis.StringStringMapCmd, 0, len(keys))
+	for _, key := range keys {
+		token := strings.TrimSuffix(strings.TrimPrefix(key, redisPrefix+"{"), "}:room")
+		tokens = append(tokens, token)
+		seenFields = append(seenFields, pipeline.HGetAll(seenKey(token)))
+	}
+	if len(keys) > 0 {
+		if _, err := pipeline.Exec(); err != nil {
+			return 0, err
+		}
+	}
+
+	cutoff := time.Now().Add(-timeout)
+	reaped := 0
+	for index, token := range tokens {
+		for id, value := range seenFields[index].Val() {
+			seen, _ := strconv.ParseInt(value, 10, 64)
+			if !time.Unix(0, seen).Before(cutoff) {
+				continue
+			}
+			// Checked again by the script, the peer may have called in the meantime
+			removed, err := store.remove(token, id, cutoff)
+			if err != nil {
+				return reaped, err
+			}
+			if removed {
+				reaped++
+			}
+		}
+	}
+	return reaped, nil
+}
+
+// scan - Every key matching pattern
+func (store *redisStore) scan(pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	iterator := store.client.Scan(0, pattern, 1000).Iterator()
+	for iterator.Next() {
+		keys = append(keys, iterator.Val())
+	}
+	return keys, iterator.Err()
+}
+
+func (store *redisStore) Close() error {
+	store.pubsub.Close()
+	return store.client.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How the server listens and who it believes about client addresses
+
+// defaultAddr - GO_SEND_ADDR, else :$PORT as platforms that assign a port set it, else :8080
+func defaultAddr() string {
+	if addr := os.Getenv("GO_SEND_ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// ParseTrustedProxies - Parses a comma separated list of IP addresses and CIDR ranges
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	trusted := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// TrustProxies - Lets gin take the client's address from X-Forwarded-For only on requests coming
+// through a trusted proxy, and then only the address the last trusted proxy saw. Anyone else could
+// make up the header to dodge rate limits and lockouts.
+func TrustProxies(trusted []*net.IPNet) gin.HandlerFunc {
+	isTrusted := func(address string) bool {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		for _, network := range trusted {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(c *gin.Context) {
+		remote, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			remote = c.Request.RemoteAddr
+		}
+		forwarded := c.Request.Header.Get("X-Forwarded-For")
+		realIP := c.Request.Header.Get("X-Real-Ip")
+		c.Request.Header.Del("X-Forwarded-For")
+		c.Request.Header.Del("X-Real-Ip")
+		if !isTrusted(remote) {
+			return
+		}
+		if forwarded == "" {
+			if realIP != "" {
+				c.Request.Header.Set("X-Real-Ip", realIP)
+			}
+			return
+		}
+		// Proxies append the address they saw, the first untrusted one from the right is the client
+		hops := strings.Split(forwarded, ",")
+		for index := len(hops) - 1; index >= 0; index-- {
+			if hop := strings.TrimSpace(hops[index]); !isTrusted(hop) || index == 0 {
+				c.Request.Header.Set("X-Forwarded-For", hop)
+				return
+			}
+		}
+	}
+}
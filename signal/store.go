@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahadevans87/go-send/protocol"
+)
+
+// Where rooms, their message queues and their events live. A single server keeps them in memory,
+// replicas behind a load balancer share them through Redis so that peers landing on different
+// replicas still meet.
+
+// Errors of Store
+var (
+	ErrRoomFull   = errors.New("Cannot add additional peer to token")
+	ErrRoomSize   = errors.New("The room was opened for a different number of peers, every peer must pass the same -peers")
+	ErrNotOwner   = errors.New("The room belongs to someone else")
+	ErrNoSuchPeer = errors.New("No such peer")
+	ErrQueueFull  = errors.New("The peer's queue is full")
+	ErrNoSuchRoom = errors.New("No such room")
+)
+
+// StoreStats - What a store holds right now
+type StoreStats struct {
+	Rooms          int
+	Peers          int
+	QueuedMessages int
+}
+
+// PeerStatus - A peer as the admin API shows it
+type PeerStatus struct {
+	ID   string `json:"id"`
+	Mode string `json:"mode"`
+	// LastSeen - When the peer last called the server with its session
+	LastSeen time.Time `json:"lastSeen"`
+	// Queued - Messages waiting for the peer to fetch them
+	Queued int `json:"queued"`
+}
+
+// RoomStatus - A room as the admin API shows it
+type RoomStatus struct {
+	Token   string       `json:"token"`
+	Size    int          `json:"size"`
+	Owner   string       `json:"owner"`
+	Created time.Time    `json:"created"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// Store - Rooms with their peers, a message queue per peer and the events of each room
+type Store interface {
+	// Join - Adds peer to the room of token, opening it with size and owner if there is none. A size of
+	// 0 opens the room with DefaultRoomSize and joins one of any size, any other size must match the
+	// room's. Returns the room as joined, fails with ErrNotOwner, ErrRoomSize or ErrRoomFull.
+	Join(token string, size int, owner string, peer *PeerInfo) (*Room, error)
+	// Leave - Removes a peer, closing the room with its last one. Fails with ErrNoSuchPeer.
+	Leave(token string, id string) error
+	// Room - The room of token, nil if there is none
+	Room(token string) (*Room, error)
+	// Touch - Records that a peer of the room was just heard from
+	Touch(token string, id string) error
+	// Rooms - Every room with the state of its peers
+	Rooms() ([]RoomStatus, error)
+	// RoomStatus - The room of token with the state of its peers, nil if there is none
+	RoomStatus(token string) (*RoomStatus, error)
+	// CloseRoom - Removes every peer of a room and the room with them. Fails with ErrNoSuchRoom.
+	CloseRoom(token string) error
+	// Enqueue - Queues a message for message.To unless capacity messages are waiting for it already,
+	// then fails with ErrQueueFull. Fails with ErrNoSuchPeer if the peer is gone.
+	Enqueue(message protocol.Message, capacity int) error
+	// Dequeue - Takes every message waiting for a peer, waiting up to wait for one if there are none
+	Dequeue(ctx context.Context, token string, id string, wait time.Duration) ([]protocol.Message, error)
+	// Subscribe - The events of a room until cancelled or the room closes
+	Subscribe(token string) (<-chan protocol.RoomEvent, func())
+	// Stats - Counts rooms, peers and the messages waiting for them
+	Stats() (StoreStats, error)
+	// Reap - Removes the peers not seen within timeout, closing the rooms they leave empty. Returns
+	// how many were removed.
+	Reap(timeout time.Duration) (int, error)
+	Close() error
+}
+
+// NewStore - The store named by url: memory, or redis://[:password@]host:port/db. Peers not seen
+// within peerTimeout are meant to be reaped, Redis expires rooms nobody reaps after a while longer.
+// 0 keeps them for good.
+func NewStore(url string, peerTimeout time.Duration) (Store, error) {
+	if url == "memory" {
+		return newMemoryStore(), nil
+	}
+	if strings.HasPrefix(url, "redis://") || strings.HasPrefix(url, "rediss://") {
+		return newRedisStore(url, 2*peerTimeout)
+	}
+	return nil, errors.New("The store must be memory or a redis:// URL")
+}
+
+// reapSilentPeers - Regularly removes the peers that crashed or lost their network without leaving,
+// so that their rooms do not stay open for good
+func reapSilentPeers(store Store, timeout time.Duration) {
+	interval := timeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		if reaped, err := store.Reap(timeout); err != nil {
+			log.Printf("Store: %v", err)
+		} else if reaped > 0 {
+			log.Printf("Removed %d peers not seen for %v", reaped, timeout)
+		}
+	}
+}
+
+// memoryRoom - A room with the queues of its peers
+type memoryRoom struct {
+	Room
+	queues map[string][]protocol.Message
+	seen   map[string]time.Time
+}
+
+// memoryStore - Keeps everything in this process
+type memoryStore struct {
+	hub *hub
+
+	mux   sync.Mutex
+	rooms map[string]*memoryRoom
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{hub: newHub(), rooms: make(map[string]*memoryRoom)}
+}
+
+func (store *memoryStore) Join(token string, size int, owner string, peer *PeerInfo) (*Room, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[token]
+	if room == nil {
+		opened := size
+		if opened == 0 {
+			opened = DefaultRoomSize
+		}
+		room = &memoryRoom{Room: Room{Size: opened, Peers: make([]*PeerInfo, 0), Owner: owner, Created: time.Now()}, queues: make(map[string][]protocol.Message), seen: make(map[string]time.Time)}
+		store.rooms[token] = room
+	}
+	if room.Owner != owner {
+		return nil, ErrNotOwner
+	}
+	if size != 0 && size != room.Size {
+		return nil, ErrRoomSize
+	}
+	if len(room.Peers) == room.Size {
+		return nil, ErrRoomFull
+	}
+	room.Peers = append(room.Peers, peer)
+	room.seen[peer.ID] = time.Now()
+	store.hub.publish(token, protocol.RoomEvent{Name: protocol.EventPeerJoined, Data: map[string]string{"id": peer.ID, "mode": peer.Mode}})
+	return room.copy(), nil
+}
+
+func (store *memoryStore) Leave(token string, id string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[token]
+	if room == nil {
+		return ErrNoSuchPeer
+	}
+	for index, peer := range room.Peers {
+		if peer.ID == id {
+			store.remove(token, room, index)
+			return nil
+		}
+	}
+	return ErrNoSuchPeer
+}
+
+// remove - Removes the peer at index from the room, closing it with its last peer. The caller holds mux.
+func (store *memoryStore) remove(token string, room *memoryRoom, index int) {
+	id := room.Peers[index].ID
+	room.Peers = append(room.Peers[:index], room.Peers[index+1:]...)
+	delete(room.queues, id)
+	delete(room.seen, id)
+	store.hub.publish(token, protocol.RoomEvent{Name: protocol.EventPeerLeft, Data: map[string]string{"id": id}})
+	if len(room.Peers) == 0 {
+		delete(store.rooms, token)
+		store.hub.publish(token, protocol.RoomEvent{Name: protocol.EventRoomClosed, Data: map[string]string{}})
+	}
+}
+
+func (store *memoryStore) Room(token string) (*Room, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[token]
+	if room == nil {
+		return nil, nil
+	}
+	return room.copy(), nil
+}
+
+func (store *memoryStore) Touch(token string, id string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	if room := store.rooms[token]; room != nil && room.has(id) {
+		room.seen[id] = time.Now()
+	}
+	return nil
+}
+
+func (store *memoryStore) Rooms() ([]RoomStatus, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	rooms := make([]RoomStatus, 0, len(store.rooms))
+	for token, room := range store.rooms {
+		rooms = append(rooms, room.status(token))
+	}
+	return rooms, nil
+}
+
+func (store *memoryStore) RoomStatus(token string) (*RoomStatus, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[token]
+	if room == nil {
+		return nil, nil
+	}
+	status := room.status(token)
+	return &status, nil
+}
+
+func (store *memoryStore) CloseRoom(token string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[token]
+	if room == nil {
+		return ErrNoSuchRoom
+	}
+	delete(store.rooms, token)
+	for _, peer := range room.Peers {
+		store.hub.publish(token, protocol.RoomEvent{Name: protocol.EventPeerLeft, Data: map[string]string{"id": peer.ID}})
+	}
+	store.hub.publish(token, protocol.RoomEvent{Name: protocol.EventRoomClosed, Data: map[string]string{}})
+	return nil
+}
+
+func (store *memoryStore) Enqueue(message protocol.Message, capacity int) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	room := store.rooms[message.Token]
+	if room == nil || !room.has(message.To) {
+		return ErrNoSuchPeer
+	}
+	if len(room.queues[message.To]) >= capacity {
+		return ErrQueueFull
+	}
+	room.queues[message.To] = append(room.queues[message.To], message)
+	store.hub.publish(message.Token, protocol.RoomEvent{Name: protocol.EventMessageAvailable, Data: map[string]string{"from": message.From, "to": message.To, "type": message.Type}})
+	return nil
+}
+
+func (store *memoryStore) Dequeue(ctx context.Context, token string, id string, wait time.Duration) ([]protocol.Message, error) {
+	return store.hub.waitForMessages(ctx, token, id, wait, func() ([]protocol.Message, error) {
+		store.mux.Lock()
+		defer store.mux.Unlock()
+		messages := make([]protocol.Message, 0)
+		if room := store.rooms[token]; room != nil {
+			messages = append(messages, room.queues[id]...)
+			delete(room.queues, id)
+		}
+		return messages, nil
+	})
+}
+
+func (store *memoryStore) Subscribe(token string) (<-chan protocol.RoomEvent, func()) {
+	return store.hub.subscribe(token)
+}
+
+func (store *memoryStore) Stats() (StoreStats, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	stats := StoreStats{Rooms: len(store.rooms)}
+	for _, room := range store.rooms {
+		stats.Peers += len(room.Peers)
+		for _, queue := range room.queues {
+			stats.QueuedMessages += len(queue)
+		}
+	}
+	return stats, nil
+}
+
+func (store *memoryStore) Reap(timeout time.Duration) (int, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	cutoff := time.Now().Add(-timeout)
+	reaped := 0
+	for token, room := range store.rooms {
+		// Backwards, removing a peer shifts those after it
+		for index := len(room.Peers) - 1; index >= 0; index-- {
+			if room.seen[room.Peers[index].ID].Before(cutoff) {
+				store.remove(token, room, index)
+				reaped++
+			}
+		}
+	}
+	return reaped, nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
+
+// copy - A snapshot of the room that stays the same while it changes
+func (room *memoryRoom) copy() *Room {
+	copied := room.Room
+	copied.Peers = append([]*PeerInfo(nil), room.Peers...)
+	return &copied
+}
+
+// status - The room as the admin API shows it
+func (room *memoryRoom) status(token string) RoomStatus {
+	status := RoomStatus{Token: token, Size: room.Size, Owner: room.Owner, Created: room.Created, Peers: make([]PeerStatus, 0, len(room.Peers))}
+	for _, peer := range room.Peers {
+		status.Peers = append(status.Peers, PeerStatus{ID: peer.ID, Mode: peer.Mode, LastSeen: room.seen[peer.ID], Queued: len(room.queues[peer.ID])})
+	}
+	return status
+}
+
+// has - Whether the peer id is in the room
+func (room *Room) has(id string) bool {
+	for _, peer := range room.Peers {
+		if peer.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mahadevans87/go-send/protocol"
+)
+
+// forEachStore - Runs test against a fresh memory store and a Redis store. Redis is an in-process
+// miniredis unless GO_SEND_TEST_REDIS holds a redis:// URL; that database is flushed first, give it
+// one of its own.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		url := os.Getenv("GO_SEND_TEST_REDIS")
+		if url == "" {
+			server, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			url = "redis://" + server.Addr()
+		}
+		store, err := newRedisStore(url, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		if err := store.client.FlushDB().Err(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+}
+
+// join - Adds a peer called id to the room of token, failing the test unless it is let in
+func join(t *testing.T, store Store, token string, size int, id string) {
+	t.Helper()
+	if _, err := store.Join(token, size, "", &PeerInfo{Token: token, ID: id, Mode: "R"}); err != nil {
+		t.Fatalf("Join %s: %v", id, err)
+	}
+}
+
+// message - An ICE message between two peers of the room of token
+func message(token string, from string, to string, data string) protocol.Message {
+	return protocol.Message{Type: protocol.TypeICE, Token: token, From: from, To: to, Data: []byte(fmt.Sprintf("%q", data))}
+}
+
+func TestJoin(t *testing.T) {
+	type attempt struct {
+		size  int
+		owner string
+	}
+	tests := []struct {
+		name     string
+		joins    []attempt
+		wantErr  error
+		wantSize int
+	}{
+		{name: "opens with the default size", joins: []attempt{{0, ""}}, wantSize: DefaultRoomSize},
+		{name: "opens with the size asked for", joins: []attempt{{3, ""}}, wantSize: 3},
+		{name: "no size joins a room of any size", joins: []attempt{{3, ""}, {0, ""}}, wantSize: 3},
+		{name: "the same size joins", joins: []attempt{{3, ""}, {3, ""}, {3, ""}}, wantSize: 3},
+		{name: "a different size is refused", joins: []attempt{{3, ""}, {2, ""}}, wantErr: ErrRoomSize},
+		{name: "someone else's room is refused", joins: []attempt{{2, "alpha"}, {2, "beta"}}, wantErr: ErrNotOwner},
+		{name: "the owner joins again", joins: []attempt{{2, "alpha"}, {2, "alpha"}}, wantSize: 2},
+		{name: "a full room is refused", joins: []attempt{{2, ""}, {2, ""}, {2, ""}}, wantErr: ErrRoomFull},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				var room *Room
+				var err error
+				for index, joining := range test.joins {
+					room, err = store.Join("t", joining.size, joining.owner, &PeerInfo{Token: "t", ID: fmt.Sprint("p", index), Mode: "R"})
+					if err != nil && index < len(test.joins)-1 {
+						t.Fatalf("Join %d: %v", index, err)
+					}
+				}
+				if err != test.wantErr {
+					t.Fatalf("Join: got %v, want %v", err, test.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if room.Size != test.wantSize || len(room.Peers) != len(test.joins) {
+					t.Errorf("Got a room of %d with %d peers, want %d with %d", room.Size, len(room.Peers), test.wantSize, len(test.joins))
+				}
+				if last := room.Peers[len(room.Peers)-1].ID; last != fmt.Sprint("p", len(test.joins)-1) {
+					t.Errorf("Peers are not in the order they joined, last is %s", last)
+				}
+			})
+		})
+	}
+}
+
+func TestLeave(t *testing.T) {
+	tests := []struct {
+		name      string
+		peers     []string
+		leave     string
+		token     string
+		wantErr   error
+		wantPeers int
+	}{
+		{name: "a peer leaves", peers: []string{"a", "b"}, leave: "a", token: "t", wantPeers: 1},
+		{name: "the last peer closes the room", peers: []string{"a"}, leave: "a", token: "t", wantPeers: 0},
+		{name: "no such peer", peers: []string{"a"}, leave: "b", token: "t", wantErr: ErrNoSuchPeer, wantPeers: 1},
+		{name: "no such room", peers: []string{"a"}, leave: "a", token: "other", wantErr: ErrNoSuchPeer, wantPeers: 1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				for _, id := range test.peers {
+					join(t, store, "t", 2, id)
+				}
+				if err := store.Leave(test.token, test.leave); err != test.wantErr {
+					t.Fatalf("Leave: got %v, want %v", err, test.wantErr)
+				}
+				room, err := store.Room("t")
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case test.wantPeers == 0 && room != nil:
+					t.Errorf("The room is still open with %d peers", len(room.Peers))
+				case test.wantPeers > 0 && (room == nil || len(room.Peers) != test.wantPeers):
+					t.Errorf("Got room %+v, want %d peers", room, test.wantPeers)
+				}
+			})
+		})
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		queued   int
+		to       string
+		capacity int
+		wantErr  error
+	}{
+		{name: "queued", queued: 0, to: "b", capacity: 2},
+		{name: "queued up to capacity", queued: 1, to: "b", capacity: 2},
+		{name: "a full queue is refused", queued: 2, to: "b", capacity: 2, wantErr: ErrQueueFull},
+		{name: "no such peer", queued: 0, to: "c", capacity: 2, wantErr: ErrNoSuchPeer},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				join(t, store, "t", 2, "a")
+				join(t, store, "t", 2, "b")
+				for index := 0; index < test.queued; index++ {
+					if err := store.Enqueue(message("t", "a", "b", fmt.Sprint(index)), test.capacity); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := store.Enqueue(message("t", "a", test.to, "last"), test.capacity); err != test.wantErr {
+					t.Fatalf("Enqueue: got %v, want %v", err, test.wantErr)
+				}
+			})
+		})
+	}
+}
+
+func TestDequeue(t *testing.T) {
+	tests := []struct {
+		name string
+		// queued - Messages waiting before Dequeue, late - one arriving while it waits
+		queued   []string
+		late     bool
+		wait     time.Duration
+		wantData []string
+	}{
+		{name: "takes what is queued, in order", queued: []string{"1", "2"}, wantData: []string{"1", "2"}},
+		{name: "nothing queued without waiting", wantData: []string{}},
+		{name: "waits for a message", late: true, wait: 10 * time.Second, wantData: []string{"late"}},
+		{name: "gives up once the wait is over", wait: 100 * time.Millisecond, wantData: []string{}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				join(t, store, "t", 2, "a")
+				join(t, store, "t", 2, "b")
+				for _, data := range test.queued {
+					if err := store.Enqueue(message("t", "a", "b", data), 10); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if test.late {
+					go func() {
+						time.Sleep(100 * time.Millisecond)
+						store.Enqueue(message("t", "a", "b", "late"), 10)
+					}()
+				}
+				started := time.Now()
+				messages, err := store.Dequeue(context.Background(), "t", "b", test.wait)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.late && time.Since(started) > test.wait/2 {
+					t.Errorf("Woke up only after %v", time.Since(started))
+				}
+				data := make([]string, 0, len(messages))
+				for _, message := range messages {
+					data = append(data, string(message.Data))
+				}
+				if fmt.Sprint(data) != fmt.Sprint(quoted(test.wantData)) {
+					t.Errorf("Got %v, want %v", data, quoted(test.wantData))
+				}
+				// Taken messages are gone
+				if again, _ := store.Dequeue(context.Background(), "t", "b", 0); len(again) != 0 {
+					t.Errorf("Got %d messages a second time", len(again))
+				}
+			})
+		})
+	}
+}
+
+// quoted - Each of data as JSON strings
+func quoted(data []string) []string {
+	result := make([]string, 0, len(data))
+	for _, value := range data {
+		result = append(result, fmt.Sprintf("%q", value))
+	}
+	return result
+}
+
+func TestCloseRoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   []string
+		token   string
+		wantErr error
+	}{
+		{name: "closes a room with its peers and queues", peers: []string{"a", "b", "c"}, token: "t"},
+		{name: "no such room", peers: []string{"a"}, token: "other", wantErr: ErrNoSuchRoom},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				for _, id := range test.peers {
+					join(t, store, "t", len(test.peers), id)
+					if err := store.Enqueue(message("t", test.peers[0], id, "hello"), 10); err != nil {
+						t.Fatal(err)
+					}
+				}
+				events, cancel := store.Subscribe("t")
+				defer cancel()
+				if err := store.CloseRoom(test.token); err != test.wantErr {
+					t.Fatalf("CloseRoom: got %v, want %v", err, test.wantErr)
+				}
+				if test.wantErr != nil {
+					return
+				}
+				stats, err := store.Stats()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stats != (StoreStats{}) {
+					t.Errorf("The store still holds %+v", stats)
+				}
+				left := 0
+				timeout := time.After(5 * time.Second)
+				for {
+					select {
+					case event := <-events:
+						if event.Name == protocol.EventPeerLeft {
+							left++
+						}
+						if event.Name != protocol.EventRoomClosed {
+							continue
+						}
+						if left != len(test.peers) {
+							t.Errorf("Got %d peer-left events, want %d", left, len(test.peers))
+						}
+						return
+					case <-timeout:
+						t.Fatal("No room-closed event")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name string
+		// rooms - The peers of each room, each peer gets queued messages from the first
+		rooms  map[string][]string
+		queued int
+		want   StoreStats
+	}{
+		{name: "empty", want: StoreStats{}},
+		{name: "one room", rooms: map[string][]string{"t": {"a", "b"}}, queued: 1, want: StoreStats{Rooms: 1, Peers: 2, QueuedMessages: 2}},
+		{name: "several rooms", rooms: map[string][]string{"t": {"a", "b"}, "u": {"c", "d", "e"}}, queued: 2, want: StoreStats{Rooms: 2, Peers: 5, QueuedMessages: 10}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				for token, peers := range test.rooms {
+					for _, id := range peers {
+						join(t, store, token, len(peers), id)
+					}
+					for _, id := range peers {
+						for index := 0; index < test.queued; index++ {
+							if err := store.Enqueue(message(token, peers[0], id, fmt.Sprint(index)), 10); err != nil {
+								t.Fatal(err)
+							}
+						}
+					}
+				}
+				stats, err := store.Stats()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stats != test.want {
+					t.Errorf("Got %+v, want %+v", stats, test.want)
+				}
+			})
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantReaped int
+	}{
+		{name: "keeps peers seen within the timeout", timeout: time.Hour, wantReaped: 0},
+		{name: "removes silent peers and closes their room", timeout: 0, wantReaped: 2},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				join(t, store, "t", 2, "a")
+				join(t, store, "t", 2, "b")
+				reaped, err := store.Reap(test.timeout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reaped != test.wantReaped {
+					t.Errorf("Reaped %d peers, want %d", reaped, test.wantReaped)
+				}
+				stats, err := store.Stats()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wantPeers := 2 - test.wantReaped; stats.Peers != wantPeers || (wantPeers == 0) != (stats.Rooms == 0) {
+					t.Errorf("The store holds %+v after reaping", stats)
+				}
+			})
+		})
+	}
+}
+
+func TestRoomStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		wantPeers  []string
+		wantQueued []int
+	}{
+		{name: "a room with its peers in the order they joined", token: "t", wantPeers: []string{"a", "b"}, wantQueued: []int{0, 2}},
+		{name: "no such room", token: "other"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				join(t, store, "t", 2, "a")
+				join(t, store, "t", 2, "b")
+				for index := 0; index < 2; index++ {
+					if err := store.Enqueue(message("t", "a", "b", fmt.Sprint(index)), 10); err != nil {
+						t.Fatal(err)
+					}
+				}
+				status, err := store.RoomStatus(test.token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.wantPeers == nil {
+					if status != nil {
+						t.Errorf("Got %+v, want no room", status)
+					}
+					return
+				}
+				if status == nil || status.Token != test.token || status.Size != 2 || len(status.Peers) != len(test.wantPeers) {
+					t.Fatalf("Got %+v", status)
+				}
+				for index, peer := range status.Peers {
+					if peer.ID != test.wantPeers[index] || peer.Queued != test.wantQueued[index] || peer.LastSeen.IsZero() {
+						t.Errorf("Peer %d is %+v, want %s with %d queued", index, peer, test.wantPeers[index], test.wantQueued[index])
+					}
+				}
+			})
+		})
+	}
+}